@@ -0,0 +1,360 @@
+package app
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// AccessLogFormat is the access log entry encoding
+type AccessLogFormat int
+
+const (
+	AccessLogJSON AccessLogFormat = iota
+	AccessLogLogfmt
+)
+
+// ParseAccessLogFormat parses json or logfmt
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch s {
+	case "json":
+		return AccessLogJSON, nil
+	case "logfmt":
+		return AccessLogLogfmt, nil
+	}
+	return AccessLogJSON, fmt.Errorf("unknown access log format: %q", s)
+}
+
+// AccessLogOptions configure the access log
+type AccessLogOptions struct {
+	// Path is the log file name, stderr is used if it is empty or "-"
+	Path   string
+	Format AccessLogFormat
+	// SampleRate is the fraction of requests to log, from 0 to 1
+	SampleRate float64
+	// SlowThreshold makes the requests taking at least that long logged
+	// regardless of the sampling, 0 disables it
+	SlowThreshold time.Duration
+}
+
+// accessLogFlushInterval is how often the buffered entries are written to the
+// file
+const accessLogFlushInterval = time.Second
+
+// errAccessLogClosed is returned by Reopen after Close
+var errAccessLogClosed = errors.New("access log is closed")
+
+var headerRequestID = []byte("X-Request-ID")
+
+// AccessLog writes an entry for every sampled or slow request
+type AccessLog struct {
+	opts AccessLogOptions
+
+	// requests is the sampling counter
+	requests uint64
+	// ids and idPrefix make the generated request IDs
+	ids      uint64
+	idPrefix string
+
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	closed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenAccessLog opens the access log file and starts the goroutine to flush
+// it periodically
+func OpenAccessLog(opts AccessLogOptions) (*AccessLog, error) {
+	if opts.SampleRate < 0 || opts.SampleRate > 1 {
+		return nil, fmt.Errorf("access log sample rate should be from 0 to 1, got %v", opts.SampleRate)
+	}
+	prefix := make([]byte, 4)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	l := &AccessLog{
+		opts:     opts,
+		idPrefix: hex.EncodeToString(prefix) + "-",
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	go l.flusher()
+	return l, nil
+}
+
+func (l *AccessLog) toStderr() bool {
+	return l.opts.Path == "" || l.opts.Path == "-"
+}
+
+// Reopen reopens the log file, it is called on SIGHUP after the file is
+// rotated
+func (l *AccessLog) Reopen() error {
+
+	var f *os.File
+	if l.toStderr() {
+		f = os.Stderr
+	} else {
+		var err error
+		f, err = os.OpenFile(l.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		if f != os.Stderr {
+			f.Close()
+		}
+		return errAccessLogClosed
+	}
+	if l.w != nil {
+		l.w.Flush()
+	}
+	if l.f != nil && l.f != os.Stderr {
+		l.f.Close()
+	}
+	l.f = f
+	l.w = bufio.NewWriterSize(f, 64<<10)
+
+	return nil
+}
+
+func (l *AccessLog) flusher() {
+	defer close(l.done)
+	t := time.NewTicker(accessLogFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.Flush()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Close stops the flusher, writes the buffered entries and closes the log
+// file. The requests finished after it aren't logged.
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	close(l.stop)
+	<-l.done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.w.Flush()
+	if l.f != os.Stderr {
+		if cerr := l.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Flush writes the buffered entries
+func (l *AccessLog) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	return l.w.Flush()
+}
+
+// requestID takes X-Request-ID of the request, or generates a new one, and
+// sets it in the response. The generated ID is built on the stack and copied
+// to the response header, so it doesn't allocate.
+func (l *AccessLog) requestID(ctx *fasthttp.RequestCtx) []byte {
+	var buf [32]byte
+	id := ctx.Request.Header.PeekBytes(headerRequestID)
+	if len(id) == 0 {
+		id = strconv.AppendUint(append(buf[:0], l.idPrefix...), atomic.AddUint64(&l.ids, 1), 36)
+	}
+	ctx.Response.Header.SetBytesKV(headerRequestID, id)
+	return ctx.Response.Header.PeekBytes(headerRequestID)
+}
+
+// sampled tells if the next request should be logged, every request moves
+// the counter so the rate is kept exactly
+func (l *AccessLog) sampled() bool {
+	if l.opts.SampleRate >= 1 {
+		return true
+	}
+	n := float64(atomic.AddUint64(&l.requests, 1))
+	return uint64(n*l.opts.SampleRate) != uint64((n-1)*l.opts.SampleRate)
+}
+
+type accessLogEntry struct {
+	t         time.Time
+	method    []byte
+	uri       []byte
+	route     route
+	id        uint32
+	status    int
+	bytes     int
+	latency   time.Duration
+	remote    string
+	requestID []byte
+	slow      bool
+}
+
+func (l *AccessLog) log(ctx *fasthttp.RequestCtx, t0 time.Time, latency time.Duration, rt route, id uint32, status int, requestID []byte) {
+
+	slow := l.opts.SlowThreshold > 0 && latency >= l.opts.SlowThreshold
+	if !l.sampled() && !slow {
+		return
+	}
+
+	e := accessLogEntry{
+		t:         t0,
+		method:    ctx.Method(),
+		uri:       ctx.Request.Header.RequestURI(),
+		route:     rt,
+		id:        id,
+		status:    status,
+		bytes:     len(ctx.Response.Body()),
+		latency:   latency,
+		remote:    ctx.RemoteAddr().String(),
+		requestID: requestID,
+		slow:      slow,
+	}
+
+	buf := fasthttp.AcquireByteBuffer()
+	defer fasthttp.ReleaseByteBuffer(buf)
+
+	if l.opts.Format == AccessLogLogfmt {
+		buf.B = e.appendLogfmt(buf.B)
+	} else {
+		buf.B = e.appendJSON(buf.B)
+	}
+	buf.B = append(buf.B, '\n')
+
+	l.mu.Lock()
+	if !l.closed {
+		l.w.Write(buf.B)
+	}
+	l.mu.Unlock()
+}
+
+func (e *accessLogEntry) appendJSON(b []byte) []byte {
+	b = append(b, `{"time":`...)
+	b = appendJSONString(b, e.t.Format(time.RFC3339Nano))
+	b = append(b, `,"request_id":`...)
+	b = appendJSONString(b, string(e.requestID))
+	b = append(b, `,"method":`...)
+	b = appendJSONString(b, string(e.method))
+	b = append(b, `,"uri":`...)
+	b = appendJSONString(b, string(e.uri))
+	b = append(b, `,"route":"`...)
+	b = append(b, routeNames[e.route]...)
+	b = append(b, '"')
+	if e.id != 0 {
+		b = append(b, `,"id":`...)
+		b = strconv.AppendUint(b, uint64(e.id), 10)
+	}
+	b = append(b, `,"status":`...)
+	b = strconv.AppendInt(b, int64(e.status), 10)
+	b = append(b, `,"bytes":`...)
+	b = strconv.AppendInt(b, int64(e.bytes), 10)
+	b = append(b, `,"latency":`...)
+	b = strconv.AppendFloat(b, e.latency.Seconds(), 'f', -1, 64)
+	b = append(b, `,"remote":`...)
+	b = appendJSONString(b, e.remote)
+	if e.slow {
+		b = append(b, `,"slow":true`...)
+	}
+	return append(b, '}')
+}
+
+func (e *accessLogEntry) appendLogfmt(b []byte) []byte {
+	b = append(b, "time="...)
+	b = append(b, e.t.Format(time.RFC3339Nano)...)
+	b = append(b, " request_id="...)
+	b = appendLogfmtValue(b, string(e.requestID))
+	b = append(b, " method="...)
+	b = appendLogfmtValue(b, string(e.method))
+	b = append(b, " uri="...)
+	b = appendLogfmtValue(b, string(e.uri))
+	b = append(b, " route="...)
+	b = append(b, routeNames[e.route]...)
+	if e.id != 0 {
+		b = append(b, " id="...)
+		b = strconv.AppendUint(b, uint64(e.id), 10)
+	}
+	b = append(b, " status="...)
+	b = strconv.AppendInt(b, int64(e.status), 10)
+	b = append(b, " bytes="...)
+	b = strconv.AppendInt(b, int64(e.bytes), 10)
+	b = append(b, " latency="...)
+	b = strconv.AppendFloat(b, e.latency.Seconds(), 'f', -1, 64)
+	b = append(b, " remote="...)
+	b = appendLogfmtValue(b, e.remote)
+	if e.slow {
+		b = append(b, " slow=true"...)
+	}
+	return b
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a JSON string, the control characters, quote
+// and backslash are escaped
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20:
+			b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+// appendLogfmtValue appends s quoted if it is empty or has spaces, quotes,
+// equal signs or control characters
+func appendLogfmtValue(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, `""`...)
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c == '"' || c == '=' || c == '\\' || c == 0x7f {
+			return appendJSONString(b, s)
+		}
+	}
+	return append(b, s...)
+}
+
+// UseAccessLog enables the access log
+func (app *Application) UseAccessLog(l *AccessLog) {
+	app.accessLog = l
+}
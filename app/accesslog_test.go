@@ -0,0 +1,88 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/ei-grad/hlcup/db"
+)
+
+func TestAccessLogRequestID(t *testing.T) {
+
+	l := &AccessLog{idPrefix: "0123abcd-"}
+
+	var ctx fasthttp.RequestCtx
+	if id := string(l.requestID(&ctx)); id != "0123abcd-1" {
+		t.Fatalf("generated id %q", id)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { l.requestID(&ctx) }); allocs != 0 {
+		t.Errorf("generated id allocates %v times", allocs)
+	}
+
+	ctx.Request.Header.Set("X-Request-ID", "given")
+	if id := string(l.requestID(&ctx)); id != "given" {
+		t.Fatalf("id %q, expected the request one", id)
+	}
+	if id := string(ctx.Response.Header.Peek("X-Request-ID")); id != "given" {
+		t.Fatalf("response id %q", id)
+	}
+}
+
+func TestAccessLogClose(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	l, err := OpenAccessLog(AccessLogOptions{Path: path, Format: AccessLogLogfmt, SampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewApplication(db.NewMapStorage())
+	a.UseAccessLog(l)
+
+	testRequest(a, "GET", "/users/1", nil)
+	// the entry is buffered until the flush interval
+	if b, _ := ioutil.ReadFile(path); len(b) != 0 {
+		t.Fatalf("entry is written before the flush: %s", b)
+	}
+
+	if err := a.Close(false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-l.done:
+	default:
+		t.Fatal("flusher is not stopped")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("uri=/users/1 ")) || bytes.Count(b, []byte("\n")) != 1 {
+		t.Fatalf("log after close: %q", b)
+	}
+
+	// the requests after the drain timeout aren't logged
+	testRequest(a, "GET", "/users/2", nil)
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reopen(); err != errAccessLogClosed {
+		t.Fatalf("reopen after close: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b2, _ := ioutil.ReadFile(path); !bytes.Equal(b, b2) {
+		t.Fatalf("log is written after close: %q", b2)
+	}
+}
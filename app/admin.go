@@ -0,0 +1,213 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// DefaultCPUProfileDuration and DefaultTraceDuration are used if the
+	// seconds parameter is not set
+	DefaultCPUProfileDuration = 30 * time.Second
+	DefaultTraceDuration      = time.Second
+	// MaxProfileDuration limits the seconds parameter
+	MaxProfileDuration = 10 * time.Minute
+)
+
+var (
+	bytesAdminPrefix   = []byte("/admin/")
+	bytesPprofPrefix   = []byte("/debug/pprof/")
+	bytesAuthorization = []byte("Authorization")
+	bytesBearer        = []byte("Bearer ")
+	bytesAdminToken    = []byte("X-Admin-Token")
+)
+
+// cpuProfiling, tracing, blockProfiling and mutexProfiling are set while the
+// profile is being collected, only one of each could run in the process
+var cpuProfiling, tracing, blockProfiling, mutexProfiling int32
+
+// SetAdminToken protects the admin endpoints with the token. If it is not
+// empty the endpoints are also served on the main port under /admin/, the
+// token is taken from "Authorization: Bearer" or X-Admin-Token header.
+func (app *Application) SetAdminToken(token string) {
+	app.adminToken = []byte(token)
+}
+
+// AdminHandler serves the admin endpoints on the separate listener:
+//
+//     /debug/pprof/profile?seconds=N   - CPU profile
+//     /debug/pprof/trace?seconds=N     - execution trace
+//     /debug/pprof/heap                - heap profile
+//     /debug/pprof/goroutine?debug=N   - goroutine stacks
+//     /debug/pprof/block?seconds=N     - blocking profile
+//     /debug/pprof/mutex?seconds=N     - mutex contention profile
+//     /reload                          - POST to reload the data file, GET
+//                                        for the progress
+//
+// Block and mutex profiles are collected for N seconds if set, or the
+// profiles accumulated since the rate was set elsewhere are written.
+func (app *Application) AdminHandler(ctx *fasthttp.RequestCtx) {
+	path := ctx.Path()
+	ctx.SetStatusCode(app.admin(ctx, path))
+}
+
+// isAdminPath tells if the admin endpoints should be served on the main port
+func (app *Application) isAdminPath(path []byte) bool {
+	return len(app.adminToken) > 0 && bytes.HasPrefix(path, bytesAdminPrefix)
+}
+
+func (app *Application) authorized(ctx *fasthttp.RequestCtx) bool {
+	if len(app.adminToken) == 0 {
+		return true
+	}
+	token := ctx.Request.Header.PeekBytes(bytesAdminToken)
+	if auth := ctx.Request.Header.PeekBytes(bytesAuthorization); bytes.HasPrefix(auth, bytesBearer) {
+		token = auth[len(bytesBearer):]
+	}
+	return subtle.ConstantTimeCompare(token, app.adminToken) == 1
+}
+
+// admin serves the admin endpoint by the path without the /admin prefix
+func (app *Application) admin(ctx *fasthttp.RequestCtx, path []byte) int {
+
+	if !app.authorized(ctx) {
+		return http.StatusUnauthorized
+	}
+
+	if bytes.Equal(path, bytesReloadPath) {
+		return app.adminReload(ctx)
+	}
+
+	if !bytes.HasPrefix(path, bytesPprofPrefix) {
+		return http.StatusNotFound
+	}
+
+	if string(ctx.Method()) != "GET" {
+		return http.StatusMethodNotAllowed
+	}
+
+	ctx.SetContentType("application/octet-stream")
+
+	args := ctx.QueryArgs()
+	dbg := debug(args)
+
+	switch name := string(path[len(bytesPprofPrefix):]); name {
+	case "profile":
+		return profileFor(ctx, args, DefaultCPUProfileDuration, &cpuProfiling, func(w *bufio.Writer, d time.Duration) error {
+			if err := pprof.StartCPUProfile(w); err != nil {
+				return err
+			}
+			time.Sleep(d)
+			pprof.StopCPUProfile()
+			return nil
+		})
+	case "trace":
+		return profileFor(ctx, args, DefaultTraceDuration, &tracing, func(w *bufio.Writer, d time.Duration) error {
+			if err := trace.Start(w); err != nil {
+				return err
+			}
+			time.Sleep(d)
+			trace.Stop()
+			return nil
+		})
+	case "block":
+		return profileFor(ctx, args, 0, &blockProfiling, func(w *bufio.Writer, d time.Duration) error {
+			if d > 0 {
+				runtime.SetBlockProfileRate(1)
+				time.Sleep(d)
+				runtime.SetBlockProfileRate(0)
+			}
+			return pprof.Lookup(name).WriteTo(w, dbg)
+		})
+	case "mutex":
+		return profileFor(ctx, args, 0, &mutexProfiling, func(w *bufio.Writer, d time.Duration) error {
+			if d > 0 {
+				old := runtime.SetMutexProfileFraction(1)
+				time.Sleep(d)
+				runtime.SetMutexProfileFraction(old)
+			}
+			return pprof.Lookup(name).WriteTo(w, dbg)
+		})
+	case "heap", "goroutine", "threadcreate":
+		if name == "heap" {
+			// get up-to-date statistics
+			runtime.GC()
+		}
+		if dbg > 0 {
+			ctx.SetContentType("text/plain; charset=utf-8")
+		}
+		if err := pprof.Lookup(name).WriteTo(ctx, dbg); err != nil {
+			log.Printf("admin: can't write %s profile: %s", name, err)
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	}
+
+	return http.StatusNotFound
+}
+
+func debug(args *fasthttp.Args) int {
+	n, _ := strconv.Atoi(string(args.Peek("debug")))
+	return n
+}
+
+func parseSeconds(b []byte, def time.Duration) (time.Duration, error) {
+	if len(b) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid seconds: %q", b)
+	}
+	d := time.Duration(n) * time.Second
+	if d > MaxProfileDuration {
+		return 0, fmt.Errorf("seconds should be at most %d", int(MaxProfileDuration/time.Second))
+	}
+	return d, nil
+}
+
+// profileFor streams the profile collected for the requested duration, the
+// handler returns at once. If the profile is already being collected the
+// request gets 409.
+func profileFor(ctx *fasthttp.RequestCtx, args *fasthttp.Args, def time.Duration, busy *int32, collect func(*bufio.Writer, time.Duration) error) int {
+
+	d, err := parseSeconds(args.Peek("seconds"), def)
+	if err != nil {
+		ctx.SetContentType("text/plain; charset=utf-8")
+		ctx.WriteString(err.Error())
+		return http.StatusBadRequest
+	}
+
+	if !atomic.CompareAndSwapInt32(busy, 0, 1) {
+		ctx.SetContentType("text/plain; charset=utf-8")
+		ctx.WriteString("profile is already being collected")
+		return http.StatusConflict
+	}
+
+	if debug(args) > 0 {
+		ctx.SetContentType("text/plain; charset=utf-8")
+	}
+
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer atomic.StoreInt32(busy, 0)
+		if err := collect(w, d); err != nil {
+			// CPU profiling or tracing could be started outside of the
+			// admin handler
+			log.Printf("admin: can't collect the profile: %s", err)
+		}
+	})
+
+	return http.StatusOK
+}
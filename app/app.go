@@ -2,46 +2,120 @@ package app
 
 import (
 	"bytes"
+	"io"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
 
+	"github.com/ei-grad/hlcup/dataset"
 	"github.com/ei-grad/hlcup/db"
 	"github.com/ei-grad/hlcup/entities"
 )
 
 // Application implements application logic
 type Application struct {
-	db            *db.DB
-	now           time.Time
-	countRequests int32
-	heat          func(entities.Entity, uint32)
+	// dataMu is held shared by the requests, Reload swaps db and now
+	// with all of its shards locked. The requests lock the shard of the
+	// connection, so they don't contend for a single lock.
+	dataMu         *db.ShardedLock
+	db             *db.DB
+	now            referenceTime
+	nowMode        NowMode
+	fixedNow       time.Time
+	countRequests  int32
+	heat           func(entities.Entity, uint32)
+	wal            *db.WALOptions
+	snapshot       *snapshotOptions
+	maxBatchSize   int
+	maxPageLimit   int
+	maxSearchLimit int
+	cache          *ResponseCache
+	dataEntity     string
+	loadMode       dataset.Mode
+	rejectsFile    string
+	load           loadStatus
+	retryAfter     time.Duration
+	metrics        Metrics
+	accessLog      *AccessLog
+	adminToken     []byte
+	inflight       int32
+	draining       int32
+	dataFile       string
+	newStorage     func() (db.Storage, error)
+	reloading      int32
+	reloadPending  int32
+	reload         loadStatus
+	snapshotMu     sync.Mutex
 }
 
-// NewApplication creates new Application
-func NewApplication() *Application {
+const dataMuShards = 64
+
+// NewApplication creates new Application on top of the storage backend
+func NewApplication(s db.Storage) *Application {
 	var app Application
-	app.db = db.New()
+	app.dataMu = db.NewShardedLock(dataMuShards)
+	app.db = db.New(s)
+	app.maxBatchSize = DefaultMaxBatchSize
+	app.maxPageLimit = MaxPageLimit
+	app.maxSearchLimit = MaxSearchLimit
 	return &app
 }
 
+// done accounts the finished request in the metrics and the access log
+func (app *Application) done(ctx *fasthttp.RequestCtx, t0 time.Time, rt route, id uint32, status int, requestID []byte) {
+	if atomic.LoadInt32(&app.draining) == 1 {
+		ctx.SetConnectionClose()
+	}
+	latency := time.Since(t0)
+	app.metrics.observe(rt, status, latency)
+	if app.accessLog != nil {
+		app.accessLog.log(ctx, t0, latency, rt, id, status, requestID)
+	}
+	atomic.AddInt32(&app.inflight, -1)
+	app.dataMu.RUnlock(uint32(ctx.ConnID()))
+}
+
 // RequestHandler contains routing implementation
 func (app *Application) RequestHandler(ctx *fasthttp.RequestCtx) {
 
 	atomic.AddInt32(&app.countRequests, 1)
+	atomic.AddInt32(&app.inflight, 1)
+	app.dataMu.RLock(uint32(ctx.ConnID()))
+
+	t0 := time.Now()
 
 	ctx.SetContentType("application/json; charset=utf8")
 
+	var requestID []byte
+	if app.accessLog != nil {
+		requestID = app.accessLog.requestID(ctx)
+	}
+
+	path := ctx.Request.Header.RequestURI()
+
+	if app.isAdminPath(path) {
+		// /admin/debug/pprof/...
+		status := app.admin(ctx, ctx.Path()[len(bytesAdminPrefix)-1:])
+		ctx.SetStatusCode(status)
+		app.done(ctx, t0, routeOther, 0, status, requestID)
+		return
+	}
+
+	if app.unavailable(ctx, path) {
+		app.done(ctx, t0, routeOther, 0, http.StatusServiceUnavailable, requestID)
+		return
+	}
+
 	var (
 		id     uint32
 		status int
 		err    error
+		rt     route
 	)
 
-	path := ctx.Request.Header.RequestURI()
-
 	switch string(ctx.Method()) {
 
 	case "GET":
@@ -65,10 +139,37 @@ func (app *Application) RequestHandler(ctx *fasthttp.RequestCtx) {
 				switch {
 				case err == nil:
 					// /<entity>/<id:int>
-					status = app.GetEntity(ctx, entities.GetEntityByRoute(entity), id)
+					rt = routeEntityGet
+					switch e := entities.GetEntityByRoute(entity); e {
+					case entities.User:
+						status = app.cached(ctx, cacheUser, id, nil, func(w io.Writer) int {
+							return app.GetEntity(w, e, id)
+						})
+					case entities.Location:
+						status = app.cached(ctx, cacheLocation, id, nil, func(w io.Writer) int {
+							return app.GetEntity(w, e, id)
+						})
+					default:
+						status = app.GetEntity(ctx, e, id)
+					}
 				case bytes.Equal(idBytes, []byte("new")):
 					// /<entity>/new is POST-only, say 405 for convenience
 					status = http.StatusMethodNotAllowed
+				case entities.GetEntityByRoute(entity) == entities.User && isPathPart(idBytes, bytesByEmail):
+					// /users/by-email?email=<email>
+					status = app.GetUserByEmail(ctx, ctx.QueryArgs())
+				case entities.GetEntityByRoute(entity) == entities.Location && isPathPart(idBytes, bytesSearch):
+					// /locations/search?q=<query>&limit=<int>
+					status = app.SearchLocations(ctx, ctx.QueryArgs())
+				case bytes.Equal(entity, bytesHealth) && isPathPart(idBytes, bytesLive):
+					// /health/live
+					status = app.GetLive(ctx)
+				case bytes.Equal(entity, bytesHealth) && isPathPart(idBytes, bytesReady):
+					// /health/ready
+					status = app.GetReady(ctx)
+				case bytes.Equal(entity, bytesStatus) && isPathPart(idBytes, bytesNow):
+					// /status/now
+					status = app.GetNow(ctx)
 				}
 			} else {
 				tailEnd := idEnd + 1
@@ -85,21 +186,43 @@ func (app *Application) RequestHandler(ctx *fasthttp.RequestCtx) {
 						switch {
 						case e == entities.User && bytes.Equal(tail, bytesVisits):
 							// /user/<id>/visits
-							status = app.GetUserVisits(ctx, id, ctx.QueryArgs())
+							rt = routeUserVisits
+							status = app.cached(ctx, cacheUserVisits, id, ctx.QueryArgs(), func(w io.Writer) int {
+								return app.GetUserVisits(w, id, ctx.QueryArgs())
+							})
 						case e == entities.Location && bytes.Equal(tail, bytesAvg):
 							// /locations/<id>/avg
-							status = app.GetLocationAvg(ctx, id, ctx.QueryArgs())
+							rt = routeLocationAvg
+							status = app.cached(ctx, cacheLocationAvg, id, ctx.QueryArgs(), func(w io.Writer) int {
+								return app.GetLocationAvg(w, id, ctx.QueryArgs())
+							})
+						case e == entities.Location && bytes.Equal(tail, bytesVisitors):
+							// /locations/<id>/visitors
+							status = app.GetLocationVisitors(ctx, id, ctx.QueryArgs())
+						case e == entities.Location && bytes.Equal(tail, bytesStats):
+							// /locations/<id>/stats
+							status = app.GetLocationStats(ctx, id, ctx.QueryArgs())
 						}
 					}
 				}
 			}
-		} else {
-			// /pprof
-			status = GetPprof(ctx, entity)
-			break
+		} else if bytes.Equal(entity, bytesStatus) {
+			// /status
+			status = app.GetStatus(ctx)
+		} else if bytes.Equal(entity, bytesMetrics) {
+			// /metrics
+			ctx.SetContentType("text/plain; version=0.0.4")
+			status = app.GetMetrics(ctx)
 		}
 	case "POST":
 
+		if isBatchPath(path) {
+			// /batch
+			rt = routeBatch
+			status = app.PostBatch(ctx, ctx.PostBody())
+			break
+		}
+
 		// To fix the "Empty response" error in yandex-tank logs we have to send
 		// "Connection: close" for POST requests.
 		// Fixed in test system, see #52
@@ -137,14 +260,45 @@ func (app *Application) RequestHandler(ctx *fasthttp.RequestCtx) {
 				switch {
 				case err == nil:
 					// /<entity>/<id:int>
+					rt = routePostUpdate
 					status = app.PostEntity(entities.GetEntityByRoute(entity), id, body)
 				case bytes.Equal(idBytes, []byte("new")):
 					// /<entity>/new
+					rt = routePostNew
 					status = app.PostEntityNew(entities.GetEntityByRoute(entity), body)
 				}
 			}
 		}
 
+	case "DELETE":
+
+		rt = routeDelete
+
+		ctx.Write([]byte("{}"))
+
+		var entityEnd = 1
+		for ; entityEnd < len(path); entityEnd++ {
+			if path[entityEnd] == '/' {
+				break
+			}
+		}
+		entity := path[1:entityEnd]
+		if entityEnd < len(path) {
+			var idEnd = entityEnd + 1
+			for ; idEnd < len(path); idEnd++ {
+				if path[idEnd] == '/' || path[idEnd] == '?' {
+					break
+				}
+			}
+			if idEnd == len(path) || path[idEnd] == '?' {
+				id, err = parseUint32(path[entityEnd+1 : idEnd])
+				if err == nil {
+					// /<entity>/<id:int>
+					status = app.DeleteEntity(entities.GetEntityByRoute(entity), id, ctx.QueryArgs())
+				}
+			}
+		}
+
 	default:
 		// XXX: rewrite with typed handlers to fix 405 errors on all urls?
 		status = http.StatusMethodNotAllowed
@@ -155,4 +309,6 @@ func (app *Application) RequestHandler(ctx *fasthttp.RequestCtx) {
 	}
 	ctx.SetStatusCode(status)
 
+	app.done(ctx, t0, rt, id, status, requestID)
+
 }
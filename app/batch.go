@@ -0,0 +1,206 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/ei-grad/hlcup/db"
+	"github.com/ei-grad/hlcup/entities"
+	"github.com/ei-grad/hlcup/models"
+)
+
+const DefaultMaxBatchSize = 1000
+
+var (
+	bytesBatchPath = []byte("/batch")
+
+	errBatchNull          = errors.New("null values are not allowed")
+	errBatchUnknownOp     = errors.New("op should be new or update")
+	errBatchUnknownEntity = errors.New("unknown entity")
+	errBatchIDForbidden   = errors.New("id is forbidden in update")
+)
+
+type batchOp struct {
+	Op     string          `json:"op"`
+	Entity string          `json:"entity"`
+	ID     uint32          `json:"id"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type batchResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Applied bool          `json:"applied"`
+	Results []batchResult `json:"results"`
+}
+
+// SetMaxBatchSize limits the number of operations in POST /batch
+func (app *Application) SetMaxBatchSize(n int) {
+	app.maxBatchSize = n
+}
+
+func isBatchPath(path []byte) bool {
+	return bytes.HasPrefix(path, bytesBatchPath) &&
+		(len(path) == len(bytesBatchPath) || path[len(bytesBatchPath)] == '?')
+}
+
+// PostBatch applies an ordered array of operations atomically:
+//
+//     [
+//         {"op": "new", "entity": "users", "data": {"id": 1, ...}},
+//         {"op": "update", "entity": "visits", "id": 2, "data": {"mark": 5}}
+//     ]
+//
+// Each result status tells if the operation is valid against the state with
+// previous operations applied. The batch is applied only if all of them are,
+// 409 is returned if the concurrent mutations make it invalid before commit.
+func (app *Application) PostBatch(w io.Writer, body []byte) int {
+
+	var ops []batchOp
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return http.StatusBadRequest
+	}
+
+	if len(ops) > app.maxBatchSize {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	resp := batchResponse{
+		Results: make([]batchResult, len(ops)),
+	}
+
+	tx := app.db.Begin()
+
+	resp.Applied = true
+	for n, i := range ops {
+		status, err := app.batchOp(tx, i)
+		resp.Results[n].Status = status
+		if err != nil {
+			resp.Results[n].Error = err.Error()
+			resp.Applied = false
+		}
+	}
+
+	status := http.StatusOK
+
+	if resp.Applied {
+		if err := tx.Commit(); err == db.ErrTxConflict {
+			// the concurrent mutations invalidated it since it was checked
+			resp.Applied = false
+			status = http.StatusConflict
+		} else if err == db.ErrWALClosed {
+			resp.Applied = false
+			status = http.StatusServiceUnavailable
+		} else if err != nil {
+			resp.Applied = false
+			status = http.StatusInternalServerError
+		}
+	} else {
+		tx.Rollback()
+		status = http.StatusBadRequest
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Write(b)
+
+	if resp.Applied && app.heat != nil {
+		for _, i := range ops {
+			e := entities.GetEntityByRoute([]byte(i.Entity))
+			if i.Op == "new" {
+				var v struct {
+					ID uint32 `json:"id"`
+				}
+				json.Unmarshal(i.Data, &v)
+				app.heat(e, v.ID)
+			} else {
+				app.heat(e, i.ID)
+			}
+		}
+	}
+
+	return status
+}
+
+func (app *Application) batchOp(tx *db.Tx, op batchOp) (int, error) {
+
+	if bytes.Contains(op.Data, []byte(": null")) || bytes.Contains(op.Data, []byte(":null")) {
+		return http.StatusBadRequest, errBatchNull
+	}
+
+	var err error
+
+	switch op.Op {
+	case "new":
+		switch entities.GetEntityByRoute([]byte(op.Entity)) {
+		case entities.User:
+			var v models.User
+			if err = v.UnmarshalJSON(op.Data); err == nil {
+				err = tx.AddUser(v)
+			}
+		case entities.Location:
+			var v models.Location
+			if err = v.UnmarshalJSON(op.Data); err == nil {
+				err = tx.AddLocation(v)
+			}
+		case entities.Visit:
+			var v models.Visit
+			if err = v.UnmarshalJSON(op.Data); err == nil {
+				err = tx.AddVisit(v)
+			}
+		default:
+			err = errBatchUnknownEntity
+		}
+	case "update":
+		switch entities.GetEntityByRoute([]byte(op.Entity)) {
+		case entities.User:
+			v := tx.GetUser(op.ID)
+			if !v.IsValid() {
+				return http.StatusNotFound, db.ErrNotFound
+			}
+			if err = v.UnmarshalJSON(op.Data); err == nil && v.ID != op.ID {
+				err = errBatchIDForbidden
+			}
+			if err == nil {
+				err = tx.UpdateUser(v)
+			}
+		case entities.Location:
+			v := tx.GetLocation(op.ID)
+			if !v.IsValid() {
+				return http.StatusNotFound, db.ErrNotFound
+			}
+			if err = v.UnmarshalJSON(op.Data); err == nil && v.ID != op.ID {
+				err = errBatchIDForbidden
+			}
+			if err == nil {
+				err = tx.UpdateLocation(v)
+			}
+		case entities.Visit:
+			v := tx.GetVisit(op.ID)
+			if !v.IsValid() {
+				return http.StatusNotFound, db.ErrNotFound
+			}
+			if err = v.UnmarshalJSON(op.Data); err == nil && v.ID != op.ID {
+				err = errBatchIDForbidden
+			}
+			if err == nil {
+				err = tx.UpdateVisit(v)
+			}
+		default:
+			err = errBatchUnknownEntity
+		}
+	default:
+		err = errBatchUnknownOp
+	}
+
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,279 @@
+package app
+
+import (
+	"container/list"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+type cacheKind uint8
+
+const (
+	// GET /users/<id>
+	cacheUser cacheKind = iota
+	// GET /locations/<id>
+	cacheLocation
+	// GET /users/<id>/visits
+	cacheUserVisits
+	// GET /locations/<id>/avg
+	cacheLocationAvg
+)
+
+const (
+	cacheShardsCount = 64
+	// cacheEntryOverhead is an estimate of the memory used by an entry
+	// besides the response body and args
+	cacheEntryOverhead = 128
+)
+
+type cacheKey struct {
+	kind cacheKind
+	id   uint32
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	args string
+	body []byte
+}
+
+func (e *cacheEntry) size() int {
+	return len(e.body) + len(e.args) + cacheEntryOverhead
+}
+
+type cacheShard struct {
+	sync.Mutex
+	// objects are the responses of the entity or index entry by args
+	objects map[cacheKey]map[string]*list.Element
+	lru     *list.List
+	size    int
+	budget  int
+
+	// clock is incremented on every invalidation in the shard, a response
+	// rendered from the DB is stored only if there were no invalidations
+	// since the rendering started
+	clock uint64
+}
+
+// ResponseCache keeps rendered GET responses. It implements db.Invalidator,
+// the responses are dropped when the entities or index entries they are
+// rendered from are modified.
+type ResponseCache struct {
+	shards []cacheShard
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// NewResponseCache creates the cache limited to budget bytes
+func NewResponseCache(budget int) *ResponseCache {
+	c := &ResponseCache{shards: make([]cacheShard, cacheShardsCount)}
+	for i := range c.shards {
+		c.shards[i].objects = map[cacheKey]map[string]*list.Element{}
+		c.shards[i].lru = list.New()
+		c.shards[i].budget = budget / cacheShardsCount
+	}
+	return c
+}
+
+func (c *ResponseCache) shard(key cacheKey) *cacheShard {
+	return &c.shards[(uint32(key.kind)*2654435761+key.id)%cacheShardsCount]
+}
+
+// get returns the cached response body, it must not be modified
+func (c *ResponseCache) get(key cacheKey, args string) ([]byte, bool) {
+	s := c.shard(key)
+	s.Lock()
+	if o := s.objects[key]; o != nil {
+		if e := o[args]; e != nil {
+			s.lru.MoveToFront(e)
+			body := e.Value.(*cacheEntry).body
+			s.Unlock()
+			atomic.AddUint64(&c.hits, 1)
+			return body, true
+		}
+	}
+	s.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+	return nil, false
+}
+
+// epoch must be taken before the response is rendered from the DB
+func (c *ResponseCache) epoch(key cacheKey) uint64 {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	return s.clock
+}
+
+// put stores the response rendered since epoch, unless there were
+// invalidations meanwhile
+func (c *ResponseCache) put(key cacheKey, args string, epoch uint64, body []byte) {
+
+	e := &cacheEntry{key: key, args: args, body: append([]byte(nil), body...)}
+
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.clock != epoch || e.size() > s.budget {
+		return
+	}
+
+	o := s.objects[key]
+	if o == nil {
+		o = map[string]*list.Element{}
+		s.objects[key] = o
+	} else if old := o[args]; old != nil {
+		s.remove(old)
+	}
+
+	o[args] = s.lru.PushFront(e)
+	s.size += e.size()
+
+	for s.size > s.budget {
+		s.remove(s.lru.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// remove must be called with s locked
+func (s *cacheShard) remove(elem *list.Element) {
+	e := s.lru.Remove(elem).(*cacheEntry)
+	s.size -= e.size()
+	o := s.objects[e.key]
+	delete(o, e.args)
+	if len(o) == 0 {
+		delete(s.objects, e.key)
+	}
+}
+
+func (c *ResponseCache) invalidate(key cacheKey) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	s.clock++
+	for _, e := range s.objects[key] {
+		s.lru.Remove(e)
+		s.size -= e.Value.(*cacheEntry).size()
+	}
+	delete(s.objects, key)
+}
+
+// reset drops all the responses, it is called when the DB is swapped
+func (c *ResponseCache) reset() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		s.clock++
+		s.objects = map[cacheKey]map[string]*list.Element{}
+		s.lru.Init()
+		s.size = 0
+		s.Unlock()
+	}
+}
+
+func (c *ResponseCache) InvalidateUser(id uint32) {
+	c.invalidate(cacheKey{cacheUser, id})
+}
+
+func (c *ResponseCache) InvalidateLocation(id uint32) {
+	c.invalidate(cacheKey{cacheLocation, id})
+}
+
+func (c *ResponseCache) InvalidateUserVisits(user uint32) {
+	c.invalidate(cacheKey{cacheUserVisits, user})
+}
+
+func (c *ResponseCache) InvalidateLocationMarks(location uint32) {
+	c.invalidate(cacheKey{cacheLocationAvg, location})
+}
+
+// CacheStats is the response cache counters
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Size      int
+}
+
+func (c *ResponseCache) Stats() (ret CacheStats) {
+	ret.Hits = atomic.LoadUint64(&c.hits)
+	ret.Misses = atomic.LoadUint64(&c.misses)
+	ret.Evictions = atomic.LoadUint64(&c.evictions)
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		ret.Entries += s.lru.Len()
+		ret.Size += s.size
+		s.Unlock()
+	}
+	return
+}
+
+// normalizeArgs returns the query args sorted by name and value, so the same
+// query has the same cache key regardless of the args order
+func normalizeArgs(args *fasthttp.Args) string {
+	var pairs []string
+	args.VisitAll(func(key, value []byte) {
+		pairs = append(pairs, url.QueryEscape(string(key))+"="+url.QueryEscape(string(value)))
+	})
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// UseCache enables the response cache limited to budget bytes
+func (app *Application) UseCache(budget int) {
+	app.cache = NewResponseCache(budget)
+	app.db.SetInvalidator(app.cache)
+}
+
+// cached writes the cached response, or renders and caches it if the status
+// is 200
+func (app *Application) cached(w io.Writer, kind cacheKind, id uint32, args *fasthttp.Args, render func(io.Writer) int) int {
+
+	if app.cache == nil || app.ageDependsOnClock(kind, args) {
+		return render(w)
+	}
+
+	key := cacheKey{kind, id}
+	var a string
+	if args != nil {
+		a = normalizeArgs(args)
+	}
+
+	if body, ok := app.cache.get(key, a); ok {
+		w.Write(body)
+		return http.StatusOK
+	}
+
+	epoch := app.cache.epoch(key)
+
+	buf := fasthttp.AcquireByteBuffer()
+	defer fasthttp.ReleaseByteBuffer(buf)
+
+	status := render(buf)
+	w.Write(buf.B)
+
+	if status == http.StatusOK {
+		app.cache.put(key, a, epoch, buf.B)
+	}
+
+	return status
+}
+
+// ageDependsOnClock tells if the response changes with the wall clock
+// reference time, such responses aren't cached
+func (app *Application) ageDependsOnClock(kind cacheKind, args *fasthttp.Args) bool {
+	return app.nowMode == NowWallClock && kind == cacheLocationAvg && args != nil &&
+		(args.Has("fromAge") || args.Has("toAge"))
+}
@@ -0,0 +1,158 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/ei-grad/hlcup/db"
+	"github.com/ei-grad/hlcup/models"
+)
+
+func TestCacheVisitUpdate(t *testing.T) {
+
+	a := NewApplication(db.NewMapStorage())
+	a.UseCache(1 << 20)
+	for i := uint32(1); i <= 2; i++ {
+		if err := a.db.AddUser(models.User{ID: i, Email: fmt.Sprintf("%d@b.c", i), FirstName: "a", LastName: "b", Gender: "m"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.db.AddLocation(models.Location{ID: i, Place: "place", Country: "country", City: "city", Distance: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.db.AddVisit(models.Visit{ID: 1, User: 1, Location: 1, VisitedAt: 1, Mark: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(uri string) string {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("GET")
+		ctx.Request.SetRequestURI(uri)
+		a.RequestHandler(&ctx)
+		if status := ctx.Response.StatusCode(); status != http.StatusOK {
+			t.Fatalf("GET %s: %d", uri, status)
+		}
+		return string(ctx.Response.Body())
+	}
+
+	uris := []string{"/users/1/visits", "/users/2/visits", "/locations/1/avg", "/locations/2/avg"}
+	before := map[string]string{}
+	for _, uri := range append(uris, "/users/1") {
+		before[uri] = get(uri)
+	}
+	if n := a.cache.Stats().Entries; n != 5 {
+		t.Fatalf("%d entries cached, expected 5", n)
+	}
+
+	// the visit moves to the other user and location
+	if status := testRequest(a, "POST", "/visits/1", []byte(`{"user":2,"location":2}`)); status != http.StatusOK {
+		t.Fatalf("POST /visits/1: %d", status)
+	}
+
+	for _, key := range []cacheKey{
+		{cacheUserVisits, 1}, {cacheUserVisits, 2},
+		{cacheLocationAvg, 1}, {cacheLocationAvg, 2},
+	} {
+		if _, ok := a.cache.get(key, ""); ok {
+			t.Errorf("%+v is not invalidated", key)
+		}
+	}
+	if _, ok := a.cache.get(cacheKey{cacheUser, 1}, ""); !ok {
+		t.Error("user 1 is invalidated")
+	}
+	for _, uri := range uris {
+		if after := get(uri); after == before[uri] {
+			t.Errorf("GET %s: stale response %s", uri, after)
+		}
+	}
+}
+
+func TestCacheEpoch(t *testing.T) {
+
+	c := NewResponseCache(1 << 20)
+	key := cacheKey{cacheUserVisits, 1}
+
+	// the invalidation happens while the response is rendered
+	epoch := c.epoch(key)
+	c.InvalidateUserVisits(1)
+	c.put(key, "", epoch, []byte("stale"))
+	if _, ok := c.get(key, ""); ok {
+		t.Fatal("response rendered before the invalidation is cached")
+	}
+
+	// the invalidations of the other keys in the shard drop it as well
+	epoch = c.epoch(key)
+	c.InvalidateUserVisits(1 + cacheShardsCount)
+	c.put(key, "", epoch, []byte("stale"))
+	if _, ok := c.get(key, ""); ok {
+		t.Fatal("response rendered before the invalidation is cached")
+	}
+
+	epoch = c.epoch(key)
+	c.InvalidateUser(1)
+	c.put(key, "", epoch, []byte("fresh"))
+	if body, ok := c.get(key, ""); !ok || string(body) != "fresh" {
+		t.Fatalf("got %q, %v", body, ok)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+
+	const bodySize = 100
+	entrySize := bodySize + cacheEntryOverhead
+	c := NewResponseCache(cacheShardsCount * 3 * entrySize)
+	body := make([]byte, bodySize)
+
+	// the ids are in the same shard
+	key := func(i int) cacheKey {
+		return cacheKey{cacheUser, uint32(i * cacheShardsCount)}
+	}
+	for i := 0; i < 3; i++ {
+		c.put(key(i), "", 0, body)
+	}
+	// 0 is used recently, 1 is evicted
+	c.get(key(0), "")
+	c.put(key(3), "", 0, body)
+
+	for i, cached := range []bool{true, false, true, true} {
+		if _, ok := c.get(key(i), ""); ok != cached {
+			t.Errorf("entry %d: cached %v, expected %v", i, ok, cached)
+		}
+	}
+	if s := c.Stats(); s.Evictions != 1 || s.Entries != 3 || s.Size != 3*entrySize {
+		t.Errorf("%+v", s)
+	}
+
+	// the response larger than the shard budget isn't cached
+	c.put(key(4), "", 0, make([]byte, 3*entrySize))
+	if _, ok := c.get(key(4), ""); ok {
+		t.Error("response over the budget is cached")
+	}
+	if s := c.Stats(); s.Evictions != 1 || s.Entries != 3 {
+		t.Errorf("%+v", s)
+	}
+}
+
+func TestNormalizeArgs(t *testing.T) {
+	for _, c := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"fromDate=1&toDate=2", "toDate=2&fromDate=1", true},
+		{"country=a&country=b&city=c", "country=b&city=c&country=a", true},
+		{"country=a", "country=b", false},
+		{"country=a%26b", "country=a&b", false},
+		{"country=a%3Db", "country=a=b", true},
+		{"", "", true},
+	} {
+		var a, b fasthttp.Args
+		a.Parse(c.a)
+		b.Parse(c.b)
+		if (normalizeArgs(&a) == normalizeArgs(&b)) != c.equal {
+			t.Errorf("%q and %q: %q and %q", c.a, c.b, normalizeArgs(&a), normalizeArgs(&b))
+		}
+	}
+}
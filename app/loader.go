@@ -1,13 +1,14 @@
 package app
 
 import (
-	"archive/zip"
-	"encoding/json"
+	"fmt"
 	"log"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/ei-grad/hlcup/dataset"
+	"github.com/ei-grad/hlcup/db"
 	"github.com/ei-grad/hlcup/models"
 )
 
@@ -17,148 +18,170 @@ type counts struct {
 	Visits    int32
 }
 
-func (app *Application) LoadData(fileName string) {
+// LoadData loads the snapshot if it is enabled and newer than the data file,
+// or the data file otherwise. Then the WAL is replayed on top of it.
+//
+// In strict load mode the first bad record stops loading, it is returned as
+// *dataset.Error. The data loaded before it stays in the DB, but the WAL is
+// not replayed and attached, so the mutations are answered 503 while it is
+// enabled.
+func (app *Application) LoadData(fileName string) error {
+
+	var fromLSN uint64
+
+	app.dataFile = fileName
+
+	app.load.setPhase(phaseStarting)
+
+	if h, ok := app.loadSnapshot(fileName); ok {
+		fromLSN = h.LSN
+	} else if err := app.loadDataset(app.db, &app.load, fileName, &app.now); err != nil {
+		app.load.fail(err)
+		return err
+	}
+
+	if app.wal != nil {
+		app.load.setPhase(phaseWAL)
+		if err := app.replayWAL(fromLSN); err != nil {
+			app.load.fail(err)
+			return err
+		}
+	}
+
+	app.load.setPhase(phaseReady)
+
+	if app.snapshot != nil {
+		go app.snapshotWriter(fromLSN == 0)
+	}
+
+	return nil
+}
+
+// loadDataset loads the data file into the DB, the reference time of the
+// data is stored to now before the records are loaded
+func (app *Application) loadDataset(target *db.DB, s *loadStatus, fileName string, now *referenceTime) error {
 	var (
 		wg sync.WaitGroup
 	)
 
-	// Open a zip archive for reading.
-	r, err := zip.OpenReader(fileName)
+	d, err := dataset.Open(fileName, app.dataEntity)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	rejects, err := dataset.NewRejects(app.loadMode, app.rejectsFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer r.Close()
+	defer rejects.Close()
+
+	s.setPhase(phaseDataset)
+	s.setRejects(rejects)
 
-	log.Printf("loader: starting")
+	log.Printf("loader: starting in %s mode", app.loadMode)
 
 	t0 := time.Now()
 
-	var c counts
+	c := &s.counts
 
-	app.now = r.File[0].ModTime()
+	now.Time, now.source = d.Now()
+	log.Printf("loader: reference time %s (%d) from %s", now.Format(time.RFC3339), now.Unix(), now.source)
 
-	for _, f := range r.File {
-		wg.Add(1)
-		go app.loadFile(&wg, f, &c, 1)
-	}
+	for stage := 1; stage <= 2; stage++ {
 
-	wg.Wait()
+		s.startStage(stage)
 
-	log.Printf("loader: stage 1 finished in %s", time.Since(t0))
+		for _, f := range d.Files {
+			wg.Add(1)
+			go loadFile(&wg, target, f, c, stage, rejects)
+		}
 
-	for _, f := range r.File {
-		wg.Add(1)
-		go app.loadFile(&wg, f, &c, 2)
-	}
+		wg.Wait()
+
+		if err := rejects.Err(); err != nil {
+			log.Printf("loader: stopped on stage %d after %s, loaded %d users, %d locations, %d visits",
+				stage, time.Since(t0), c.Users, c.Locations, c.Visits)
+			return err
+		}
+
+		s.finishStage(stage)
 
-	wg.Wait()
+		log.Printf("loader: stage %d finished in %s", stage, time.Since(t0))
+	}
 
 	log.Printf("loader: load finished in %s", time.Since(t0))
 	log.Printf("loader: loaded %d users, %d locations, %d visits",
 		c.Users, c.Locations, c.Visits)
 
-}
+	if app.loadMode == dataset.Lenient {
+		log.Printf("loader: %s", rejects.Summary())
+	}
 
-func (app *Application) loadFile(wg *sync.WaitGroup, f *zip.File, c *counts, stage int) {
+	return nil
+}
 
-	defer wg.Done()
+// SetLoadMode sets the handling of the bad data records. In lenient mode
+// they are skipped and written to the rejects file, if it is not empty.
+func (app *Application) SetLoadMode(mode dataset.Mode, rejectsFile string) {
+	app.loadMode = mode
+	app.rejectsFile = rejectsFile
+}
 
-	rc, err := f.Open()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer rc.Close()
+// SetDataEntity sets the entity of NDJSON and CSV data files, instead of
+// detecting it by the file names
+func (app *Application) SetDataEntity(entity string) {
+	app.dataEntity = entity
+}
 
-	decoder := json.NewDecoder(rc)
+// UseWAL enables the write-ahead log, it is replayed on top of the loaded
+// data and attached to the DB when LoadData finishes
+func (app *Application) UseWAL(opts db.WALOptions) {
+	app.wal = &opts
+}
 
-	// read left_bracket token
-	token, err := decoder.Token()
+func (app *Application) replayWAL(fromLSN uint64) error {
+	t0 := time.Now()
+	w, err := db.OpenWAL(*app.wal)
 	if err != nil {
-		log.Fatalf("loader: %s: invalid JSON", f.Name)
+		return fmt.Errorf("wal: can't open %s: %s", app.wal.Path, err)
 	}
-	if t, ok := token.(json.Delim); !ok || t.String() != "{" {
-		log.Fatalf("loader: %s: expected {, got %v", f.Name, token)
+	applied, failed, err := app.db.ReplayWAL(w, fromLSN)
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("wal: replay failed: %s", err)
 	}
+	app.db.SetWAL(w)
+	log.Printf("wal: replayed %d records (%d failed) in %s, sync=%s",
+		applied, failed, time.Since(t0), app.wal.Sync)
+	return nil
+}
 
-	for decoder.More() {
+func loadFile(wg *sync.WaitGroup, target *db.DB, f *dataset.File, c *counts, stage int, rejects *dataset.Rejects) {
 
-		// read key
-		token, err = decoder.Token()
-		if err != nil {
-			log.Fatalf("loader: %s: invalid JSON", f.Name)
-		}
-		key, ok := token.(string)
-		if !ok {
-			log.Fatalf("loader: %s: expected string, got %v", f.Name, token)
-		}
+	defer wg.Done()
 
-		// read left_brace token
-		token, err = decoder.Token()
-		if err != nil {
-			log.Fatalf("loader: %s: invalid JSON", f.Name)
+	f.Read(stage, func(r dataset.Record) error {
+		// other files are stopped at the first error in strict mode
+		if err := rejects.Err(); err != nil {
+			return err
 		}
-		if t, ok := token.(json.Delim); !ok || t.String() != "[" {
-			log.Fatalf("loader: %s: expected [, got %v", f.Name, token)
-		}
-
-		var handler func()
-
-		switch {
-		case key == strUsers:
-			if stage != 1 {
-				return
-			}
-			handler = func() {
-				var v models.User
-				err = decoder.Decode(&v)
-				if err != nil {
-					log.Fatalf("loader: bad user: %s", err)
-				}
-				err = app.db.AddUser(v)
-				if err != nil {
-					log.Fatalf("loader: can't add user %d: %s", v.ID, err)
-				}
+		var err error
+		switch v := r.Value.(type) {
+		case *models.User:
+			if err = target.AddUser(*v); err == nil {
 				atomic.AddInt32(&c.Users, 1)
 			}
-		case key == strLocations:
-			if stage != 1 {
-				return
-			}
-			handler = func() {
-				var v models.Location
-				err = decoder.Decode(&v)
-				if err != nil {
-					log.Fatalf("loader: bad location: %s", err)
-				}
-				err = app.db.AddLocation(v)
-				if err != nil {
-					log.Fatalf("loader: can't add location %d: %s", v.ID, err)
-				}
+		case *models.Location:
+			if err = target.AddLocation(*v); err == nil {
 				atomic.AddInt32(&c.Locations, 1)
 			}
-		case key == strVisits:
-			if stage != 2 {
-				return
-			}
-			handler = func() {
-				var v models.Visit
-				err = decoder.Decode(&v)
-				if err != nil {
-					log.Fatalf("loader: bad visit: %s", err)
-				}
-				err = app.db.AddVisit(v)
-				if err != nil {
-					log.Fatalf("loader: can't add visit %d: %s", v.ID, err)
-				}
+		case *models.Visit:
+			if err = target.AddVisit(*v); err == nil {
 				atomic.AddInt32(&c.Visits, 1)
 			}
-		default:
-			log.Fatalf("loader: unknown section: %s", key)
 		}
-
-		for decoder.More() {
-			handler()
-		}
-	}
+		return err
+	}, rejects.Handle)
 
 }
@@ -14,8 +14,7 @@ type Peeker interface {
 
 type LocationMarkFilter func(models.LocationMark) bool
 
-// GetMarksFilter validates query args and returns a function to filter
-// LocationMark's based on this parameters
+// GetMarksQuery validates query args of the marks filter
 //
 // Parameters:
 //
@@ -27,59 +26,91 @@ type LocationMarkFilter func(models.LocationMark) bool
 //     toAge - как предыдущее, но наоборот
 //     gender - учитывать оценки только мужчин или женщин
 //
-func (app *Application) GetMarksFilter(args Peeker) (ret LocationMarkFilter, err error) {
+func (app *Application) GetMarksQuery(args Peeker) (q models.MarksQuery, err error) {
 
-	var filters []LocationMarkFilter
+	q.Now = app.referenceTime()
 
 	fromDateRaw := args.Peek("fromDate")
 	if fromDateRaw != nil {
-		fromDate, err := strconv.Atoi(string(fromDateRaw))
+		q.FromDate, err = strconv.Atoi(string(fromDateRaw))
 		if err != nil {
-			return nil, fmt.Errorf("invalid fromDate: %s", err)
+			return q, fmt.Errorf("invalid fromDate: %s", err)
 		}
-		filters = append(filters, filterLocationMarkFromDate(fromDate))
+		q.FromDateIsSet = true
 	}
 
 	toDateRaw := args.Peek("toDate")
 	if toDateRaw != nil {
-		toDate, err := strconv.Atoi(string(toDateRaw))
+		q.ToDate, err = strconv.Atoi(string(toDateRaw))
 		if err != nil {
-			return nil, fmt.Errorf("invalid toDate: %s", err)
+			return q, fmt.Errorf("invalid toDate: %s", err)
 		}
-		filters = append(filters, filterLocationMarkToDate(toDate))
+		q.ToDateIsSet = true
 	}
 
 	fromAgeRaw := args.Peek("fromAge")
 	if fromAgeRaw != nil {
 		fromAge, err := strconv.ParseUint(string(fromAgeRaw), 10, 32)
 		if err != nil {
-			return nil, fmt.Errorf("invalid fromAge: %s", err)
+			return q, fmt.Errorf("invalid fromAge: %s", err)
 		}
-		t := app.now
-		t = time.Date(t.Year()-int(fromAge), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
-		filters = append(filters, filterLocationMarkFromAge(t))
+		q.FromAge = int(fromAge)
+		q.FromAgeIsSet = true
 	}
 
 	toAgeRaw := args.Peek("toAge")
 	if toAgeRaw != nil {
 		toAge, err := strconv.ParseUint(string(toAgeRaw), 10, 32)
 		if err != nil {
-			return nil, fmt.Errorf("invalid toAge: %s", err)
+			return q, fmt.Errorf("invalid toAge: %s", err)
 		}
-		t := app.now
-		t = time.Date(t.Year()-int(toAge), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
-		filters = append(filters, filterLocationMarkToAge(t))
+		q.ToAge = int(toAge)
+		q.ToAgeIsSet = true
 	}
 
 	genderRaw := args.Peek("gender")
 	if genderRaw != nil {
 		if len(genderRaw) != 1 || (genderRaw[0] != 'm' && genderRaw[0] != 'f') {
-			return nil, fmt.Errorf("invalid gender")
+			return q, fmt.Errorf("invalid gender")
 		}
-		filters = append(filters, filterLocationMarkCountry(genderRaw[0]))
+		q.Gender = genderRaw[0]
 	}
 
-	ret = func(v models.LocationMark) bool {
+	return q, nil
+}
+
+// GetMarksFilter validates query args and returns a function to filter
+// LocationMark's based on this parameters, see GetMarksQuery
+func (app *Application) GetMarksFilter(args Peeker) (ret LocationMarkFilter, err error) {
+	q, err := app.GetMarksQuery(args)
+	if err != nil {
+		return nil, err
+	}
+	return MarksQueryFilter(q), nil
+}
+
+// MarksQueryFilter returns a function to filter LocationMark's
+func MarksQueryFilter(q models.MarksQuery) LocationMarkFilter {
+
+	var filters []LocationMarkFilter
+
+	if q.FromDateIsSet {
+		filters = append(filters, filterLocationMarkFromDate(q.FromDate))
+	}
+	if q.ToDateIsSet {
+		filters = append(filters, filterLocationMarkToDate(q.ToDate))
+	}
+	if q.FromAgeIsSet {
+		filters = append(filters, filterLocationMarkFromAge(q.AgeThreshold(q.FromAge)))
+	}
+	if q.ToAgeIsSet {
+		filters = append(filters, filterLocationMarkToAge(q.AgeThreshold(q.ToAge)))
+	}
+	if q.Gender != 0 {
+		filters = append(filters, filterLocationMarkCountry(q.Gender))
+	}
+
+	return func(v models.LocationMark) bool {
 		for _, i := range filters {
 			if !i(v) {
 				return false
@@ -87,8 +118,6 @@ func (app *Application) GetMarksFilter(args Peeker) (ret LocationMarkFilter, err
 		}
 		return true
 	}
-
-	return ret, nil
 }
 
 func filterLocationMarkFromDate(t int) LocationMarkFilter {
@@ -0,0 +1,244 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// route is the label of the request metrics
+type route uint8
+
+const (
+	routeOther route = iota
+	// GET /<entity>/<id>
+	routeEntityGet
+	// GET /users/<id>/visits
+	routeUserVisits
+	// GET /locations/<id>/avg
+	routeLocationAvg
+	// POST /<entity>/new
+	routePostNew
+	// POST /<entity>/<id>
+	routePostUpdate
+	// POST /batch
+	routeBatch
+	// DELETE /<entity>/<id>
+	routeDelete
+	routesCount
+)
+
+var routeNames = [routesCount]string{
+	"other",
+	"entity_get",
+	"user_visits",
+	"location_avg",
+	"post_new",
+	"post_update",
+	"batch",
+	"delete",
+}
+
+// latencyBuckets are the upper bounds of the latency histogram buckets in
+// seconds
+var latencyBuckets = [...]float64{
+	.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1,
+}
+
+type histogram struct {
+	// counts[i] is the number of observations in (bucket[i-1], bucket[i]],
+	// the last one is for the values above all buckets
+	counts [len(latencyBuckets) + 1]uint64
+	// sum is in nanoseconds
+	sum uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	i := 0
+	for ; i < len(latencyBuckets) && s > latencyBuckets[i]; i++ {
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// maxStatus bounds the status codes, the histograms are kept in the array
+// to be found without locks or allocations
+const maxStatus = 600
+
+// Metrics are the request counters and latency histograms by route and
+// status
+type Metrics struct {
+	mu       sync.Mutex
+	requests [routesCount][maxStatus]atomic.Value
+}
+
+func (m *Metrics) observe(r route, status int, d time.Duration) {
+	if status < 0 || status >= maxStatus {
+		status = 0
+	}
+	v := &m.requests[r][status]
+	h, _ := v.Load().(*histogram)
+	if h == nil {
+		m.mu.Lock()
+		if h, _ = v.Load().(*histogram); h == nil {
+			h = &histogram{}
+			v.Store(h)
+		}
+		m.mu.Unlock()
+	}
+	h.observe(d)
+}
+
+// metricsWriter writes the Prometheus text exposition format
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (w metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w metricsWriter) value(name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w.w, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (w metricsWriter) metric(name, typ, help string, v float64) {
+	w.header(name, typ, help)
+	w.value(name, "", v)
+}
+
+func (m *Metrics) write(w metricsWriter) {
+
+	type series struct {
+		labels string
+		h      *histogram
+	}
+	var all []series
+	for r := range m.requests {
+		for status := range m.requests[r] {
+			if h, _ := m.requests[r][status].Load().(*histogram); h != nil {
+				all = append(all, series{
+					fmt.Sprintf(`route="%s",status="%d"`, routeNames[r], status), h,
+				})
+			}
+		}
+	}
+
+	// the counts are read once to keep the counter and the histogram
+	// consistent
+	counts := make([][len(latencyBuckets) + 1]uint64, len(all))
+	for n, i := range all {
+		for j := range i.h.counts {
+			counts[n][j] = atomic.LoadUint64(&i.h.counts[j])
+		}
+	}
+
+	w.header("hlcup_http_requests_total", "counter", "Number of HTTP requests by route and status.")
+	for n, i := range all {
+		var total uint64
+		for _, c := range counts[n] {
+			total += c
+		}
+		w.value("hlcup_http_requests_total", i.labels, float64(total))
+	}
+
+	w.header("hlcup_http_request_duration_seconds", "histogram", "HTTP request latency by route and status.")
+	for n, i := range all {
+		var total uint64
+		for j, le := range latencyBuckets {
+			total += counts[n][j]
+			w.value("hlcup_http_request_duration_seconds_bucket",
+				i.labels+`,le="`+strconv.FormatFloat(le, 'g', -1, 64)+`"`, float64(total))
+		}
+		total += counts[n][len(latencyBuckets)]
+		w.value("hlcup_http_request_duration_seconds_bucket", i.labels+`,le="+Inf"`, float64(total))
+		w.value("hlcup_http_request_duration_seconds_sum", i.labels,
+			time.Duration(atomic.LoadUint64(&i.h.sum)).Seconds())
+		w.value("hlcup_http_request_duration_seconds_count", i.labels, float64(total))
+	}
+}
+
+// GetMetrics writes the metrics in Prometheus text format
+func (app *Application) GetMetrics(out io.Writer) int {
+
+	w := metricsWriter{out}
+
+	app.metrics.write(w)
+
+	// loader
+	phase := app.load.getPhase()
+	w.header("hlcup_load_phase", "gauge", "Data loading phase, 1 for the current one.")
+	for p := phaseStarting; p <= phaseFailed; p++ {
+		v := 0.
+		if p == phase {
+			v = 1
+		}
+		w.value("hlcup_load_phase", `phase="`+p.String()+`"`, v)
+	}
+	w.header("hlcup_load_records_total", "counter", "Number of records loaded from the data files.")
+	w.value("hlcup_load_records_total", `entity="users"`, float64(atomic.LoadInt32(&app.load.counts.Users)))
+	w.value("hlcup_load_records_total", `entity="locations"`, float64(atomic.LoadInt32(&app.load.counts.Locations)))
+	w.value("hlcup_load_records_total", `entity="visits"`, float64(atomic.LoadInt32(&app.load.counts.Visits)))
+	app.load.Lock()
+	rejects := app.load.rejects
+	app.load.Unlock()
+	var rejected int
+	if rejects != nil {
+		rejected = rejects.Summary().Total
+	}
+	w.metric("hlcup_load_rejected_total", "counter", "Number of records skipped in lenient load mode.", float64(rejected))
+
+	// DB
+	s := app.db.Stats()
+	w.header("hlcup_db_entities", "gauge", "Number of stored entities.")
+	w.value("hlcup_db_entities", `entity="users"`, float64(s.Users))
+	w.value("hlcup_db_entities", `entity="locations"`, float64(s.Locations))
+	w.value("hlcup_db_entities", `entity="visits"`, float64(s.Visits))
+	w.header("hlcup_db_index_entries", "gauge", "Number of index entries.")
+	w.value("hlcup_db_index_entries", `index="emails"`, float64(s.Emails))
+	w.value("hlcup_db_index_entries", `index="search_terms"`, float64(s.SearchTerms))
+	w.value("hlcup_db_index_entries", `index="search_postings"`, float64(s.SearchPostings))
+
+	// response cache
+	if app.cache != nil {
+		c := app.cache.Stats()
+		w.metric("hlcup_cache_hits_total", "counter", "Number of response cache hits.", float64(c.Hits))
+		w.metric("hlcup_cache_misses_total", "counter", "Number of response cache misses.", float64(c.Misses))
+		w.metric("hlcup_cache_evictions_total", "counter", "Number of responses evicted from the cache.", float64(c.Evictions))
+		w.metric("hlcup_cache_entries", "gauge", "Number of cached responses.", float64(c.Entries))
+		w.metric("hlcup_cache_bytes", "gauge", "Estimated size of the cached responses.", float64(c.Size))
+	}
+
+	// runtime
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	w.metric("go_goroutines", "gauge", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	w.metric("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", float64(m.Alloc))
+	w.metric("go_memstats_alloc_bytes_total", "counter", "Total number of bytes allocated, even if freed.", float64(m.TotalAlloc))
+	w.metric("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.", float64(m.Sys))
+	w.metric("go_memstats_mallocs_total", "counter", "Total number of mallocs.", float64(m.Mallocs))
+	w.metric("go_memstats_frees_total", "counter", "Total number of frees.", float64(m.Frees))
+	w.metric("go_memstats_heap_alloc_bytes", "gauge", "Number of heap bytes allocated and still in use.", float64(m.HeapAlloc))
+	w.metric("go_memstats_heap_sys_bytes", "gauge", "Number of heap bytes obtained from system.", float64(m.HeapSys))
+	w.metric("go_memstats_heap_idle_bytes", "gauge", "Number of heap bytes waiting to be used.", float64(m.HeapIdle))
+	w.metric("go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.", float64(m.HeapInuse))
+	w.metric("go_memstats_heap_released_bytes", "gauge", "Number of heap bytes released to OS.", float64(m.HeapReleased))
+	w.metric("go_memstats_heap_objects", "gauge", "Number of allocated objects.", float64(m.HeapObjects))
+	w.metric("go_memstats_stack_inuse_bytes", "gauge", "Number of bytes in use by the stack allocator.", float64(m.StackInuse))
+	w.metric("go_memstats_next_gc_bytes", "gauge", "Number of heap bytes when next garbage collection will take place.", float64(m.NextGC))
+	w.metric("go_memstats_last_gc_time_seconds", "gauge", "Number of seconds since 1970 of last garbage collection.", float64(m.LastGC)/1e9)
+	w.metric("go_memstats_gc_cpu_fraction", "gauge", "The fraction of this program's available CPU time used by the GC since the program started.", m.GCCPUFraction)
+	w.metric("go_gc_count_total", "counter", "Number of completed GC cycles.", float64(m.NumGC))
+	w.metric("go_gc_pause_seconds_total", "counter", "Total GC stop-the-world pause time.", time.Duration(m.PauseTotalNs).Seconds())
+
+	return http.StatusOK
+}
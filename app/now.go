@@ -0,0 +1,103 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NowMode selects the reference time the ages are counted from
+type NowMode int
+
+const (
+	// NowData takes it from options.txt or the data file modification time
+	NowData NowMode = iota
+	// NowFixed is set explicitly with SetNow
+	NowFixed
+	// NowWallClock is the current time. The avg queries are answered by
+	// scanning the marks, the aggregate and the cache of the age filtered
+	// responses need the constant reference time.
+	NowWallClock
+)
+
+func (m NowMode) String() string {
+	switch m {
+	case NowData:
+		return "data"
+	case NowFixed:
+		return "fixed"
+	case NowWallClock:
+		return "wall"
+	}
+	return "unknown"
+}
+
+// ParseNow parses the reference time setting: empty for NowData, "wall" for
+// NowWallClock, or the unix timestamp or RFC 3339 time for NowFixed
+func ParseNow(s string) (NowMode, time.Time, error) {
+	switch s {
+	case "":
+		return NowData, time.Time{}, nil
+	case "wall":
+		return NowWallClock, time.Time{}, nil
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return NowFixed, time.Unix(ts, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return NowData, t, fmt.Errorf("invalid now: %q, expected unix timestamp, RFC 3339 time or wall", s)
+	}
+	return NowFixed, t.UTC(), nil
+}
+
+// referenceTime is the time of the loaded data and where it is taken from
+type referenceTime struct {
+	time.Time
+	source string
+}
+
+// SetNow sets the reference time mode, t is used by NowFixed. The time of the
+// loaded data is still kept in the snapshot.
+func (app *Application) SetNow(mode NowMode, t time.Time) {
+	app.nowMode = mode
+	app.fixedNow = t.Truncate(time.Second)
+}
+
+// referenceTime returns the time the ages are counted from, with second
+// resolution
+func (app *Application) referenceTime() time.Time {
+	switch app.nowMode {
+	case NowFixed:
+		return app.fixedNow
+	case NowWallClock:
+		return time.Now().UTC().Truncate(time.Second)
+	}
+	return app.now.Truncate(time.Second)
+}
+
+func (app *Application) referenceSource() string {
+	switch app.nowMode {
+	case NowFixed:
+		return "-now"
+	case NowWallClock:
+		return "wall clock"
+	}
+	return app.now.source
+}
+
+// GetNow reports the reference time in use
+func (app *Application) GetNow(w io.Writer) int {
+	now := app.referenceTime()
+	b, _ := json.Marshal(struct {
+		Now    int64  `json:"now"`
+		Time   string `json:"time"`
+		Mode   string `json:"mode"`
+		Source string `json:"source"`
+	}{now.Unix(), now.Format(time.RFC3339), app.nowMode.String(), app.referenceSource()})
+	w.Write(b)
+	return http.StatusOK
+}
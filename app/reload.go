@@ -0,0 +1,210 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	rtdebug "runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/ei-grad/hlcup/db"
+)
+
+var (
+	ErrReloadDisabled = errors.New("reload is disabled")
+	ErrReloadRunning  = errors.New("reload is already running")
+	ErrNotReady       = errors.New("data is not loaded yet")
+	ErrShuttingDown   = errors.New("shutting down")
+)
+
+var bytesReloadPath = []byte("/reload")
+
+// EnableReload allows Reload, the data is loaded into a new DB on the
+// storage created by newStorage, so there should be enough memory for two
+// copies of the data
+func (app *Application) EnableReload(newStorage func() (db.Storage, error)) {
+	app.newStorage = newStorage
+}
+
+// Reload loads the data file again into a new DB in background and swaps it
+// with the current one when it is loaded, the old DB is freed. The
+// mutations get 503 until the swap, they would be lost with the old DB.
+//
+// The WAL is restarted and the snapshot is written again for the new data.
+func (app *Application) Reload() error {
+	if app.newStorage == nil {
+		return ErrReloadDisabled
+	}
+	if !app.Ready() {
+		return ErrNotReady
+	}
+	if !atomic.CompareAndSwapInt32(&app.reloading, 0, 1) {
+		return ErrReloadRunning
+	}
+	app.reload.reset()
+	app.reload.setPhase(phaseStarting)
+	atomic.StoreInt32(&app.reloadPending, 1)
+	go func() {
+		defer atomic.StoreInt32(&app.reloading, 0)
+		// it is cleared by swap, the mutations are accepted again if the
+		// reload fails
+		defer atomic.StoreInt32(&app.reloadPending, 0)
+		if err := app.reloadData(); err != nil {
+			log.Printf("reload: %s, keeping the current data", err)
+			app.reload.fail(err)
+		}
+	}()
+	return nil
+}
+
+func (app *Application) reloadData() error {
+
+	t0 := time.Now()
+
+	log.Printf("reload: loading %s", app.dataFile)
+
+	s, err := app.newStorage()
+	if err != nil {
+		return err
+	}
+	next := db.New(s)
+
+	var now referenceTime
+	if err := app.loadDataset(next, &app.reload, app.dataFile, &now); err != nil {
+		return err
+	}
+
+	if err := app.swap(next, now); err != nil {
+		return err
+	}
+
+	app.reload.setPhase(phaseReady)
+
+	log.Printf("reload: swapped the data in %s", time.Since(t0))
+
+	// the old DB isn't referenced anymore
+	rtdebug.FreeOSMemory()
+
+	if app.snapshot != nil {
+		if err := app.WriteSnapshot(); err != nil {
+			log.Print("snapshot: write failed: ", err)
+		}
+	}
+
+	return nil
+}
+
+// swap replaces the DB and the reference time while no requests are
+// running. The new WAL is prepared next to the current one and renamed over
+// it after the current one is closed.
+func (app *Application) swap(next *db.DB, now referenceTime) error {
+
+	var w *db.WAL
+	if app.wal != nil {
+		opts := *app.wal
+		opts.Path += ".reload"
+		os.Remove(opts.Path)
+		var err error
+		if w, err = db.OpenWAL(opts); err != nil {
+			return fmt.Errorf("wal: %s", err)
+		}
+	}
+
+	// wait for the snapshot being written, then for the requests
+	app.snapshotMu.Lock()
+	defer app.snapshotMu.Unlock()
+	for i := uint32(0); i < dataMuShards; i++ {
+		app.dataMu.Lock(i)
+	}
+	defer func() {
+		for i := uint32(0); i < dataMuShards; i++ {
+			app.dataMu.Unlock(i)
+		}
+	}()
+
+	if atomic.LoadInt32(&app.draining) == 1 {
+		if w != nil {
+			w.Close()
+			os.Remove(app.wal.Path + ".reload")
+		}
+		return ErrShuttingDown
+	}
+
+	if w != nil {
+		if err := app.db.CloseWAL(); err != nil {
+			log.Print("wal: close failed: ", err)
+		}
+		if err := os.Rename(app.wal.Path+".reload", app.wal.Path); err != nil {
+			// the mutations of the new data can't be logged, keep the
+			// current one with the log reopened
+			w.Close()
+			old, oerr := db.OpenWAL(*app.wal)
+			if oerr != nil {
+				log.Fatalf("wal: can't reopen %s: %s", app.wal.Path, oerr)
+			}
+			app.db.SetWAL(old)
+			return fmt.Errorf("wal: %s", err)
+		}
+		next.SetWAL(w)
+	}
+
+	if app.snapshot != nil {
+		// the snapshot of the old data isn't used on restart
+		if err := os.Remove(app.snapshot.fileName); err != nil && !os.IsNotExist(err) {
+			log.Print("snapshot: ", err)
+		}
+	}
+
+	if app.cache != nil {
+		app.cache.reset()
+		next.SetInvalidator(app.cache)
+	}
+
+	app.db = next
+	app.now = now
+	atomic.StoreInt32(&app.reloadPending, 0)
+
+	return nil
+}
+
+// adminReload starts the reload on POST, and reports its progress on GET
+func (app *Application) adminReload(ctx *fasthttp.RequestCtx) int {
+
+	ctx.SetContentType("application/json; charset=utf8")
+
+	switch string(ctx.Method()) {
+	case "GET":
+		if app.newStorage == nil {
+			return adminError(ctx, http.StatusNotFound, ErrReloadDisabled)
+		}
+		if app.reload.getPhase() == phaseStarting && atomic.LoadInt32(&app.reloading) == 0 {
+			ctx.WriteString(`{"phase":"idle"}`)
+			return http.StatusOK
+		}
+		writeStatus(ctx, &app.reload)
+		return http.StatusOK
+	case "POST":
+		switch err := app.Reload(); err {
+		case nil:
+			writeStatus(ctx, &app.reload)
+			return http.StatusAccepted
+		case ErrReloadDisabled:
+			return adminError(ctx, http.StatusNotFound, err)
+		default:
+			return adminError(ctx, http.StatusConflict, err)
+		}
+	}
+
+	return http.StatusMethodNotAllowed
+}
+
+func adminError(ctx *fasthttp.RequestCtx, status int, err error) int {
+	b := appendJSONString([]byte(`{"error":`), err.Error())
+	ctx.Write(append(b, '}'))
+	return status
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/ei-grad/hlcup/db"
+)
+
+func testRequest(app *Application, method, uri string, body []byte) int {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.SetBody(body)
+	app.RequestHandler(&ctx)
+	return ctx.Response.StatusCode()
+}
+
+func TestReloadConcurrentWrites(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the reload should take long enough to get the writes while loading
+	var b bytes.Buffer
+	for i := 1; i <= 20000; i++ {
+		fmt.Fprintf(&b, `{"id":%d,"email":"%d@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}`+"\n", i, i)
+	}
+	data := filepath.Join(dir, "users.ndjson")
+	if err := ioutil.WriteFile(data, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewApplication(db.NewMapStorage())
+	a.EnableReload(func() (db.Storage, error) { return db.NewMapStorage(), nil })
+	if err := a.LoadData(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		reloading int32
+		stop      = make(chan struct{})
+		nextID    = uint32(100000)
+		// the users added after Reload is called
+		added       []uint32
+		unavailable int32
+	)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				after := atomic.LoadInt32(&reloading) == 1
+				id := atomic.AddUint32(&nextID, 1)
+				body := []byte(fmt.Sprintf(`{"id":%d,"email":"%d@b.c","first_name":"a","last_name":"b","gender":"f","birth_date":0}`, id, id))
+				switch status := testRequest(a, "POST", "/users/new", body); status {
+				case http.StatusOK:
+					if after {
+						mu.Lock()
+						added = append(added, id)
+						mu.Unlock()
+					}
+				case http.StatusServiceUnavailable:
+					atomic.AddInt32(&unavailable, 1)
+				default:
+					t.Errorf("POST /users/new: %d", status)
+				}
+				if status := testRequest(a, "GET", "/users/1", nil); status != http.StatusOK {
+					t.Errorf("GET /users/1 while reloading: %d", status)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&reloading, 1)
+	for n := 0; atomic.LoadInt32(&a.reloading) == 1; n++ {
+		if n == 1000 {
+			t.Fatal("reload is not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the writes continue on the new data
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if a.reload.getPhase() != phaseReady {
+		t.Fatalf("reload phase %s", a.reload.getPhase())
+	}
+	if unavailable == 0 {
+		t.Error("no writes while reloading")
+	}
+	if len(added) == 0 {
+		t.Error("no writes after reload")
+	}
+	for _, id := range added {
+		if !a.db.GetUser(id).IsValid() {
+			t.Fatalf("user %d is accepted and lost", id)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// drainPollInterval is how often Drain checks the in-flight requests
+const drainPollInterval = 10 * time.Millisecond
+
+// Drain makes the responses close keep-alive connections and waits until
+// there are no in-flight requests, it returns false if they are still
+// running after the timeout. The listener should be closed before.
+func (app *Application) Drain(timeout time.Duration) bool {
+	atomic.StoreInt32(&app.draining, 1)
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&app.inflight) > 0 {
+		if time.Now().After(deadline) {
+			log.Printf("shutdown: %d requests are still in flight after %s",
+				atomic.LoadInt32(&app.inflight), timeout)
+			return false
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return true
+}
+
+// Close writes the snapshot if persist is set and the snapshot is enabled,
+// then syncs and closes the WAL and the access log. The mutations fail after
+// it.
+func (app *Application) Close(persist bool) error {
+
+	var err error
+
+	if persist && app.snapshot != nil {
+		if app.Ready() {
+			err = app.WriteSnapshot()
+			if err != nil {
+				log.Print("snapshot: write failed: ", err)
+			}
+		} else {
+			// don't replace the snapshot with the partially loaded data
+			log.Printf("snapshot: data is not loaded (%s), not writing it", app.load.getPhase())
+		}
+	}
+
+	app.dataMu.RLock(0)
+	d := app.db
+	app.dataMu.RUnlock(0)
+
+	if werr := d.CloseWAL(); werr != nil {
+		log.Print("wal: close failed: ", werr)
+		if err == nil {
+			err = werr
+		}
+	}
+
+	// the requests still in flight after the drain timeout aren't logged
+	if app.accessLog != nil {
+		if lerr := app.accessLog.Close(); lerr != nil {
+			log.Print("access log: close failed: ", lerr)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ei-grad/hlcup/db"
+)
+
+func TestMutationsAfterClose(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "users.ndjson")
+	if err := ioutil.WriteFile(data, []byte(`{"id":1,"email":"a@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewApplication(db.NewMapStorage())
+	a.UseWAL(db.WALOptions{Path: filepath.Join(dir, "wal")})
+	if err := a.LoadData(data); err != nil {
+		t.Fatal(err)
+	}
+	if status := testRequest(a, "POST", "/users/1", []byte(`{"first_name":"b"}`)); status != http.StatusOK {
+		t.Fatalf("POST /users/1 before close: %d", status)
+	}
+
+	// the requests still in flight after the drain timeout
+	if err := a.Close(false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []struct {
+		method, uri, body string
+	}{
+		{"POST", "/users/new", `{"id":2,"email":"b@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}`},
+		{"POST", "/users/1", `{"first_name":"c"}`},
+		{"POST", "/batch", `[{"op":"update","entity":"users","id":1,"data":{"first_name":"d"}}]`},
+		{"DELETE", "/users/1", ``},
+	} {
+		if status := testRequest(a, i.method, i.uri, []byte(i.body)); status != http.StatusServiceUnavailable {
+			t.Errorf("%s %s after close: %d", i.method, i.uri, status)
+		}
+	}
+	if u := a.db.GetUser(1); u.FirstName != "b" {
+		t.Errorf("user is modified after close: %+v", u)
+	}
+}
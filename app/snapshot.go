@@ -0,0 +1,105 @@
+package app
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/ei-grad/hlcup/db"
+)
+
+type snapshotOptions struct {
+	fileName string
+	interval time.Duration
+}
+
+// UseSnapshot makes LoadData prefer the snapshot file if it is newer than the
+// data file. The snapshot is written after the data file is loaded and then
+// every interval, if it is non-zero. The WAL records before the snapshot are
+// truncated after it is written, so the WAL can't be replayed on top of the
+// data file anymore.
+func (app *Application) UseSnapshot(fileName string, interval time.Duration) {
+	app.snapshot = &snapshotOptions{
+		fileName: fileName,
+		interval: interval,
+	}
+}
+
+func (app *Application) loadSnapshot(dataFileName string) (h db.SnapshotHeader, ok bool) {
+
+	if app.snapshot == nil {
+		return h, false
+	}
+
+	fileName := app.snapshot.fileName
+
+	st, err := os.Stat(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("snapshot: %s", err)
+		}
+		return h, false
+	}
+	if dst, err := os.Stat(dataFileName); err == nil && !st.ModTime().After(dst.ModTime()) {
+		log.Printf("snapshot: %s is older than %s, ignoring it", fileName, dataFileName)
+		return h, false
+	}
+
+	log.Printf("snapshot: loading %s", fileName)
+
+	app.load.setPhase(phaseSnapshot)
+
+	t0 := time.Now()
+
+	// the DB isn't modified if the snapshot can't be read
+	if h, err = app.db.LoadSnapshot(fileName); err != nil {
+		log.Printf("snapshot: can't load %s: %s, falling back to %s", fileName, err, dataFileName)
+		return h, false
+	}
+
+	app.now = referenceTime{h.Now, "snapshot"}
+
+	log.Printf("snapshot: loaded %s (created %s, lsn %d) in %s",
+		fileName, h.Created.Format(time.RFC3339), h.LSN, time.Since(t0))
+
+	return h, true
+}
+
+// WriteSnapshot writes the DB state to the snapshot file
+func (app *Application) WriteSnapshot() error {
+	// the DB isn't swapped by Reload while it is written
+	app.snapshotMu.Lock()
+	defer app.snapshotMu.Unlock()
+	app.dataMu.RLock(0)
+	d, now := app.db, app.now
+	app.dataMu.RUnlock(0)
+	t0 := time.Now()
+	h, err := d.WriteSnapshot(app.snapshot.fileName, now.Time)
+	if err != nil {
+		return err
+	}
+	log.Printf("snapshot: written %s (lsn %d) in %s",
+		app.snapshot.fileName, h.LSN, time.Since(t0))
+	// the records before the snapshot are replayed only on top of it
+	if err := d.TruncateWAL(h.LSN); err != nil {
+		log.Printf("wal: can't truncate up to lsn %d: %s", h.LSN, err)
+	}
+	return nil
+}
+
+func (app *Application) snapshotWriter(writeNow bool) {
+	if writeNow {
+		if err := app.WriteSnapshot(); err != nil {
+			log.Print("snapshot: write failed: ", err)
+		}
+	}
+	if app.snapshot.interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(app.snapshot.interval)
+		if err := app.WriteSnapshot(); err != nil {
+			log.Print("snapshot: write failed: ", err)
+		}
+	}
+}
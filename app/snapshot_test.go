@@ -0,0 +1,83 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ei-grad/hlcup/db"
+	"github.com/ei-grad/hlcup/models"
+)
+
+func TestSnapshotFallback(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "users.ndjson")
+	if err := ioutil.WriteFile(data, []byte(`{"id":1,"email":"a@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the snapshot is used only if it is newer than the data file
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(data, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// a valid snapshot with another user
+	valid := filepath.Join(dir, "valid")
+	d := db.New(db.NewMapStorage())
+	if err := d.AddUser(models.User{ID: 2, Email: "b@b.c", FirstName: "a", LastName: "b", Gender: "f"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.WriteSnapshot(valid, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []struct {
+		name     string
+		snapshot []byte
+		user     uint32
+	}{
+		{"valid", b, 2},
+		{"bad-magic", append([]byte("XXXX"), b[4:]...), 1},
+		{"bad-checksum", append(append([]byte(nil), b[:len(b)-1]...), b[len(b)-1]^0xff), 1},
+	} {
+		fileName := filepath.Join(dir, i.name+".snapshot")
+		if err := ioutil.WriteFile(fileName, i.snapshot, 0644); err != nil {
+			t.Fatal(err)
+		}
+		a := NewApplication(db.NewMapStorage())
+		a.UseSnapshot(fileName, 0)
+		if err := a.LoadData(data); err != nil {
+			t.Fatalf("%s: %s", i.name, err)
+		}
+		if !a.Ready() {
+			t.Fatalf("%s: not ready", i.name)
+		}
+		for _, id := range []uint32{1, 2} {
+			if a.db.GetUser(id).IsValid() != (id == i.user) {
+				t.Errorf("%s: user %d is loaded: %v", i.name, id, a.db.GetUser(id).IsValid())
+			}
+		}
+		// the snapshot is written again in background after the data file
+		// is loaded
+		for n := 0; ; n++ {
+			if _, err := db.New(db.NewMapStorage()).LoadSnapshot(fileName); err == nil {
+				break
+			} else if n == 100 {
+				t.Fatalf("%s: the snapshot is not written: %s", i.name, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
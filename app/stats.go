@@ -0,0 +1,210 @@
+package app
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+// marksStats accumulates the marks in one pass. Marks are 0..5, so the
+// median is found from the histogram without sorting.
+type marksStats struct {
+	Count     int
+	Mean      float64
+	Median    float64
+	Stddev    float64
+	Histogram [6]int
+	sum       int
+	sumSq     int
+}
+
+func (s *marksStats) add(mark uint8) {
+	if int(mark) >= len(s.Histogram) {
+		return
+	}
+	s.Count++
+	s.Histogram[mark]++
+	s.sum += int(mark)
+	s.sumSq += int(mark) * int(mark)
+}
+
+// nth returns n-th (zero-based) mark in the sorted order
+func (s *marksStats) nth(n int) int {
+	for mark, count := range s.Histogram {
+		if n < count {
+			return mark
+		}
+		n -= count
+	}
+	return len(s.Histogram) - 1
+}
+
+func (s *marksStats) finish() {
+	if s.Count == 0 {
+		return
+	}
+	n := float64(s.Count)
+	s.Mean = float64(s.sum) / n
+	s.Stddev = math.Sqrt(math.Max(float64(s.sumSq)/n-s.Mean*s.Mean, 0))
+	if s.Count%2 == 1 {
+		s.Median = float64(s.nth(s.Count / 2))
+	} else {
+		s.Median = float64(s.nth(s.Count/2-1)+s.nth(s.Count/2)) / 2
+	}
+}
+
+// appendJSON appends the count, mean, median, stddev and histogram fields
+// without the braces
+func (s *marksStats) appendJSON(b []byte) []byte {
+	b = append(b, `"count":`...)
+	b = strconv.AppendInt(b, int64(s.Count), 10)
+	b = append(b, `,"mean":`...)
+	b = strconv.AppendFloat(b, s.Mean, 'f', -1, 64)
+	b = append(b, `,"median":`...)
+	b = strconv.AppendFloat(b, s.Median, 'f', -1, 64)
+	b = append(b, `,"stddev":`...)
+	b = strconv.AppendFloat(b, s.Stddev, 'f', -1, 64)
+	b = append(b, `,"histogram":[`...)
+	for i, n := range s.Histogram {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendInt(b, int64(n), 10)
+	}
+	return append(b, ']')
+}
+
+type statsGroup struct {
+	Group string
+	// order sorts the numeric groups by their value, the groups with the
+	// same order are sorted by name
+	order int
+	*marksStats
+}
+
+type statsResponse struct {
+	*marksStats
+	Groups []statsGroup
+}
+
+func (r *statsResponse) appendJSON(b []byte) []byte {
+	b = append(b, '{')
+	b = r.marksStats.appendJSON(b)
+	if len(r.Groups) > 0 {
+		b = append(b, `,"groups":[`...)
+		for i, g := range r.Groups {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, `{"group":`...)
+			b = appendJSONString(b, g.Group)
+			b = append(b, ',')
+			b = g.marksStats.appendJSON(b)
+			b = append(b, '}')
+		}
+		b = append(b, ']')
+	}
+	return append(b, '}')
+}
+
+// AgeBucketSize is the width of the ageBucket groups in years
+const AgeBucketSize = 10
+
+// statsGroupBy returns the group of the mark and its sort order
+type statsGroupBy func(models.LocationMark) (string, int)
+
+// getStatsGroupBy returns the function to get the group of the mark
+func (app *Application) getStatsGroupBy(groupBy []byte) (statsGroupBy, bool) {
+	switch string(groupBy) {
+	case "":
+		return nil, true
+	case "gender":
+		return func(m models.LocationMark) (string, int) {
+			return string([]byte{m.Gender}), 0
+		}, true
+	case "ageBucket":
+		q := models.MarksQuery{Now: app.referenceTime()}
+		return func(m models.LocationMark) (string, int) {
+			age := q.Age(m.BirthDate)
+			if age < 0 {
+				age = 0
+			}
+			from := age / AgeBucketSize * AgeBucketSize
+			return strconv.Itoa(from) + "-" + strconv.Itoa(from+AgeBucketSize-1), from
+		}, true
+	case "year":
+		return func(m models.LocationMark) (string, int) {
+			year := time.Unix(int64(m.VisitedAt), 0).UTC().Year()
+			return strconv.Itoa(year), year
+		}, true
+	}
+	return nil, false
+}
+
+// GetLocationStats returns count, mean, median, stddev and histogram of the
+// location marks filtered with the GetMarksFilter parameters, optionally
+// broken down with groupBy=gender|ageBucket|year
+func (app *Application) GetLocationStats(w io.Writer, id uint32, args Peeker) int {
+
+	app.db.RLockLocation(id)
+	defer app.db.RUnlockLocation(id)
+
+	if !app.db.GetLocation(id).IsValid() {
+		return http.StatusNotFound
+	}
+
+	filter, err := app.GetMarksFilter(args)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+
+	groupBy, ok := app.getStatsGroupBy(args.Peek("groupBy"))
+	if !ok {
+		return http.StatusBadRequest
+	}
+
+	total := &marksStats{}
+	groups := map[string]*statsGroup{}
+
+	marks := app.db.GetLocationMarks(id)
+	marks.M.RLock()
+	for _, i := range marks.Marks {
+		if !filter(i) {
+			continue
+		}
+		total.add(i.Mark)
+		if groupBy != nil {
+			key, order := groupBy(i)
+			g := groups[key]
+			if g == nil {
+				g = &statsGroup{key, order, &marksStats{}}
+				groups[key] = g
+			}
+			g.add(i.Mark)
+		}
+	}
+	marks.M.RUnlock()
+
+	total.finish()
+	resp := statsResponse{marksStats: total}
+	for _, g := range groups {
+		g.finish()
+		resp.Groups = append(resp.Groups, *g)
+	}
+	sort.Slice(resp.Groups, func(i, j int) bool {
+		a, b := resp.Groups[i], resp.Groups[j]
+		if a.order != b.order {
+			return a.order < b.order
+		}
+		return a.Group < b.Group
+	})
+
+	w.Write(resp.appendJSON(nil))
+
+	return http.StatusOK
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/ei-grad/hlcup/db"
+	"github.com/ei-grad/hlcup/models"
+)
+
+func testGet(t *testing.T, app *Application, uri string, resp interface{}) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("GET")
+	ctx.Request.SetRequestURI(uri)
+	app.RequestHandler(&ctx)
+	if status := ctx.Response.StatusCode(); status != http.StatusOK {
+		t.Fatalf("GET %s: %d", uri, status)
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), resp); err != nil {
+		t.Fatalf("GET %s: %s: %s", uri, err, ctx.Response.Body())
+	}
+}
+
+// testStatsApp has location 1 visited by the users of 5, 25 and 105 years
+func testStatsApp(t *testing.T) *Application {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := NewApplication(db.NewMapStorage())
+	a.SetNow(NowFixed, now)
+	if err := a.db.AddLocation(models.Location{ID: 1, Place: "place", Country: "country", City: "city", Distance: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i, age := range []int{105, 5, 25} {
+		id := uint32(i + 1)
+		if err := a.db.AddUser(models.User{
+			ID:        id,
+			Email:     fmt.Sprintf("%d@b.c", id),
+			FirstName: `first "` + fmt.Sprint(id) + `"`,
+			LastName:  "last\n",
+			Gender:    "mf"[i%2 : i%2+1],
+			BirthDate: now.AddDate(-age, 0, -1).Unix(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.db.AddVisit(models.Visit{ID: id, User: id, Location: 1, VisitedAt: int(now.AddDate(-i, 0, 0).Unix()), Mark: uint8(id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+func TestLocationStats(t *testing.T) {
+
+	a := testStatsApp(t)
+
+	var resp struct {
+		Count     int     `json:"count"`
+		Mean      float64 `json:"mean"`
+		Median    float64 `json:"median"`
+		Histogram []int   `json:"histogram"`
+		Groups    []struct {
+			Group string `json:"group"`
+			Count int    `json:"count"`
+		} `json:"groups"`
+	}
+
+	for _, c := range []struct {
+		groupBy string
+		groups  []string
+	}{
+		{"", nil},
+		{"gender", []string{"f", "m"}},
+		// the numeric groups are not sorted as strings
+		{"ageBucket", []string{"0-9", "20-29", "100-109"}},
+		{"year", []string{"2015", "2016", "2017"}},
+	} {
+		resp.Groups = nil
+		testGet(t, a, "/locations/1/stats?groupBy="+c.groupBy, &resp)
+		if resp.Count != 3 || resp.Mean != 2 || resp.Median != 2 || fmt.Sprint(resp.Histogram) != "[0 1 1 1 0 0]" {
+			t.Errorf("groupBy=%s: %+v", c.groupBy, resp)
+		}
+		var groups []string
+		for _, g := range resp.Groups {
+			groups = append(groups, g.Group)
+		}
+		if fmt.Sprint(groups) != fmt.Sprint(c.groups) {
+			t.Errorf("groupBy=%s: groups %v, expected %v", c.groupBy, groups, c.groups)
+		}
+	}
+}
+
+func TestLocationVisitors(t *testing.T) {
+
+	a := testStatsApp(t)
+
+	var resp struct {
+		Total    int `json:"total"`
+		Visitors []struct {
+			ID        uint32 `json:"id"`
+			FirstName string `json:"first_name"`
+			LastName  string `json:"last_name"`
+			Visits    int    `json:"visits"`
+		} `json:"visitors"`
+	}
+	testGet(t, a, "/locations/1/visitors?limit=2", &resp)
+	if resp.Total != 3 || len(resp.Visitors) != 2 {
+		t.Fatalf("%+v", resp)
+	}
+	// the latest visit goes first, the names are escaped
+	if v := resp.Visitors[0]; v.ID != 1 || v.FirstName != `first "1"` || v.LastName != "last\n" || v.Visits != 1 {
+		t.Errorf("%+v", v)
+	}
+}
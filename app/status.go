@@ -0,0 +1,295 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/ei-grad/hlcup/dataset"
+)
+
+// loadPhase is the step of LoadData
+type loadPhase int32
+
+const (
+	phaseStarting loadPhase = iota
+	phaseSnapshot
+	phaseDataset
+	phaseWAL
+	phaseReady
+	phaseFailed
+)
+
+func (p loadPhase) String() string {
+	switch p {
+	case phaseStarting:
+		return "starting"
+	case phaseSnapshot:
+		return "snapshot"
+	case phaseDataset:
+		return "dataset"
+	case phaseWAL:
+		return "wal"
+	case phaseReady:
+		return "ready"
+	case phaseFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+type stageState struct {
+	started  time.Time
+	finished time.Time
+}
+
+// loadStatus is the LoadData progress
+type loadStatus struct {
+	phase int32
+	// counts are updated atomically by the loader
+	counts counts
+
+	sync.Mutex
+	started  time.Time
+	finished time.Time
+	stages   [2]stageState
+	rejects  *dataset.Rejects
+	err      error
+}
+
+func (s *loadStatus) getPhase() loadPhase {
+	return loadPhase(atomic.LoadInt32(&s.phase))
+}
+
+func (s *loadStatus) setPhase(p loadPhase) {
+	s.Lock()
+	defer s.Unlock()
+	switch p {
+	case phaseStarting:
+		s.started = time.Now()
+	case phaseReady, phaseFailed:
+		s.finished = time.Now()
+	}
+	atomic.StoreInt32(&s.phase, int32(p))
+}
+
+func (s *loadStatus) fail(err error) {
+	s.Lock()
+	s.err = err
+	s.Unlock()
+	s.setPhase(phaseFailed)
+}
+
+func (s *loadStatus) startStage(stage int) {
+	s.Lock()
+	defer s.Unlock()
+	s.stages[stage-1].started = time.Now()
+}
+
+func (s *loadStatus) finishStage(stage int) {
+	s.Lock()
+	defer s.Unlock()
+	s.stages[stage-1].finished = time.Now()
+}
+
+// reset clears the status before loading again
+func (s *loadStatus) reset() {
+	s.Lock()
+	defer s.Unlock()
+	atomic.StoreInt32(&s.counts.Users, 0)
+	atomic.StoreInt32(&s.counts.Locations, 0)
+	atomic.StoreInt32(&s.counts.Visits, 0)
+	s.started = time.Time{}
+	s.finished = time.Time{}
+	s.stages = [2]stageState{}
+	s.rejects = nil
+	s.err = nil
+}
+
+func (s *loadStatus) setRejects(r *dataset.Rejects) {
+	s.Lock()
+	defer s.Unlock()
+	s.rejects = r
+}
+
+// Ready tells if LoadData has successfully finished
+func (app *Application) Ready() bool {
+	return app.load.getPhase() == phaseReady
+}
+
+// SetUnavailableWhileLoading makes the data requests get 503 with the
+// Retry-After header until the data is loaded, instead of 404 for the
+// entities which are not loaded yet. Zero retryAfter disables it.
+func (app *Application) SetUnavailableWhileLoading(retryAfter time.Duration) {
+	app.retryAfter = retryAfter
+}
+
+// unavailable writes 503 for the data requests while loading. The mutations
+// get it regardless of retryAfter if the WAL is enabled, it is attached after
+// the data is loaded and they would be lost on restart. While the data is
+// reloaded the mutations get it too, they would be lost with the old DB.
+func (app *Application) unavailable(ctx *fasthttp.RequestCtx, path []byte) bool {
+	if !isDataPath(path) {
+		return false
+	}
+	switch {
+	case !app.Ready():
+		if app.retryAfter == 0 && (app.wal == nil || ctx.IsGet()) {
+			return false
+		}
+	case atomic.LoadInt32(&app.reloadPending) == 1:
+		if ctx.IsGet() {
+			return false
+		}
+	default:
+		return false
+	}
+	seconds := int(app.retryAfter / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(seconds))
+	ctx.SetStatusCode(http.StatusServiceUnavailable)
+	return true
+}
+
+var dataPaths = [][]byte{
+	[]byte("/users"),
+	[]byte("/locations"),
+	[]byte("/visits"),
+	bytesBatchPath,
+}
+
+func isDataPath(path []byte) bool {
+	for _, i := range dataPaths {
+		if bytes.HasPrefix(path, i) && (len(path) == len(i) || path[len(i)] == '/' || path[len(i)] == '?') {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	bytesHealth = []byte("health")
+	bytesLive   = []byte("live")
+	bytesReady  = []byte("ready")
+	bytesStatus = []byte("status")
+	bytesNow    = []byte("now")
+)
+
+// GetLive is the liveness probe, the process is able to serve requests
+func (app *Application) GetLive(w io.Writer) int {
+	w.Write([]byte(`{"status":"ok"}`))
+	return http.StatusOK
+}
+
+// GetReady is the readiness probe, it succeeds only after both loader
+// stages and the WAL replay are finished
+func (app *Application) GetReady(w io.Writer) int {
+	phase := app.load.getPhase()
+	b, _ := json.Marshal(struct {
+		Ready bool   `json:"ready"`
+		Phase string `json:"phase"`
+	}{phase == phaseReady, phase.String()})
+	w.Write(b)
+	if phase != phaseReady {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+type stageStatusResponse struct {
+	Stage     int     `json:"stage"`
+	State     string  `json:"state"`
+	Elapsed   float64 `json:"elapsed"`
+	Users     *int32  `json:"users,omitempty"`
+	Locations *int32  `json:"locations,omitempty"`
+	Visits    *int32  `json:"visits,omitempty"`
+}
+
+type statusResponse struct {
+	Phase    string                `json:"phase"`
+	Ready    bool                  `json:"ready"`
+	Elapsed  float64               `json:"elapsed"`
+	Stages   []stageStatusResponse `json:"stages"`
+	Rejected int                   `json:"rejected"`
+	Error    string                `json:"error,omitempty"`
+}
+
+// GetStatus reports the data loading progress
+func (app *Application) GetStatus(w io.Writer) int {
+	writeStatus(w, &app.load)
+	return http.StatusOK
+}
+
+func writeStatus(w io.Writer, s *loadStatus) {
+
+	phase := s.getPhase()
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if !s.finished.IsZero() {
+		// a failed stage stops with the loading
+		now = s.finished
+	}
+	elapsed := func(started, finished time.Time) float64 {
+		switch {
+		case started.IsZero():
+			return 0
+		case finished.IsZero():
+			return now.Sub(started).Seconds()
+		}
+		return finished.Sub(started).Seconds()
+	}
+
+	resp := statusResponse{
+		Phase:   phase.String(),
+		Ready:   phase == phaseReady,
+		Elapsed: elapsed(s.started, s.finished),
+	}
+	if s.err != nil {
+		resp.Error = s.err.Error()
+	}
+	if s.rejects != nil {
+		resp.Rejected = s.rejects.Summary().Total
+	}
+
+	users := atomic.LoadInt32(&s.counts.Users)
+	locations := atomic.LoadInt32(&s.counts.Locations)
+	visits := atomic.LoadInt32(&s.counts.Visits)
+
+	for n, i := range s.stages {
+		stage := stageStatusResponse{Stage: n + 1, Elapsed: elapsed(i.started, i.finished)}
+		switch {
+		case !i.finished.IsZero():
+			stage.State = "done"
+		case i.started.IsZero() && (phase == phaseSnapshot || phase >= phaseWAL):
+			// loaded from the snapshot or stopped earlier
+			stage.State = "skipped"
+		case i.started.IsZero():
+			stage.State = "pending"
+		case phase == phaseFailed:
+			stage.State = "failed"
+		default:
+			stage.State = "running"
+		}
+		if n == 0 {
+			stage.Users, stage.Locations = &users, &locations
+		} else {
+			stage.Visits = &visits
+		}
+		resp.Stages = append(resp.Stages, stage)
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Write(b)
+}
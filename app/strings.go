@@ -8,4 +8,9 @@ var (
 	bytesLocations = []byte(strLocations)
 	bytesVisits    = []byte(strVisits)
 	bytesAvg       = []byte("avg")
+	bytesVisitors  = []byte("visitors")
+	bytesStats     = []byte("stats")
+	bytesByEmail   = []byte("by-email")
+	bytesSearch    = []byte("search")
+	bytesMetrics   = []byte("metrics")
 )
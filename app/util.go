@@ -1,16 +1,11 @@
 package app
 
 import (
-	"bytes"
 	"errors"
 	"log"
-	"net/http"
-	"runtime"
-	"runtime/pprof"
+	"math"
 	"sync/atomic"
 	"time"
-
-	"github.com/valyala/fasthttp"
 )
 
 var (
@@ -18,6 +13,7 @@ var (
 	errUnexpectedFirstChar    = errors.New("unexpected first char found. Expecting 0-9")
 	errUnexpectedTrailingChar = errors.New("unexpected traling char found. Expecting 0-9")
 	errTooLongInt             = errors.New("too long int")
+	errIntOverflow            = errors.New("int overflows uint32")
 )
 
 var maxIntChars = 10
@@ -40,7 +36,11 @@ func parseUint32(b []byte) (uint32, error) {
 		if i >= maxIntChars {
 			return 0, errTooLongInt
 		}
-		v = 10*v + uint32(k)
+		next := 10*uint64(v) + uint64(k)
+		if next > math.MaxUint32 {
+			return 0, errIntOverflow
+		}
+		v = uint32(next)
 	}
 	if n != len(b) {
 		return 0, errUnexpectedTrailingChar
@@ -53,32 +53,14 @@ func (app *Application) RpsWatcher() {
 		time.Sleep(1 * time.Second)
 		count := atomic.LoadInt32(&app.countRequests)
 		if count > 0 {
-			log.Printf("RPS: %6d", count)
+			if app.cache != nil {
+				s := app.cache.Stats()
+				log.Printf("RPS: %6d, cache: %d hits, %d misses, %d evictions, %d entries, %d bytes",
+					count, s.Hits, s.Misses, s.Evictions, s.Entries, s.Size)
+			} else {
+				log.Printf("RPS: %6d", count)
+			}
 			atomic.SwapInt32(&app.countRequests, 0)
 		}
 	}
 }
-
-func GetPprof(ctx *fasthttp.RequestCtx, entity []byte) int {
-	if bytes.Equal(entity, []byte("pprof")) {
-		t, err := time.ParseDuration(string(ctx.QueryArgs().Peek("t")))
-		if err != nil {
-			t = 30 * time.Second
-		}
-		if err := pprof.StartCPUProfile(ctx); err != nil {
-			log.Print("could not start CPU profile: ", err)
-			return http.StatusInternalServerError
-		}
-		time.Sleep(t)
-		pprof.StopCPUProfile()
-		return http.StatusOK
-	}
-	if bytes.Equal(entity, []byte("pprof_mem")) {
-		runtime.GC() // get up-to-date statistics
-		if err := pprof.WriteHeapProfile(ctx); err != nil {
-			log.Fatal("could not write memory profile: ", err)
-		}
-		return http.StatusOK
-	}
-	return http.StatusNotFound
-}
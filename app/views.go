@@ -1,6 +1,7 @@
 package app
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"net/http"
 	"sort"
 
+	"github.com/ei-grad/hlcup/db"
 	"github.com/ei-grad/hlcup/entities"
 	"github.com/ei-grad/hlcup/models"
 )
@@ -21,12 +23,18 @@ func (app *Application) GetEntity(w io.Writer, entity entities.Entity, id uint32
 
 	switch entity {
 	case entities.User:
+		app.db.RLockUser(id)
+		defer app.db.RUnlockUser(id)
 		user := app.db.GetUser(id)
 		v = &user
 	case entities.Location:
+		app.db.RLockLocation(id)
+		defer app.db.RUnlockLocation(id)
 		location := app.db.GetLocation(id)
 		v = &location
 	case entities.Visit:
+		app.db.RLockVisit(id)
+		defer app.db.RUnlockVisit(id)
 		visit := app.db.GetVisit(id)
 		v = &visit
 	default:
@@ -43,7 +51,72 @@ func (app *Application) GetEntity(w io.Writer, entity entities.Entity, id uint32
 
 }
 
-func (app *Application) GetUserVisits(w io.Writer, id uint32, args Peeker) int {
+// isPathPart checks that the last path part is the word, possibly followed by
+// the query string
+func isPathPart(b, word []byte) bool {
+	return bytes.HasPrefix(b, word) &&
+		(len(b) == len(word) || b[len(word)] == '?')
+}
+
+func (app *Application) GetUserByEmail(w io.Writer, args Peeker) int {
+
+	email := args.Peek("email")
+	if len(email) == 0 {
+		return http.StatusBadRequest
+	}
+
+	user := app.db.GetUserByEmail(string(email))
+	if !user.IsValid() {
+		return http.StatusNotFound
+	}
+
+	user.DumpTo(w)
+
+	return http.StatusOK
+}
+
+const (
+	DefaultSearchLimit = 10
+	MaxSearchLimit     = 1000
+)
+
+// SetMaxSearchLimit limits the limit parameter of the location search
+func (app *Application) SetMaxSearchLimit(n int) {
+	app.maxSearchLimit = n
+}
+
+func (app *Application) SearchLocations(w io.Writer, args Peeker) int {
+
+	q := args.Peek("q")
+	if len(db.Tokenize(string(q))) == 0 {
+		return http.StatusBadRequest
+	}
+
+	limit := DefaultSearchLimit
+	if b := args.Peek("limit"); b != nil {
+		n, err := parseUint32(b)
+		if err != nil || n == 0 || n > uint32(app.maxSearchLimit) {
+			return http.StatusBadRequest
+		}
+		limit = int(n)
+	}
+
+	io.WriteString(w, `{"locations":[`)
+	for n, i := range app.db.SearchLocations(string(q), limit) {
+		if n > 0 {
+			io.WriteString(w, ",")
+		}
+		i.DumpTo(w)
+	}
+	io.WriteString(w, "]}")
+
+	return http.StatusOK
+}
+
+func (app *Application) GetUserVisits(w io.Writer, id uint32, args Args) int {
+
+	app.db.RLockUser(id)
+	defer app.db.RUnlockUser(id)
 
 	if !app.db.GetUser(id).IsValid() {
 		return http.StatusNotFound
@@ -54,7 +127,16 @@ func (app *Application) GetUserVisits(w io.Writer, id uint32, args Peeker) int {
 		return http.StatusBadRequest
 	}
 
-	first := true
+	page, err := GetVisitsPage(args, app.maxPageLimit)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+
+	var (
+		n, skipped int
+		last       models.UserVisit
+		more       bool
+	)
 
 	io.WriteString(w, `{"visits":[`)
 
@@ -75,48 +157,87 @@ func (app *Application) GetUserVisits(w io.Writer, id uint32, args Peeker) int {
 			v = v[:i]
 		}
 	}
-	for _, i := range v {
+	if page.cursor != nil {
+		c := page.cursor
+		if page.desc {
+			v = v[:sort.Search(len(v), func(i int) bool { return c.compare(v[i]) <= 0 })]
+		} else {
+			v = v[sort.Search(len(v), func(i int) bool { return c.compare(v[i]) < 0 }):]
+		}
+	}
+	for k := range v {
+		i := v[k]
+		if page.desc {
+			i = v[len(v)-1-k]
+		}
 		if !filter.filter(i) {
 			continue
 		}
-		if !first {
+		if skipped < page.offset {
+			skipped++
+			continue
+		}
+		if page.limit > 0 && n == page.limit {
+			more = true
+			break
+		}
+		if n > 0 {
 			io.WriteString(w, ",")
 		}
 		i.DumpTo(w)
-		first = false
+		last = i
+		n++
 	}
 	visits.M.RUnlock()
 
-	io.WriteString(w, "]}")
+	io.WriteString(w, "]")
+	if more {
+		io.WriteString(w, `,"next_cursor":"`+visitsCursorOf(last).String()+`"`)
+	}
+	io.WriteString(w, "}")
 
 	return http.StatusOK
 }
 
 func (app *Application) GetLocationAvg(w io.Writer, id uint32, args Peeker) int {
 
+	app.db.RLockLocation(id)
+	defer app.db.RUnlockLocation(id)
+
 	if !app.db.GetLocation(id).IsValid() {
 		return http.StatusNotFound
 	}
 
-	filter, err := app.GetMarksFilter(args)
+	q, err := app.GetMarksQuery(args)
 	if err != nil {
 		return http.StatusBadRequest
 	}
 
-	var sum, count int
 	var avg float64
 
 	marks := app.db.GetLocationMarks(id)
 	marks.M.RLock()
-	for _, i := range marks.Marks {
-		if !filter(i) {
-			continue
+	sum, count, ok := marks.Sum(q)
+	if !ok {
+		filter := MarksQueryFilter(q)
+		for _, i := range marks.Marks {
+			if !filter(i) {
+				continue
+			}
+			sum = sum + int(i.Mark)
+			count = count + 1
 		}
-		sum = sum + int(i.Mark)
-		count = count + 1
 	}
+	n := len(marks.Marks)
 	marks.M.RUnlock()
 
+	// the aggregate is tied to the reference second, it isn't built for the
+	// wall clock which moves on the next second
+	if !ok && n >= models.AggregateMinMarks && app.nowMode != NowWallClock {
+		// the next queries will be answered by the aggregate
+		marks.Aggregate(q.Now)
+	}
+
 	if count == 0 {
 		// location have no marks
 		avg = 0.
@@ -158,7 +279,10 @@ func (app *Application) PostEntityNew(entity entities.Entity, body []byte) int {
 	if err := v.UnmarshalJSON(body); err != nil {
 		return http.StatusBadRequest
 	}
-	if err := saver(); err != nil {
+	if err := saver(); err == db.ErrWALClosed {
+		// shutting down, the mutation isn't applied
+		return http.StatusServiceUnavailable
+	} else if err != nil {
 		return http.StatusBadRequest
 	}
 
@@ -232,7 +356,14 @@ func (app *Application) PostEntity(entity entities.Entity, id uint32, body []byt
 		err = app.db.UpdateVisit(visit)
 	}
 
-	if err != nil {
+	switch err {
+	case nil:
+	case db.ErrNotFound:
+		// deleted after the check above
+		return http.StatusNotFound
+	case db.ErrWALClosed:
+		return http.StatusServiceUnavailable
+	default:
 		return http.StatusBadRequest
 	}
 
@@ -242,3 +373,44 @@ func (app *Application) PostEntity(entity entities.Entity, id uint32, body []byt
 
 	return http.StatusOK
 }
+
+// DeleteEntity removes the entity. Users and locations which have visits are
+// removed only with cascade=1 query argument, together with their visits.
+func (app *Application) DeleteEntity(entity entities.Entity, id uint32, args Peeker) int {
+
+	var cascade bool
+
+	switch string(args.Peek("cascade")) {
+	case "", "0", "false":
+	case "1", "true":
+		cascade = true
+	default:
+		return http.StatusBadRequest
+	}
+
+	var err error
+
+	switch entity {
+	case entities.User:
+		err = app.db.DeleteUser(id, cascade)
+	case entities.Location:
+		err = app.db.DeleteLocation(id, cascade)
+	case entities.Visit:
+		err = app.db.DeleteVisit(id)
+	default:
+		return http.StatusNotFound
+	}
+
+	switch err {
+	case nil:
+		return http.StatusOK
+	case db.ErrNotFound:
+		return http.StatusNotFound
+	case db.ErrReferenced:
+		return http.StatusConflict
+	case db.ErrWALClosed:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
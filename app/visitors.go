@@ -0,0 +1,162 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+// SetMaxPageLimit limits the limit parameter of the paged responses
+func (app *Application) SetMaxPageLimit(n int) {
+	app.maxPageLimit = n
+}
+
+var (
+	errInvalidLimit  = errors.New("invalid limit")
+	errInvalidOffset = errors.New("invalid offset")
+)
+
+type visitor struct {
+	ID            uint32
+	FirstName     string
+	LastName      string
+	Visits        int
+	LastVisitedAt int
+}
+
+func (v *visitor) appendJSON(b []byte) []byte {
+	b = append(b, `{"id":`...)
+	b = strconv.AppendUint(b, uint64(v.ID), 10)
+	b = append(b, `,"first_name":`...)
+	b = appendJSONString(b, v.FirstName)
+	b = append(b, `,"last_name":`...)
+	b = appendJSONString(b, v.LastName)
+	b = append(b, `,"visits":`...)
+	b = strconv.AppendInt(b, int64(v.Visits), 10)
+	b = append(b, `,"last_visited_at":`...)
+	b = strconv.AppendInt(b, int64(v.LastVisitedAt), 10)
+	return append(b, '}')
+}
+
+type visitorsResponse struct {
+	Total    int
+	Visitors []*visitor
+}
+
+func (r *visitorsResponse) appendJSON(b []byte) []byte {
+	b = append(b, `{"total":`...)
+	b = strconv.AppendInt(b, int64(r.Total), 10)
+	b = append(b, `,"visitors":[`...)
+	for i, v := range r.Visitors {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = v.appendJSON(b)
+	}
+	return append(b, ']', '}')
+}
+
+// parsePage validates the limit and offset query args, limit is zero if it
+// is not set
+func parsePage(args Peeker, maxLimit int) (limit, offset int, err error) {
+	if b := args.Peek("limit"); b != nil {
+		n, err := parseUint32(b)
+		if err != nil || n == 0 || n > uint32(maxLimit) {
+			return 0, 0, errInvalidLimit
+		}
+		limit = int(n)
+	}
+	if b := args.Peek("offset"); b != nil {
+		n, err := parseUint32(b)
+		if err != nil {
+			return 0, 0, errInvalidOffset
+		}
+		offset = int(n)
+	}
+	return
+}
+
+// GetLocationVisitors lists the users who visited the location, with the
+// number of their visits and the latest visit time. The marks are filtered
+// with the GetMarksFilter parameters, the users who visited the location last
+// go first.
+func (app *Application) GetLocationVisitors(w io.Writer, id uint32, args Peeker) int {
+
+	app.db.RLockLocation(id)
+	defer app.db.RUnlockLocation(id)
+
+	if !app.db.GetLocation(id).IsValid() {
+		return http.StatusNotFound
+	}
+
+	filter, err := app.GetMarksFilter(args)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+
+	limit, offset, err := parsePage(args, app.maxPageLimit)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	if limit == 0 {
+		limit = DefaultPageLimit
+	}
+
+	users := map[uint32]*visitor{}
+
+	marks := app.db.GetLocationMarks(id)
+	marks.M.RLock()
+	for _, i := range marks.Marks {
+		if !filter(i) {
+			continue
+		}
+		v := users[i.User]
+		if v == nil {
+			v = &visitor{ID: i.User}
+			users[i.User] = v
+		}
+		v.Visits++
+		if i.VisitedAt > v.LastVisitedAt {
+			v.LastVisitedAt = i.VisitedAt
+		}
+	}
+	marks.M.RUnlock()
+
+	visitors := make([]*visitor, 0, len(users))
+	for _, v := range users {
+		visitors = append(visitors, v)
+	}
+	sort.Slice(visitors, func(i, j int) bool {
+		if visitors[i].LastVisitedAt != visitors[j].LastVisitedAt {
+			return visitors[i].LastVisitedAt > visitors[j].LastVisitedAt
+		}
+		return visitors[i].ID < visitors[j].ID
+	})
+
+	resp := visitorsResponse{Total: len(visitors)}
+	if offset < len(visitors) {
+		visitors = visitors[offset:]
+	} else {
+		visitors = visitors[:0]
+	}
+	if len(visitors) > limit {
+		visitors = visitors[:limit]
+	}
+	for _, v := range visitors {
+		user := app.db.GetUser(v.ID)
+		v.FirstName = user.FirstName
+		v.LastName = user.LastName
+	}
+	resp.Visitors = visitors
+
+	w.Write(resp.appendJSON(nil))
+
+	return http.StatusOK
+}
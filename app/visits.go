@@ -1,8 +1,11 @@
 package app
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/ei-grad/hlcup/models"
 )
@@ -17,21 +20,58 @@ type UserVisitFilterData struct {
 
 type UserVisitFilter func(models.UserVisit) bool
 
+// Args is the query args of the request, implemented by fasthttp.Args
+type Args interface {
+	Peeker
+	VisitAll(f func(key, value []byte))
+}
+
 // GetVisitsFilter validates query args and returns a function to filter
-// UserVisit's based on this parameters
+// UserVisit's based on this parameters. Unknown parameters are reported as
+// an error.
 //
 // Parameters:
 //
 //     fromDate - посещения с visited_at > fromDate
 //     toDate - посещения с visited_at < toDate
 //     country - название страны, в которой находятся интересующие
-//               достопримечательности
+//               достопримечательности, может быть указан несколько раз
+//     city - название города
+//     placePrefix - описание места начинается с этой строки
+//     fromDistance - возвращать только те места, у которых
+//                    расстояние от города больше этого параметра
 //     toDistance - возвращать только те места, у которых
 //                  расстояние от города меньше этого параметра
+//     fromMark, toMark - оценка в диапазоне [fromMark, toMark]
+//
+// Also limit, offset, cursor and order are accepted, see GetVisitsPage.
 //
-func GetVisitsFilter(args Peeker) (ret UserVisitFilterData, err error) {
+func GetVisitsFilter(args Args) (ret UserVisitFilterData, err error) {
 
-	var filters []UserVisitFilter
+	var (
+		filters   []UserVisitFilter
+		countries map[string]bool
+	)
+
+	args.VisitAll(func(key, value []byte) {
+		switch string(key) {
+		case "fromDate", "toDate", "city", "placePrefix", "fromDistance",
+			"toDistance", "fromMark", "toMark", "limit", "offset", "cursor",
+			"order":
+		case "country":
+			if countries == nil {
+				countries = map[string]bool{}
+			}
+			countries[string(value)] = true
+		default:
+			if err == nil {
+				err = fmt.Errorf("unknown parameter: %s", key)
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
 
 	fromDateRaw := args.Peek("fromDate")
 	if fromDateRaw != nil {
@@ -53,9 +93,27 @@ func GetVisitsFilter(args Peeker) (ret UserVisitFilterData, err error) {
 		ret.toDate = toDate
 	}
 
-	countryRaw := args.Peek("country")
-	if countryRaw != nil {
-		filters = append(filters, filterUserVisitCountry(string(countryRaw)))
+	if countries != nil {
+		filters = append(filters, filterUserVisitCountries(countries))
+	}
+
+	cityRaw := args.Peek("city")
+	if cityRaw != nil {
+		filters = append(filters, filterUserVisitCity(string(cityRaw)))
+	}
+
+	placePrefixRaw := args.Peek("placePrefix")
+	if placePrefixRaw != nil {
+		filters = append(filters, filterUserVisitPlacePrefix(string(placePrefixRaw)))
+	}
+
+	fromDistanceRaw := args.Peek("fromDistance")
+	if fromDistanceRaw != nil {
+		fromDistance, err := strconv.ParseUint(string(fromDistanceRaw), 10, 32)
+		if err != nil {
+			return ret, fmt.Errorf("invalid fromDistance: %s", err)
+		}
+		filters = append(filters, filterUserVisitFromDistance(uint32(fromDistance)))
 	}
 
 	toDistanceRaw := args.Peek("toDistance")
@@ -67,6 +125,24 @@ func GetVisitsFilter(args Peeker) (ret UserVisitFilterData, err error) {
 		filters = append(filters, filterUserVisitToDistance(uint32(toDistance)))
 	}
 
+	fromMarkRaw := args.Peek("fromMark")
+	if fromMarkRaw != nil {
+		fromMark, err := strconv.ParseUint(string(fromMarkRaw), 10, 8)
+		if err != nil || fromMark > 5 {
+			return ret, fmt.Errorf("invalid fromMark: %s", fromMarkRaw)
+		}
+		filters = append(filters, filterUserVisitFromMark(uint8(fromMark)))
+	}
+
+	toMarkRaw := args.Peek("toMark")
+	if toMarkRaw != nil {
+		toMark, err := strconv.ParseUint(string(toMarkRaw), 10, 8)
+		if err != nil || toMark > 5 {
+			return ret, fmt.Errorf("invalid toMark: %s", toMarkRaw)
+		}
+		filters = append(filters, filterUserVisitToMark(uint8(toMark)))
+	}
+
 	ret.filter = func(v models.UserVisit) bool {
 		for _, i := range filters {
 			if !i(v) {
@@ -91,9 +167,27 @@ func searchUserVisitToDate(t int) UserVisitFilter {
 	}
 }
 
-func filterUserVisitCountry(country string) UserVisitFilter {
+func filterUserVisitCountries(countries map[string]bool) UserVisitFilter {
+	return func(v models.UserVisit) bool {
+		return countries[v.Country]
+	}
+}
+
+func filterUserVisitCity(city string) UserVisitFilter {
+	return func(v models.UserVisit) bool {
+		return v.City == city
+	}
+}
+
+func filterUserVisitPlacePrefix(prefix string) UserVisitFilter {
 	return func(v models.UserVisit) bool {
-		return v.Country == country
+		return strings.HasPrefix(v.Place, prefix)
+	}
+}
+
+func filterUserVisitFromDistance(t uint32) UserVisitFilter {
+	return func(v models.UserVisit) bool {
+		return v.Distance > t
 	}
 }
 
@@ -102,3 +196,110 @@ func filterUserVisitToDistance(t uint32) UserVisitFilter {
 		return v.Distance < t
 	}
 }
+
+func filterUserVisitFromMark(mark uint8) UserVisitFilter {
+	return func(v models.UserVisit) bool {
+		return v.Mark >= mark
+	}
+}
+
+func filterUserVisitToMark(mark uint8) UserVisitFilter {
+	return func(v models.UserVisit) bool {
+		return v.Mark <= mark
+	}
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// visitsCursor points to the last visit of the previous page. Visits are
+// ordered by (visited_at, id).
+type visitsCursor struct {
+	visitedAt int
+	visit     uint32
+}
+
+func visitsCursorOf(v models.UserVisit) visitsCursor {
+	return visitsCursor{v.VisitedAt, v.Visit}
+}
+
+// String encodes the cursor to an opaque URL-safe string
+func (c visitsCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strconv.Itoa(c.visitedAt) + "." + strconv.FormatUint(uint64(c.visit), 10)))
+}
+
+func parseVisitsCursor(b []byte) (*visitsCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(string(b))
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), ".", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidCursor
+	}
+	visitedAt, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	visit, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	return &visitsCursor{visitedAt, uint32(visit)}, nil
+}
+
+// compare returns -1, 0 or 1 if the cursor is before, at or after the visit
+func (c visitsCursor) compare(v models.UserVisit) int {
+	switch {
+	case c.visitedAt < v.VisitedAt:
+		return -1
+	case c.visitedAt > v.VisitedAt:
+		return 1
+	case c.visit < v.Visit:
+		return -1
+	case c.visit > v.Visit:
+		return 1
+	}
+	return 0
+}
+
+type UserVisitsPage struct {
+	limit  int
+	offset int
+	cursor *visitsCursor
+	desc   bool
+}
+
+// GetVisitsPage validates the paging query args
+//
+// Parameters:
+//
+//     limit - максимальное число посещений в ответе, по умолчанию без
+//             ограничения
+//     offset - пропустить столько подходящих посещений
+//     cursor - next_cursor из предыдущего ответа, продолжить после него
+//     order - asc (по умолчанию) или desc по visited_at
+//
+func GetVisitsPage(args Peeker, maxLimit int) (ret UserVisitsPage, err error) {
+
+	ret.limit, ret.offset, err = parsePage(args, maxLimit)
+	if err != nil {
+		return
+	}
+
+	if b := args.Peek("cursor"); b != nil {
+		if ret.cursor, err = parseVisitsCursor(b); err != nil {
+			return
+		}
+	}
+
+	switch string(args.Peek("order")) {
+	case "", "asc":
+	case "desc":
+		ret.desc = true
+	default:
+		return ret, errors.New("order should be asc or desc")
+	}
+
+	return
+}
@@ -0,0 +1,255 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/ei-grad/hlcup/db"
+	"github.com/ei-grad/hlcup/models"
+)
+
+type testVisitsPage struct {
+	Visits []struct {
+		VisitedAt int    `json:"visited_at"`
+		Place     string `json:"place"`
+		Mark      uint8  `json:"mark"`
+	} `json:"visits"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+// testGetVisits returns the status and the marks of the user visits, the
+// marks of the test visits are their ids - 1
+func testGetVisits(t *testing.T, app *Application, uri string) (int, []int, *string) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("GET")
+	ctx.Request.SetRequestURI(uri)
+	app.RequestHandler(&ctx)
+	status := ctx.Response.StatusCode()
+	if status != http.StatusOK {
+		return status, nil, nil
+	}
+	var page testVisitsPage
+	if err := json.Unmarshal(ctx.Response.Body(), &page); err != nil {
+		t.Fatalf("GET %s: %s: %s", uri, err, ctx.Response.Body())
+	}
+	var ids []int
+	for _, v := range page.Visits {
+		ids = append(ids, int(v.Mark)+1)
+	}
+	return status, ids, page.NextCursor
+}
+
+// testVisitsApp has user 1 with visits 1..6, visits 2, 3 and 4 are at the
+// same time and added out of order
+func testVisitsApp(t *testing.T) *Application {
+	a := NewApplication(db.NewMapStorage())
+	if err := a.db.AddUser(models.User{ID: 1, Email: "a@b.c", FirstName: "a", LastName: "b", Gender: "m"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []models.Location{
+		{ID: 1, Place: "Museum", Country: "Russia", City: "Moscow", Distance: 10},
+		{ID: 2, Place: "Park", Country: "Russia", City: "Kazan", Distance: 20},
+		{ID: 3, Place: "Mall", Country: "France", City: "Paris", Distance: 30},
+	} {
+		if err := a.db.AddLocation(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []models.Visit{
+		{ID: 4, Location: 2, VisitedAt: 20},
+		{ID: 1, Location: 1, VisitedAt: 10},
+		{ID: 6, Location: 3, VisitedAt: 40},
+		{ID: 2, Location: 1, VisitedAt: 20},
+		{ID: 5, Location: 3, VisitedAt: 30},
+		{ID: 3, Location: 2, VisitedAt: 20},
+	} {
+		v.User = 1
+		v.Mark = uint8(v.ID - 1)
+		if err := a.db.AddVisit(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+func TestUserVisitsCursor(t *testing.T) {
+
+	a := testVisitsApp(t)
+
+	for _, c := range []struct {
+		args     string
+		expected string
+		pages    int
+	}{
+		// the pages end inside the group of the visits at the same time
+		{"limit=2", "[1 2 3 4 5 6]", 3},
+		{"limit=2&order=desc", "[6 5 4 3 2 1]", 3},
+		{"limit=1", "[1 2 3 4 5 6]", 6},
+		{"limit=4&order=desc", "[6 5 4 3 2 1]", 2},
+		// the last page is full
+		{"limit=3", "[1 2 3 4 5 6]", 2},
+		{"limit=6", "[1 2 3 4 5 6]", 1},
+		{"limit=2&fromDate=10&toDate=40", "[2 3 4 5]", 2},
+		{"limit=2&order=desc&fromDate=10&toDate=40", "[5 4 3 2]", 2},
+	} {
+		var (
+			all    []int
+			cursor *string
+			pages  int
+		)
+		for {
+			uri := "/users/1/visits?" + c.args
+			if cursor != nil {
+				uri += "&cursor=" + *cursor
+			}
+			status, ids, next := testGetVisits(t, a, uri)
+			if status != http.StatusOK {
+				t.Fatalf("GET %s: %d", uri, status)
+			}
+			if len(ids) == 0 {
+				t.Fatalf("GET %s: empty page", uri)
+			}
+			all = append(all, ids...)
+			pages++
+			if next == nil {
+				break
+			}
+			if pages > 6 {
+				t.Fatalf("%s: pages don't end", c.args)
+			}
+			cursor = next
+		}
+		if fmt.Sprint(all) != c.expected || pages != c.pages {
+			t.Errorf("%s: got %v in %d pages, expected %s in %d", c.args, all, pages, c.expected, c.pages)
+		}
+	}
+}
+
+func TestUserVisitsCursorOffset(t *testing.T) {
+
+	a := testVisitsApp(t)
+
+	for _, c := range []struct {
+		args     string
+		expected string
+		last     bool
+	}{
+		{"limit=2", "[4 5]", false},
+		{"limit=2&offset=1", "[5 6]", true},
+		{"limit=2&offset=3", "[]", true},
+		{"limit=1&offset=1&order=desc", "[1]", true},
+		{"limit=1&order=desc", "[2]", false},
+	} {
+		// the cursor of the visit 3 is in the middle of the same time group
+		cursor := visitsCursor{20, 3}.String()
+		uri := "/users/1/visits?" + c.args + "&cursor=" + cursor
+		status, ids, next := testGetVisits(t, a, uri)
+		if status != http.StatusOK {
+			t.Fatalf("GET %s: %d", uri, status)
+		}
+		if fmt.Sprint(ids) != c.expected {
+			t.Errorf("%s: got %v, expected %s", c.args, ids, c.expected)
+		}
+		if (next == nil) != c.last {
+			t.Errorf("%s: next_cursor %v", c.args, next)
+		}
+	}
+}
+
+func TestUserVisitsInvalidCursor(t *testing.T) {
+
+	a := testVisitsApp(t)
+
+	enc := base64.RawURLEncoding.EncodeToString
+	for _, cursor := range []string{
+		"!!!",
+		enc([]byte("20")),
+		enc([]byte("20.")),
+		enc([]byte(".3")),
+		enc([]byte("x.3")),
+		enc([]byte("20.-3")),
+		enc([]byte("20.4294967296")),
+		enc([]byte("20.3")) + "=",
+	} {
+		uri := "/users/1/visits?limit=2&cursor=" + cursor
+		if status, _, _ := testGetVisits(t, a, uri); status != http.StatusBadRequest {
+			t.Errorf("cursor %q: %d", cursor, status)
+		}
+	}
+	for _, args := range []string{"limit=0", "limit=x", "limit=1001", "offset=-1", "order=up"} {
+		if status, _, _ := testGetVisits(t, a, "/users/1/visits?"+args); status != http.StatusBadRequest {
+			t.Errorf("%s: %d", args, status)
+		}
+	}
+}
+
+func TestUserVisitsFilter(t *testing.T) {
+
+	a := testVisitsApp(t)
+
+	for _, c := range []struct {
+		args     string
+		expected string
+	}{
+		{"", "[1 2 3 4 5 6]"},
+		{"fromDate=10", "[2 3 4 5 6]"},
+		{"toDate=30", "[1 2 3 4]"},
+		{"fromDate=10&toDate=30", "[2 3 4]"},
+		{"fromDate=40", "[]"},
+		{"toDate=10", "[]"},
+		{"country=Russia", "[1 2 3 4]"},
+		{"country=Russia&country=France", "[1 2 3 4 5 6]"},
+		{"country=Spain", "[]"},
+		{"city=Kazan", "[3 4]"},
+		{"city=Kazan&country=France", "[]"},
+		{"placePrefix=M", "[1 2 5 6]"},
+		{"placePrefix=Ma", "[5 6]"},
+		{"fromDistance=10", "[3 4 5 6]"},
+		{"toDistance=30", "[1 2 3 4]"},
+		{"fromDistance=10&toDistance=30", "[3 4]"},
+		// the marks of the test visits are their ids - 1
+		{"fromMark=2&toMark=4", "[3 4 5]"},
+		{"fromMark=5", "[6]"},
+		{"toMark=0", "[1]"},
+		{"country=Russia&toDistance=20&fromDate=10", "[2]"},
+	} {
+		uri := "/users/1/visits?" + c.args
+		status, ids, _ := testGetVisits(t, a, uri)
+		if status != http.StatusOK {
+			t.Errorf("GET %s: %d", uri, status)
+			continue
+		}
+		if fmt.Sprint(ids) != c.expected {
+			t.Errorf("%s: got %v, expected %s", c.args, ids, c.expected)
+		}
+	}
+}
+
+func TestUserVisitsInvalidFilter(t *testing.T) {
+
+	a := testVisitsApp(t)
+
+	for _, args := range []string{
+		"foo=1",
+		"fromdate=1",
+		"limits=1",
+		"country=Russia&distance=1",
+		"fromDate=x",
+		"toDate=1.5",
+		"fromDistance=-1",
+		"toDistance=x",
+		"toDistance=4294967296",
+		"fromMark=6",
+		"fromMark=-1",
+		"toMark=x",
+	} {
+		if status, _, _ := testGetVisits(t, a, "/users/1/visits?"+args); status != http.StatusBadRequest {
+			t.Errorf("%s: %d", args, status)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ei-grad/hlcup/app"
+	"github.com/ei-grad/hlcup/dataset"
+	"github.com/ei-grad/hlcup/db"
+)
+
+// configEnvPrefix prefixes the environment variables overriding the config
+// file, e.g. HLCUP_WAL_SYNC sets wal-sync
+const configEnvPrefix = "HLCUP_"
+
+// configAliases are the short flags of the config keys
+var configAliases = map[string]string{
+	"b": "bind",
+	"v": "access-log-enable",
+}
+
+// legacyEnv are the environment switches kept for compatibility
+var legacyEnv = map[string]string{
+	"RUN_TOP": "top",
+}
+
+// config is the server configuration. The keys of the config file are the
+// flag names, the nested sections are joined with "-", so
+//
+//     wal:
+//       sync: batch
+//
+// in YAML is the same as wal-sync = "batch" in TOML or -wal-sync=batch. The
+// defaults are overridden by the file, then by the environment, then by the
+// command line. The booleans could be set with yes/no and on/off too.
+type config struct {
+	Bind        string
+	Network     string
+	Listeners   int
+	Backlog     int
+	Backend     string
+	Data        string
+	DataEntity  string
+	LoadMode    string
+	Now         string
+	Rejects     string
+	RetryAfter  time.Duration
+	Heat        bool
+	RPS         bool
+	Top         bool
+	Mlockall    string
+	DeferAccept bool
+	FastOpen    bool
+	Shards      int
+	Cache       int
+	BatchMax    int
+	PageMax     int
+	SearchMax   int
+
+	WAL         string
+	WALSync     string
+	WALBatch    int
+	WALInterval time.Duration
+
+	Snapshot         string
+	SnapshotInterval time.Duration
+	PersistOnExit    bool
+	DrainTimeout     time.Duration
+
+	Admin      string
+	AdminToken string
+	Reload     bool
+
+	AccessLog       bool
+	AccessLogFile   string
+	AccessLogFormat string
+	AccessLogSample float64
+	AccessLogSlow   time.Duration
+
+	// parsed by validate
+	loadMode     dataset.Mode
+	nowMode      app.NowMode
+	now          time.Time
+	walSync      db.SyncPolicy
+	accessFormat app.AccessLogFormat
+}
+
+func defaultConfig() *config {
+	return &config{
+		Bind:            ":80",
+		Network:         "tcp4",
+		Listeners:       1,
+		Backend:         "array",
+		Data:            "/tmp/data/data.zip",
+		LoadMode:        "strict",
+		RPS:             true,
+		Mlockall:        "try",
+		DeferAccept:     true,
+		FastOpen:        true,
+		Shards:          db.DefaultShardsCount,
+		BatchMax:        app.DefaultMaxBatchSize,
+		PageMax:         app.MaxPageLimit,
+		SearchMax:       app.MaxSearchLimit,
+		WALSync:         "always",
+		WALBatch:        64,
+		WALInterval:     100 * time.Millisecond,
+		DrainTimeout:    10 * time.Second,
+		AccessLogFormat: "json",
+		AccessLogSample: 1,
+	}
+}
+
+// flags defines the flags setting the config fields
+func (c *config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Bind, "bind", c.Bind, "bind address")
+	fs.StringVar(&c.Bind, "b", c.Bind, "bind address (shorthand for -bind)")
+	fs.StringVar(&c.Network, "network", c.Network, "listener network: tcp4, tcp6, tcp (dual-stack, falls back to tcp4) or unix (bind is the socket path)")
+	fs.IntVar(&c.Listeners, "listeners", c.Listeners, "number of SO_REUSEPORT listeners (GOMAXPROCS if 0)")
+	fs.IntVar(&c.Backlog, "backlog", c.Backlog, "listen backlog size (net.core.somaxconn if 0)")
+	fs.StringVar(&c.Backend, "db", c.Backend, "storage backend: "+strings.Join(db.Backends(), ", "))
+	fs.StringVar(&c.Data, "data", c.Data, "data zip archive, directory or file (json, ndjson or csv, optionally gzipped)")
+	fs.StringVar(&c.DataEntity, "data-entity", c.DataEntity, "entity of ndjson and csv data files (detected by file names if empty)")
+	fs.StringVar(&c.Now, "now", c.Now, "reference time of the ages: unix timestamp, RFC 3339 time, wall (current time, the avg queries are not aggregated), or empty to take it from options.txt or the data file modification time")
+	fs.StringVar(&c.LoadMode, "load-mode", c.LoadMode, "bad data records handling: strict (stop loading) or lenient (skip them)")
+	fs.StringVar(&c.Rejects, "rejects", c.Rejects, "file to write the records skipped in lenient mode to (JSON lines)")
+	fs.DurationVar(&c.RetryAfter, "load-retry-after", c.RetryAfter, "answer data requests with 503 and this Retry-After while loading (disabled if 0, the mutations get 503 anyway with -wal)")
+	fs.BoolVar(&c.Heat, "heat", c.Heat, "heat GET requests on POST")
+	fs.BoolVar(&c.RPS, "rps", c.RPS, "log RPS every second")
+	fs.BoolVar(&c.Top, "top", c.Top, "run top in batch mode every 30 seconds")
+	fs.StringVar(&c.Mlockall, "mlockall", c.Mlockall, "lock the process memory: off, try (continue if not permitted) or require")
+	fs.BoolVar(&c.DeferAccept, "tcp-defer-accept", c.DeferAccept, "set TCP_DEFER_ACCEPT on the listener")
+	fs.BoolVar(&c.FastOpen, "tcp-fast-open", c.FastOpen, "set TCP_FASTOPEN on the listener")
+	fs.IntVar(&c.Shards, "shards", c.Shards, "number of shards of the entity locks, indexes and map storage")
+	fs.IntVar(&c.Cache, "cache", c.Cache, "GET response cache size in megabytes (disabled if 0)")
+	fs.IntVar(&c.BatchMax, "batch-max", c.BatchMax, "max number of operations in POST /batch")
+	fs.IntVar(&c.PageMax, "page-max", c.PageMax, "max limit of the paged responses")
+	fs.IntVar(&c.SearchMax, "search-max", c.SearchMax, "max limit of the location search")
+	fs.StringVar(&c.WAL, "wal", c.WAL, "write-ahead log file name (disabled if empty)")
+	fs.StringVar(&c.WALSync, "wal-sync", c.WALSync, "wal fsync policy: always, batch or interval")
+	fs.IntVar(&c.WALBatch, "wal-batch", c.WALBatch, "fsync wal every N records (for -wal-sync=batch)")
+	fs.DurationVar(&c.WALInterval, "wal-interval", c.WALInterval, "fsync wal interval (for -wal-sync=interval, and the partial batches of -wal-sync=batch)")
+	fs.StringVar(&c.Snapshot, "snapshot", c.Snapshot, "snapshot file name, used instead of data file if newer (disabled if empty)")
+	fs.DurationVar(&c.SnapshotInterval, "snapshot-interval", c.SnapshotInterval, "write snapshot every interval (0 to write only after loading data file)")
+	fs.BoolVar(&c.PersistOnExit, "persist-on-exit", c.PersistOnExit, "write snapshot on SIGTERM/SIGINT (requires -snapshot)")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "time to wait for in-flight requests on SIGTERM/SIGINT")
+	fs.StringVar(&c.Admin, "admin", c.Admin, "admin listener address for profiling endpoints (disabled if empty)")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "token required by admin endpoints, also serves them under /admin/ on the main port")
+	fs.BoolVar(&c.Reload, "reload", c.Reload, "allow reloading the data file with POST /reload on the admin endpoints (needs memory for two copies of the data)")
+	fs.BoolVar(&c.AccessLog, "access-log-enable", c.AccessLog, "show access log")
+	fs.BoolVar(&c.AccessLog, "v", c.AccessLog, "show access log (shorthand for -access-log-enable)")
+	fs.StringVar(&c.AccessLogFile, "access-log", c.AccessLogFile, "access log file name, reopened on SIGHUP (stderr if empty or -, enables access log)")
+	fs.StringVar(&c.AccessLogFormat, "access-log-format", c.AccessLogFormat, "access log format: json or logfmt")
+	fs.Float64Var(&c.AccessLogSample, "access-log-sample", c.AccessLogSample, "fraction of requests to write to the access log")
+	fs.DurationVar(&c.AccessLogSlow, "access-log-slow", c.AccessLogSlow, "always log requests taking at least this long (disabled if 0)")
+}
+
+// isConfigKey tells if the flag is a config key, not a shorthand or a flag
+// defined outside of config.flags
+func isConfigKey(fs *flag.FlagSet, name string) bool {
+	if _, ok := configAliases[name]; ok {
+		return false
+	}
+	switch name {
+	case "config", "print-config", "print-config-mask":
+		return false
+	}
+	return fs.Lookup(name) != nil
+}
+
+func configEnvName(key string) string {
+	return configEnvPrefix + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+}
+
+// load sets the flags which were not set in the command line from the config
+// file, if it is not empty, and from the environment. It should be called
+// after fs.Parse.
+func (c *config) load(fs *flag.FlagSet, fileName string) error {
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := configAliases[f.Name]; ok {
+			set[key] = true
+		}
+		set[f.Name] = true
+	})
+
+	setKey := func(key, value, source string) error {
+		if set[key] {
+			return nil
+		}
+		if b, ok := fs.Lookup(key).Value.(boolFlag); ok && b.IsBoolFlag() {
+			value = parseConfigBool(value)
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q for %s: %s", source, value, key, err)
+		}
+		return nil
+	}
+
+	if fileName != "" {
+		values, err := readConfigFile(fileName)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !isConfigKey(fs, key) {
+				return fmt.Errorf("%s: unknown key %q", fileName, key)
+			}
+			if err := setKey(key, values[key], fileName); err != nil {
+				return err
+			}
+		}
+	}
+
+	for env, key := range legacyEnv {
+		if _, ok := os.LookupEnv(configEnvName(key)); ok {
+			continue
+		}
+		if v := os.Getenv(env); v != "" {
+			if err := setKey(key, v, env); err != nil {
+				return err
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || !isConfigKey(fs, f.Name) {
+			return
+		}
+		env := configEnvName(f.Name)
+		if v, ok := os.LookupEnv(env); ok {
+			err = setKey(f.Name, v, env)
+		}
+	})
+
+	return err
+}
+
+// validate checks the values and parses the enums
+func (c *config) validate() error {
+
+	var err error
+
+	if c.Bind == "" {
+		return errors.New("bind address is empty")
+	}
+	switch c.Network {
+	case "tcp4", "tcp6", "tcp", "unix":
+	default:
+		return fmt.Errorf("unknown network: %q", c.Network)
+	}
+	switch c.Mlockall {
+	case "off", "try", "require":
+	default:
+		return fmt.Errorf("unknown mlockall mode: %q", c.Mlockall)
+	}
+	if !db.HasBackend(c.Backend) {
+		return fmt.Errorf("unknown storage backend: %q", c.Backend)
+	}
+	if c.loadMode, err = dataset.ParseMode(c.LoadMode); err != nil {
+		return err
+	}
+	if c.nowMode, c.now, err = app.ParseNow(c.Now); err != nil {
+		return err
+	}
+	if c.walSync, err = db.ParseSyncPolicy(c.WALSync); err != nil {
+		return err
+	}
+	if c.accessFormat, err = app.ParseAccessLogFormat(c.AccessLogFormat); err != nil {
+		return err
+	}
+
+	if c.Shards <= 0 || c.Shards > db.MaxShardsCount {
+		return fmt.Errorf("shards should be from 1 to %d, got %d", db.MaxShardsCount, c.Shards)
+	}
+	for _, i := range []struct {
+		name  string
+		value int
+	}{
+		{"batch-max", c.BatchMax},
+		{"page-max", c.PageMax},
+		{"search-max", c.SearchMax},
+		{"wal-batch", c.WALBatch},
+	} {
+		if i.value <= 0 {
+			return fmt.Errorf("%s should be positive, got %d", i.name, i.value)
+		}
+	}
+	for _, i := range []struct {
+		name  string
+		value int
+	}{
+		{"listeners", c.Listeners},
+		{"backlog", c.Backlog},
+		{"cache", c.Cache},
+	} {
+		if i.value < 0 {
+			return fmt.Errorf("%s should not be negative, got %d", i.name, i.value)
+		}
+	}
+	for _, i := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"load-retry-after", c.RetryAfter},
+		{"snapshot-interval", c.SnapshotInterval},
+		{"drain-timeout", c.DrainTimeout},
+		{"access-log-slow", c.AccessLogSlow},
+	} {
+		if i.value < 0 {
+			return fmt.Errorf("%s should not be negative, got %s", i.name, i.value)
+		}
+	}
+	if c.walSync == db.SyncInterval && c.WALInterval <= 0 {
+		return fmt.Errorf("wal-interval should be positive, got %s", c.WALInterval)
+	}
+	if c.AccessLogSample < 0 || c.AccessLogSample > 1 {
+		return fmt.Errorf("access-log-sample should be from 0 to 1, got %v", c.AccessLogSample)
+	}
+
+	if c.PersistOnExit && c.Snapshot == "" {
+		return errors.New("persist-on-exit requires snapshot")
+	}
+	if c.Reload && c.Admin == "" && c.AdminToken == "" {
+		return errors.New("reload requires admin or admin-token")
+	}
+
+	return nil
+}
+
+func (c *config) nowState() string {
+	switch c.nowMode {
+	case app.NowFixed:
+		return c.now.Format(time.RFC3339)
+	case app.NowWallClock:
+		return "wall clock"
+	}
+	return "from the data"
+}
+
+// print writes the effective config as JSON, which could be used as the
+// config file. The admin token is masked if mask is set, the output can't be
+// used as the config then.
+func (c *config) print(w io.Writer, fs *flag.FlagSet, mask bool) error {
+	values := map[string]interface{}{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !isConfigKey(fs, f.Name) {
+			return
+		}
+		v := f.Value.(flag.Getter).Get()
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		values[f.Name] = v
+	})
+	if mask && c.AdminToken != "" {
+		values["admin-token"] = "********"
+	}
+	b, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
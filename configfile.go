@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readConfigFile reads the JSON, YAML or TOML config file by its extension,
+// the nested keys are joined with "-". All config keys are scalars, so YAML
+// and TOML are parsed by the subset parsers below, which support only the
+// scalar values, the comments and the nested sections (YAML indented keys,
+// TOML [section] headers). The lists, inline tables, multi-line strings,
+// anchors and tags are rejected.
+func readConfigFile(fileName string) (map[string]string, error) {
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]string
+	switch ext := strings.ToLower(filepath.Ext(fileName)); ext {
+	case ".json":
+		values, err = parseJSONConfig(b)
+	case ".yaml", ".yml":
+		values, err = parseYAMLConfig(b)
+	case ".toml":
+		values, err = parseTOMLConfig(b)
+	default:
+		return nil, fmt.Errorf("%s: unknown config format %q, expected .json, .yaml or .toml", fileName, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+
+	return values, nil
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "-" + key
+}
+
+func parseJSONConfig(b []byte) (map[string]string, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var m map[string]interface{}
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	return values, flattenJSON(values, "", m)
+}
+
+func flattenJSON(values map[string]string, prefix string, m map[string]interface{}) error {
+	for k, v := range m {
+		key := joinKey(prefix, k)
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := flattenJSON(values, key, v); err != nil {
+				return err
+			}
+		case string:
+			values[key] = v
+		case json.Number:
+			values[key] = v.String()
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("%s: unsupported value %v", key, v)
+		}
+	}
+	return nil
+}
+
+// parseYAMLConfig parses the "key: value" lines, a key without the value
+// starts the section of the more indented keys
+func parseYAMLConfig(b []byte) (map[string]string, error) {
+
+	type section struct {
+		indent int
+		key    string
+	}
+
+	var (
+		values   = map[string]string{}
+		sections []section
+		s        = bufio.NewScanner(bytes.NewReader(b))
+		n        int
+	)
+
+	for s.Scan() {
+		n++
+		line := strings.TrimRight(s.Text(), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || trimmed[0] == '#' || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", n)
+		}
+		indent := len(line) - len(trimmed)
+
+		for len(sections) > 0 && sections[len(sections)-1].indent >= indent {
+			sections = sections[:len(sections)-1]
+		}
+		prefix := ""
+		if len(sections) > 0 {
+			prefix = sections[len(sections)-1].key
+		}
+
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("line %d: lists are not supported", n)
+		}
+		i := strings.Index(trimmed, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", n)
+		}
+		key := joinKey(prefix, strings.TrimSpace(trimmed[:i]))
+		raw := strings.TrimSpace(trimmed[i+1:])
+
+		if raw == "" {
+			sections = append(sections, section{indent, key})
+			continue
+		}
+		if strings.IndexByte("|>&*!", raw[0]) >= 0 {
+			return nil, fmt.Errorf("line %d: block scalars, anchors and tags are not supported", n)
+		}
+
+		v, err := parseConfigValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		values[key] = v
+	}
+
+	return values, s.Err()
+}
+
+// parseTOMLConfig parses the "key = value" lines and the [section] headers
+func parseTOMLConfig(b []byte) (map[string]string, error) {
+
+	var (
+		values = map[string]string{}
+		prefix string
+		s      = bufio.NewScanner(bytes.NewReader(b))
+		n      int
+	)
+
+	for s.Scan() {
+		n++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if i := strings.Index(line, "#"); i > 0 {
+				line = strings.TrimSpace(line[:i])
+			}
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid section header", n)
+			}
+			prefix = strings.Replace(strings.TrimSpace(line[1:len(line)-1]), ".", "-", -1)
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := joinKey(prefix, strings.Trim(strings.TrimSpace(line[:i]), `"`))
+
+		v, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		values[key] = v
+	}
+
+	return values, s.Err()
+}
+
+// parseConfigValue unquotes the string or strips the comment after the
+// unquoted value
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", fmt.Errorf("value is empty")
+	case raw[0] == '"':
+		i := closingQuote(raw)
+		if i < 0 {
+			return "", fmt.Errorf("unterminated string %s", raw)
+		}
+		if err := checkTrailer(raw[i+1:]); err != nil {
+			return "", err
+		}
+		return strconv.Unquote(raw[:i+1])
+	case raw[0] == '\'':
+		i := strings.Index(raw[1:], "'")
+		if i < 0 {
+			return "", fmt.Errorf("unterminated string %s", raw)
+		}
+		if err := checkTrailer(raw[i+2:]); err != nil {
+			return "", err
+		}
+		return raw[1 : i+1], nil
+	case raw[0] == '[' || raw[0] == '{':
+		return "", fmt.Errorf("lists and inline tables are not supported")
+	}
+	if i := strings.Index(raw, " #"); i >= 0 {
+		raw = strings.TrimSpace(raw[:i])
+	}
+	return raw, nil
+}
+
+type boolFlag interface {
+	IsBoolFlag() bool
+}
+
+// parseConfigBool converts the YAML 1.1 yes/no and on/off booleans for the
+// boolean flags, other values are returned as is
+func parseConfigBool(v string) string {
+	switch strings.ToLower(v) {
+	case "yes", "y", "on":
+		return "true"
+	case "no", "n", "off":
+		return "false"
+	}
+	return v
+}
+
+// closingQuote returns the index of the quote closing the double-quoted
+// string
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func checkTrailer(s string) error {
+	s = strings.TrimSpace(s)
+	if s != "" && s[0] != '#' {
+		return fmt.Errorf("unexpected %q after the string", s)
+	}
+	return nil
+}
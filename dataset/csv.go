@@ -0,0 +1,118 @@
+package dataset
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+// csvField sets the entity field from the CSV value
+type csvField func(v Entity, s string) error
+
+func parseUint(s string, bits int) (uint64, error) {
+	return strconv.ParseUint(s, 10, bits)
+}
+
+var csvFields = map[string]map[string]csvField{
+	Users: {
+		"id": func(v Entity, s string) (err error) {
+			n, err := parseUint(s, 32)
+			v.(*models.User).ID = uint32(n)
+			return
+		},
+		"email": func(v Entity, s string) error {
+			v.(*models.User).Email = s
+			return nil
+		},
+		"first_name": func(v Entity, s string) error {
+			v.(*models.User).FirstName = s
+			return nil
+		},
+		"last_name": func(v Entity, s string) error {
+			v.(*models.User).LastName = s
+			return nil
+		},
+		"gender": func(v Entity, s string) error {
+			v.(*models.User).Gender = s
+			return nil
+		},
+		"birth_date": func(v Entity, s string) (err error) {
+			v.(*models.User).BirthDate, err = strconv.ParseInt(s, 10, 64)
+			return
+		},
+	},
+	Locations: {
+		"id": func(v Entity, s string) (err error) {
+			n, err := parseUint(s, 32)
+			v.(*models.Location).ID = uint32(n)
+			return
+		},
+		"distance": func(v Entity, s string) (err error) {
+			n, err := parseUint(s, 32)
+			v.(*models.Location).Distance = uint32(n)
+			return
+		},
+		"place": func(v Entity, s string) error {
+			v.(*models.Location).Place = s
+			return nil
+		},
+		"country": func(v Entity, s string) error {
+			v.(*models.Location).Country = s
+			return nil
+		},
+		"city": func(v Entity, s string) error {
+			v.(*models.Location).City = s
+			return nil
+		},
+	},
+	Visits: {
+		"id": func(v Entity, s string) (err error) {
+			n, err := parseUint(s, 32)
+			v.(*models.Visit).ID = uint32(n)
+			return
+		},
+		"location": func(v Entity, s string) (err error) {
+			n, err := parseUint(s, 32)
+			v.(*models.Visit).Location = uint32(n)
+			return
+		},
+		"user": func(v Entity, s string) (err error) {
+			n, err := parseUint(s, 32)
+			v.(*models.Visit).User = uint32(n)
+			return
+		},
+		"visited_at": func(v Entity, s string) (err error) {
+			v.(*models.Visit).VisitedAt, err = strconv.Atoi(s)
+			return
+		},
+		"mark": func(v Entity, s string) (err error) {
+			n, err := parseUint(s, 8)
+			v.(*models.Visit).Mark = uint8(n)
+			return
+		},
+	},
+}
+
+// csvDecoder returns a function to fill the entity from the CSV row with
+// the columns named by the header
+func csvDecoder(entity string, header []string) (func(row []string, v Entity) error, error) {
+
+	fields := make([]csvField, len(header))
+	for n, i := range header {
+		f, ok := csvFields[entity][i]
+		if !ok {
+			return nil, fmt.Errorf("unknown %s column: %q", entity, i)
+		}
+		fields[n] = f
+	}
+
+	return func(row []string, v Entity) error {
+		for n, f := range fields {
+			if err := f(v, row[n]); err != nil {
+				return fmt.Errorf("invalid %s: %s", header[n], err)
+			}
+		}
+		return nil
+	}, nil
+}
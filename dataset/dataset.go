@@ -0,0 +1,274 @@
+// Package dataset reads the initial data for the DB.
+//
+// The data is a zip archive, a directory or a single file. Supported file
+// formats are detected by the file name extension:
+//
+//     .json   - {"users": [...]} layout of the data.zip, the entity is given
+//               by the top-level key
+//     .ndjson - one JSON entity per line, .jsonl is the same
+//     .csv    - entity fields named by the header row
+//
+// Any of them could be gzip-compressed with .gz suffix. The entity of NDJSON
+// and CSV files is detected by the file name prefix (users, locations or
+// visits), or set explicitly for all of them.
+//
+// The first line of options.txt, if it is present, is the reference time of
+// the data in unix seconds. The ages are counted from it.
+package dataset
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Users     = "users"
+	Locations = "locations"
+	Visits    = "visits"
+)
+
+// OptionsFile is the name of the file with the reference time of the data
+const OptionsFile = "options.txt"
+
+// Format of the data file
+type Format int
+
+const (
+	JSON Format = iota
+	NDJSON
+	CSV
+)
+
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "json"
+	case NDJSON:
+		return "ndjson"
+	case CSV:
+		return "csv"
+	}
+	return "unknown"
+}
+
+// Stage returns the loading stage of the entity. Users and locations are
+// loaded on the first stage, visits reference them and are loaded on the
+// second one.
+func Stage(entity string) int {
+	if entity == Visits {
+		return 2
+	}
+	return 1
+}
+
+// File is a data file of the dataset
+type File struct {
+	Name    string
+	Format  Format
+	Gzip    bool
+	ModTime time.Time
+
+	// Entity is empty for JSON files
+	Entity string
+
+	open func() (io.ReadCloser, error)
+}
+
+// Dataset is a set of data files
+type Dataset struct {
+	Files  []*File
+	closer io.Closer
+
+	// now is the time from options.txt
+	now time.Time
+}
+
+// Open opens the zip archive, the directory or the single data file. Files
+// with unknown extensions are skipped.
+func Open(path, entity string) (*Dataset, error) {
+
+	switch entity {
+	case "", Users, Locations, Visits:
+	default:
+		return nil, fmt.Errorf("dataset: unknown entity: %q", entity)
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dataset{}
+
+	switch {
+	case st.IsDir():
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range infos {
+			if i.IsDir() {
+				continue
+			}
+			if err := d.add(i.Name(), i.ModTime(), entity, openFile(filepath.Join(path, i.Name()))); err != nil {
+				return nil, err
+			}
+		}
+	case strings.HasSuffix(path, ".zip"):
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		d.closer = r
+		for _, f := range r.File {
+			if err := d.add(f.Name, f.ModTime(), entity, f.Open); err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+	default:
+		if err := d.add(filepath.Base(path), st.ModTime(), entity, openFile(path)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(d.Files) == 0 {
+		d.Close()
+		return nil, fmt.Errorf("dataset: %s: no data files", path)
+	}
+
+	return d, nil
+}
+
+func openFile(path string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+func (d *Dataset) add(name string, modTime time.Time, entity string, open func() (io.ReadCloser, error)) error {
+
+	base := filepath.Base(name)
+	if base == OptionsFile {
+		return d.readOptions(name, open)
+	}
+
+	f := &File{Name: name, ModTime: modTime, open: open}
+
+	if strings.HasSuffix(base, ".gz") {
+		f.Gzip = true
+		base = strings.TrimSuffix(base, ".gz")
+	}
+
+	ext := filepath.Ext(base)
+	switch ext {
+	case ".json":
+		f.Format = JSON
+	case ".ndjson", ".jsonl":
+		f.Format = NDJSON
+	case ".csv":
+		f.Format = CSV
+	default:
+		return nil
+	}
+
+	if f.Format != JSON {
+		f.Entity = entity
+		if f.Entity == "" {
+			base = strings.TrimSuffix(base, ext)
+			for _, i := range []string{Users, Locations, Visits} {
+				if strings.HasPrefix(base, i) {
+					f.Entity = i
+					break
+				}
+			}
+		}
+		if f.Entity == "" {
+			return fmt.Errorf("dataset: %s: can't detect the entity by the file name", name)
+		}
+	}
+
+	d.Files = append(d.Files, f)
+
+	return nil
+}
+
+// readOptions takes the reference time from the first line of options.txt
+func (d *Dataset) readOptions(name string, open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	s := bufio.NewScanner(io.LimitReader(r, 4096))
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return fmt.Errorf("dataset: %s: %s", name, err)
+		}
+		return fmt.Errorf("dataset: %s: is empty", name)
+	}
+	ts, err := strconv.ParseInt(strings.TrimSpace(s.Text()), 10, 64)
+	if err != nil {
+		return fmt.Errorf("dataset: %s: invalid timestamp: %s", name, err)
+	}
+	d.now = time.Unix(ts, 0).UTC()
+	return nil
+}
+
+// ModTime returns the modification time of the first data file
+func (d *Dataset) ModTime() time.Time {
+	return d.Files[0].ModTime
+}
+
+// Now returns the reference time of the data and where it is taken from:
+// the timestamp from options.txt, or the modification time of the first
+// data file
+func (d *Dataset) Now() (time.Time, string) {
+	if !d.now.IsZero() {
+		return d.now, OptionsFile
+	}
+	return d.ModTime(), "modtime of " + d.Files[0].Name
+}
+
+func (d *Dataset) Close() error {
+	if d.closer != nil {
+		return d.closer.Close()
+	}
+	return nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	rc io.ReadCloser
+}
+
+func (r gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.rc.Close()
+}
+
+// Open opens the file for reading, decompressing it if needed
+func (f *File) Open() (io.ReadCloser, error) {
+	rc, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	if !f.Gzip {
+		return rc, nil
+	}
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return gzipReadCloser{gz, rc}, nil
+}
@@ -0,0 +1,233 @@
+package dataset
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const (
+	testUsersNDJSON = `{"id":1,"email":"a@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}
+
+{"id":2,"email":"b@b.c","first_name":"a","last_name":"b","gender":"f","birth_date":0}
+`
+	testLocationsCSV = "id,place,country,city,distance\n1,place,country,\"city, town\",10\n"
+	testVisitsCSV    = "user,location,id,visited_at,mark\n1,1,1,100,5\n2,1,2,200,4\n"
+	testJSON         = `{"users": [{"id":3,"email":"c@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}]}`
+)
+
+func gzipped(s string) string {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(s))
+	w.Close()
+	return b.String()
+}
+
+func writeTestDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "dataset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func writeTestZip(t *testing.T, dir string, files map[string]string) string {
+	path := filepath.Join(dir, "data.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, data := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readAll returns the records of both stages as "entity id" strings sorted
+func readAll(t *testing.T, d *Dataset) []string {
+	var ret []string
+	for stage := 1; stage <= 2; stage++ {
+		for _, f := range d.Files {
+			err := f.Read(stage, func(r Record) error {
+				if Stage(r.Entity) != stage {
+					t.Errorf("%s: %s is read on stage %d", f.Name, r.Entity, stage)
+				}
+				ret = append(ret, fmt.Sprintf("%s %d", r.Entity, r.Value.GetID()))
+				return nil
+			}, func(e *Error) error {
+				t.Errorf("%s", e)
+				return e
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestOpen(t *testing.T) {
+
+	files := map[string]string{
+		"users_1.ndjson":       testUsersNDJSON,
+		"locations.csv.gz":     gzipped(testLocationsCSV),
+		"visits-part.csv":      testVisitsCSV,
+		"data_3.json":          testJSON,
+		"README.md":            "skipped",
+		OptionsFile:            "1503695452\n",
+		"users.extra.jsonl.gz": gzipped(`{"id":4,"email":"d@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}`),
+	}
+	expected := "[locations 1 users 1 users 2 users 3 users 4 visits 1 visits 2]"
+
+	dir := writeTestDir(t, files)
+	defer os.RemoveAll(dir)
+
+	zipDir, err := ioutil.TempDir("", "dataset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(zipDir)
+
+	for _, path := range []string{dir, writeTestZip(t, zipDir, files)} {
+		d, err := Open(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(d.Files) != 5 {
+			t.Errorf("%s: %d files", path, len(d.Files))
+		}
+		for _, f := range d.Files {
+			var format Format
+			switch {
+			case strings.Contains(f.Name, ".csv"):
+				format = CSV
+			case strings.Contains(f.Name, ".ndjson"), strings.Contains(f.Name, ".jsonl"):
+				format = NDJSON
+			}
+			if f.Format != format || f.Gzip != strings.HasSuffix(f.Name, ".gz") {
+				t.Errorf("%s: format %s, gzip %v", f.Name, f.Format, f.Gzip)
+			}
+		}
+		if got := fmt.Sprint(readAll(t, d)); got != expected {
+			t.Errorf("%s: got %s, expected %s", path, got, expected)
+		}
+		if now, source := d.Now(); now.Unix() != 1503695452 || source != OptionsFile {
+			t.Errorf("%s: now %s from %s", path, now, source)
+		}
+		d.Close()
+	}
+
+	// the single file
+	d, err := Open(filepath.Join(dir, "users_1.ndjson"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if got := fmt.Sprint(readAll(t, d)); got != "[users 1 users 2]" {
+		t.Errorf("got %s", got)
+	}
+	// the reference time is the modification time without options.txt
+	st, _ := os.Stat(filepath.Join(dir, "users_1.ndjson"))
+	if now, source := d.Now(); !now.Equal(st.ModTime()) || source != "modtime of users_1.ndjson" {
+		t.Errorf("now %s from %s", now, source)
+	}
+}
+
+func TestOpenEntity(t *testing.T) {
+
+	for _, c := range []struct {
+		name, entity string
+		// expected entity, empty if Open fails
+		expected string
+	}{
+		{"users.ndjson", "", Users},
+		{"locations_001.csv", "", Locations},
+		{"visits.jsonl.gz", "", Visits},
+		{"visits.ndjson", Users, Users},
+		{"data.ndjson", Locations, Locations},
+		{"data.ndjson", "", ""},
+		{"user.csv", "", ""},
+		{"my_users.csv", "", ""},
+		{"users.ndjson", "others", ""},
+	} {
+		dir := writeTestDir(t, map[string]string{c.name: ""})
+		d, err := Open(filepath.Join(dir, c.name), c.entity)
+		os.RemoveAll(dir)
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("%s, entity %q: no error", c.name, c.entity)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s, entity %q: %s", c.name, c.entity, err)
+			continue
+		}
+		if e := d.Files[0].Entity; e != c.expected {
+			t.Errorf("%s, entity %q: got %s, expected %s", c.name, c.entity, e, c.expected)
+		}
+	}
+
+	// only the unknown extensions
+	dir := writeTestDir(t, map[string]string{"users.txt": "", "users.xml": ""})
+	defer os.RemoveAll(dir)
+	if _, err := Open(dir, ""); err == nil || !strings.Contains(err.Error(), "no data files") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+
+	for _, c := range []struct {
+		options string
+		// expected timestamp, 0 if Open fails
+		ts int64
+	}{
+		{"1503695452\n", 1503695452},
+		{" 1503695452 \r\nignored\n", 1503695452},
+		{"1503695452", 1503695452},
+		{"", 0},
+		{"\n1503695452\n", 0},
+		{"2017-08-25\n", 0},
+	} {
+		dir := writeTestDir(t, map[string]string{"users.ndjson": testUsersNDJSON, OptionsFile: c.options})
+		d, err := Open(dir, "")
+		os.RemoveAll(dir)
+		if c.ts == 0 {
+			if err == nil {
+				t.Errorf("%q: no error", c.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", c.options, err)
+			continue
+		}
+		if now, source := d.Now(); now.Unix() != c.ts || source != OptionsFile {
+			t.Errorf("%q: now %s from %s", c.options, now, source)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package dataset
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mode of handling the bad records
+type Mode int
+
+const (
+	// Strict mode stops loading on the first bad record
+	Strict Mode = iota
+	// Lenient mode skips the bad records
+	Lenient
+)
+
+func (m Mode) String() string {
+	if m == Lenient {
+		return "lenient"
+	}
+	return "strict"
+}
+
+// ParseMode parses strict or lenient
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "strict":
+		return Strict, nil
+	case "lenient":
+		return Lenient, nil
+	}
+	return Strict, fmt.Errorf("dataset: unknown mode: %q", s)
+}
+
+// Error is a bad record of the data file, or a problem with the file itself
+// if Offset is NoOffset
+type Error struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Entity string `json:"entity,omitempty"`
+	ID     uint32 `json:"id,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// NoOffset is the Error offset of the errors not related to a record
+const NoOffset = -1
+
+func (e *Error) Error() string {
+	var b bytes.Buffer
+	b.WriteString(e.File)
+	if e.Offset != NoOffset {
+		fmt.Fprintf(&b, ":%d", e.Offset)
+	}
+	if e.Entity != "" {
+		fmt.Fprintf(&b, ": %s %d", e.Entity, e.ID)
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Reason)
+	return b.String()
+}
+
+// Handler is called for every bad record. If it returns nil the record is
+// skipped, otherwise the reading stops with the returned error.
+type Handler func(*Error) error
+
+// Rejects handles the bad records according to the mode. In lenient mode it
+// writes them to the rejects file as JSON lines and counts them, in strict
+// mode it remembers the first one and stops.
+type Rejects struct {
+	mode Mode
+
+	mu    sync.Mutex
+	err   error
+	f     *os.File
+	w     *bufio.Writer
+	files map[string]int
+	total int
+}
+
+// NewRejects creates the rejects handler, fileName could be empty to only
+// count the rejected records
+func NewRejects(mode Mode, fileName string) (*Rejects, error) {
+	r := &Rejects{mode: mode, files: map[string]int{}}
+	if mode == Lenient && fileName != "" {
+		f, err := os.Create(fileName)
+		if err != nil {
+			return nil, err
+		}
+		r.f = f
+		r.w = bufio.NewWriter(f)
+	}
+	return r, nil
+}
+
+// Handle is the Handler
+func (r *Rejects) Handle(e *Error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mode == Strict {
+		if r.err == nil {
+			r.err = e
+		}
+		return r.err
+	}
+	r.files[e.File]++
+	r.total++
+	if r.w != nil {
+		b, _ := json.Marshal(e)
+		r.w.Write(b)
+		r.w.WriteByte('\n')
+	}
+	return nil
+}
+
+// Err returns the error which stopped loading in strict mode
+func (r *Rejects) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Summary is the number of rejected records by file
+type Summary struct {
+	Total int
+	Files map[string]int
+}
+
+func (s Summary) String() string {
+	if s.Total == 0 {
+		return "no records rejected"
+	}
+	names := make([]string, 0, len(s.Files))
+	for i := range s.Files {
+		names = append(names, i)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for n, i := range names {
+		parts[n] = fmt.Sprintf("%s: %d", i, s.Files[i])
+	}
+	return fmt.Sprintf("%d records rejected (%s)", s.Total, strings.Join(parts, ", "))
+}
+
+// Summary returns the rejected records counts
+func (r *Rejects) Summary() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := Summary{Total: r.total, Files: make(map[string]int, len(r.files))}
+	for k, v := range r.files {
+		s.Files[k] = v
+	}
+	return s
+}
+
+// Close flushes and closes the rejects file
+func (r *Rejects) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f = nil
+	return err
+}
@@ -0,0 +1,155 @@
+package dataset
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testBadFiles have the bad records at the offsets in the comments, the
+// user 3 is rejected by the test fn
+var testBadFiles = map[string]string{
+	"users.ndjson": `{"id":1,"email":"a@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}
+{"id":2,"email":
+{"id":3,"email":"c@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}
+{"id":4,"email":"d@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":"x"}
+`, // 2, 3, 4
+	"locations.csv": "id,place,country,city,distance\n1,a,b,c,10\n2,a,b,c,-1\n3,a,b\n4,a,b,c,40\n", // 3, 4
+	"data.json":     `{"users": [{"id":5,"email":"e@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}, {"id":6}, 7, {"id":8,`, // 2, 3
+}
+
+// errDuplicate is returned by the test fn for the user 3
+var errDuplicate = errors.New("duplicate")
+
+// readWithRejects reads the stage 1 records of the test files and returns the
+// ids of the read ones
+func readWithRejects(t *testing.T, r *Rejects) (ids []uint32) {
+	dir := writeTestDir(t, testBadFiles)
+	defer os.RemoveAll(dir)
+	d, err := Open(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, f := range d.Files {
+		f.Read(1, func(rec Record) error {
+			if err := r.Err(); err != nil {
+				return err
+			}
+			if rec.Value.GetID() == 3 {
+				return errDuplicate
+			}
+			ids = append(ids, rec.Value.GetID())
+			return nil
+		}, r.Handle)
+	}
+	return
+}
+
+func TestRejectsStrict(t *testing.T) {
+
+	r, err := NewRejects(Strict, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// the files are read in the name order: data.json, locations.csv,
+	// users.ndjson
+	ids := readWithRejects(t, r)
+	if fmt.Sprint(ids) != "[5 6]" {
+		t.Errorf("read %v", ids)
+	}
+
+	e, ok := r.Err().(*Error)
+	if !ok {
+		t.Fatalf("got %#v", r.Err())
+	}
+	if e.File != "data.json" || e.Offset != 2 || e.Entity != "" {
+		t.Errorf("got %s", e)
+	}
+	// the next errors don't replace the first one
+	if err := r.Handle(&Error{File: "other", Offset: NoOffset, Reason: "x"}); err != e {
+		t.Errorf("got %v", err)
+	}
+	if s := r.Summary(); s.Total != 0 {
+		t.Errorf("%+v", s)
+	}
+}
+
+func TestRejectsLenient(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rejects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rejectsFile := filepath.Join(dir, "rejects.jsonl")
+
+	r, err := NewRejects(Lenient, rejectsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := readWithRejects(t, r)
+	if fmt.Sprint(ids) != "[5 6 1 4 1]" {
+		t.Errorf("read %v", ids)
+	}
+	if r.Err() != nil {
+		t.Errorf("got %v", r.Err())
+	}
+
+	s := r.Summary()
+	if s.Total != 7 || s.Files["data.json"] != 2 || s.Files["locations.csv"] != 2 || s.Files["users.ndjson"] != 3 {
+		t.Errorf("%+v", s)
+	}
+	if expected := "7 records rejected (data.json: 2, locations.csv: 2, users.ndjson: 3)"; s.String() != expected {
+		t.Errorf("got %q, expected %q", s, expected)
+	}
+	if s := (Summary{}).String(); s != "no records rejected" {
+		t.Errorf("got %q", s)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(rejectsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		var e Error
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatalf("%s: %s", line, err)
+		}
+		got = append(got, fmt.Sprintf("%s:%d:%s:%d", e.File, e.Offset, e.Entity, e.ID))
+	}
+	// the entity and id are set if the id is decoded
+	expected := "[data.json:2::0 data.json:3::0 " +
+		"locations.csv:3:locations:2 locations.csv:4::0 " +
+		"users.ndjson:2:users:2 users.ndjson:3:users:3 users.ndjson:4:users:4]"
+	if fmt.Sprint(got) != expected {
+		t.Errorf("got %v, expected %s", got, expected)
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	for _, c := range []struct {
+		e        Error
+		expected string
+	}{
+		{Error{File: "a.csv", Offset: NoOffset, Reason: "can't read"}, "a.csv: can't read"},
+		{Error{File: "a.csv", Offset: 3, Reason: "bad"}, "a.csv:3: bad"},
+		{Error{File: "a.csv", Offset: 3, Entity: Users, ID: 7, Reason: "bad"}, "a.csv:3: users 7: bad"},
+	} {
+		if s := c.e.Error(); s != c.expected {
+			t.Errorf("got %q, expected %q", s, c.expected)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package dataset
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+// Entity is *models.User, *models.Location or *models.Visit
+type Entity interface {
+	MarshalJSON() ([]byte, error)
+	UnmarshalJSON([]byte) error
+	GetID() uint32
+}
+
+func newEntity(entity string) Entity {
+	switch entity {
+	case Users:
+		return &models.User{}
+	case Locations:
+		return &models.Location{}
+	case Visits:
+		return &models.Visit{}
+	}
+	return nil
+}
+
+// Record is an entity read from the data file
+type Record struct {
+	Entity string
+	// Offset is the line number of NDJSON records, the record number of CSV
+	// ones (the header is 1), or the index in the entity array of JSON files
+	Offset int64
+	Value  Entity
+}
+
+// Read calls fn for every record of the entities loaded on the stage.
+//
+// Records which can't be decoded and the errors returned by fn are passed to
+// onError with the record offset, the reading continues if it returns nil.
+// Errors which make the rest of the file unreadable are passed to onError
+// too, but the reading of the file stops anyway.
+func (f *File) Read(stage int, fn func(Record) error, onError Handler) error {
+
+	if f.Format != JSON && Stage(f.Entity) != stage {
+		return nil
+	}
+
+	r := &reader{File: f, fn: fn, onError: onError}
+
+	rc, err := f.Open()
+	if err != nil {
+		return r.fail(NoOffset, err)
+	}
+	defer rc.Close()
+
+	switch f.Format {
+	case JSON:
+		return r.readJSON(rc, stage)
+	case NDJSON:
+		return r.readNDJSON(rc)
+	case CSV:
+		return r.readCSV(rc)
+	}
+
+	return nil
+}
+
+type reader struct {
+	*File
+	fn      func(Record) error
+	onError Handler
+}
+
+// fail reports the error after which the file can't be read further
+func (r *reader) fail(offset int64, err error) error {
+	return r.onError(&Error{File: r.Name, Offset: offset, Reason: err.Error()})
+}
+
+// record passes the decoded record to fn, or reports the decoding error
+func (r *reader) record(entity string, offset int64, v Entity, err error) error {
+	if err == nil {
+		err = r.fn(Record{entity, offset, v})
+	} else {
+		err = fmt.Errorf("can't decode: %s", err)
+	}
+	if err == nil {
+		return nil
+	}
+	e := &Error{File: r.Name, Offset: offset, Entity: entity, Reason: err.Error()}
+	if e.ID = v.GetID(); e.ID == 0 {
+		e.Entity = ""
+	}
+	return r.onError(e)
+}
+
+func (r *reader) readJSON(rd io.Reader, stage int) error {
+
+	decoder := json.NewDecoder(bufio.NewReader(rd))
+
+	// read left_bracket token
+	token, err := decoder.Token()
+	if err != nil {
+		return r.fail(NoOffset, fmt.Errorf("invalid JSON: %s", err))
+	}
+	if t, ok := token.(json.Delim); !ok || t.String() != "{" {
+		return r.fail(NoOffset, fmt.Errorf("expected {, got %v", token))
+	}
+
+	for decoder.More() {
+
+		// read key
+		token, err = decoder.Token()
+		if err != nil {
+			return r.fail(NoOffset, fmt.Errorf("invalid JSON: %s", err))
+		}
+		key, ok := token.(string)
+		if !ok {
+			return r.fail(NoOffset, fmt.Errorf("expected string, got %v", token))
+		}
+
+		if newEntity(key) == nil {
+			return r.fail(NoOffset, fmt.Errorf("unknown section: %s", key))
+		}
+		if Stage(key) != stage {
+			// the sections are not mixed in the data.zip files
+			return nil
+		}
+
+		// read left_brace token
+		token, err = decoder.Token()
+		if err != nil {
+			return r.fail(NoOffset, fmt.Errorf("invalid JSON: %s", err))
+		}
+		if t, ok := token.(json.Delim); !ok || t.String() != "[" {
+			return r.fail(NoOffset, fmt.Errorf("expected [, got %v", token))
+		}
+
+		var offset int64
+		for ; decoder.More(); offset++ {
+			// the syntax errors break the decoder, but the valid JSON
+			// values which are not valid entities could be skipped
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err != nil {
+				return r.fail(offset, fmt.Errorf("invalid JSON: %s", err))
+			}
+			v := newEntity(key)
+			if err := r.record(key, offset, v, v.UnmarshalJSON(raw)); err != nil {
+				return err
+			}
+		}
+
+		// read right_brace token
+		if _, err := decoder.Token(); err != nil {
+			return r.fail(offset, fmt.Errorf("invalid JSON: %s", err))
+		}
+	}
+
+	return nil
+}
+
+func (r *reader) readNDJSON(rd io.Reader) error {
+
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(nil, 1<<24)
+
+	var line int64
+	for scanner.Scan() {
+		line++
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		v := newEntity(r.Entity)
+		if err := r.record(r.Entity, line, v, v.UnmarshalJSON(b)); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return r.fail(line+1, err)
+	}
+
+	return nil
+}
+
+func (r *reader) readCSV(rd io.Reader) error {
+
+	reader := csv.NewReader(bufio.NewReader(rd))
+
+	header, err := reader.Read()
+	if err != nil {
+		return r.fail(NoOffset, fmt.Errorf("can't read the header: %s", err))
+	}
+	decode, err := csvDecoder(r.Entity, header)
+	if err != nil {
+		return r.fail(NoOffset, err)
+	}
+
+	line := int64(1)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		line++
+		if _, ok := err.(*csv.ParseError); err != nil && !ok {
+			return r.fail(line, err)
+		}
+		v := newEntity(r.Entity)
+		if err == nil {
+			err = decode(row, v)
+		}
+		if err := r.record(r.Entity, line, v, err); err != nil {
+			return err
+		}
+	}
+}
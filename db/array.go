@@ -1,27 +1,17 @@
 package db
 
 import (
-	"errors"
-
 	"github.com/ei-grad/hlcup/models"
 )
 
-const Version = "array"
-
-const (
-	MaxUsers           = 1500000
-	MaxLocations       = 1100000
-	MaxVisits          = 15000000
-	DefaultShardsCount = 509
-)
+// ArrayStorage keeps entities in segmented arrays indexed by ID
+type ArrayStorage struct {
+	users     userArray
+	locations locationArray
+	visits    visitArray
 
-type DB struct {
-	users     []models.User
-	locations []models.Location
-	visits    []models.Visit
-
-	locationMarks []*models.LocationMarks
-	userVisits    []*models.UserVisits
+	locationMarks locationMarksArray
+	userVisits    userVisitsArray
 
 	lockU *ShardedLock
 	lockL *ShardedLock
@@ -31,90 +21,153 @@ type DB struct {
 	lockUV *ShardedLock
 }
 
-func New() *DB {
-
-	db := new(DB)
+func NewArrayStorage() *ArrayStorage {
 
-	db.users = make([]models.User, MaxUsers)
-	db.locations = make([]models.Location, MaxLocations)
-	db.visits = make([]models.Visit, MaxVisits)
+	s := new(ArrayStorage)
 
-	db.locationMarks = make([]*models.LocationMarks, MaxLocations)
-	db.userVisits = make([]*models.UserVisits, MaxUsers)
+	s.lockU = NewShardedLock(shardsCount)
+	s.lockL = NewShardedLock(shardsCount)
+	s.lockV = NewShardedLock(shardsCount)
+	s.lockLM = NewShardedLock(shardsCount)
+	s.lockUV = NewShardedLock(shardsCount)
 
-	db.lockU = NewShardedLock(DefaultShardsCount)
-	db.lockL = NewShardedLock(DefaultShardsCount)
-	db.lockV = NewShardedLock(DefaultShardsCount)
-	db.lockLM = NewShardedLock(DefaultShardsCount)
-	db.lockUV = NewShardedLock(DefaultShardsCount)
-
-	return db
+	return s
 }
 
-var ErrAlreadyExists = errors.New("already exists")
-
-func (db *DB) GetUser(id uint32) models.User {
-	if id >= MaxUsers {
-		return models.User{}
+func (s *ArrayStorage) GetUser(id uint32) models.User {
+	s.lockU.RLock(id)
+	defer s.lockU.RUnlock(id)
+	if v := s.users.get(id); v != nil {
+		return *v
 	}
-	db.lockU.RLock(id)
-	defer db.lockU.RUnlock(id)
-	return db.users[id]
+	return models.User{}
 }
 
-func (db *DB) GetLocation(id uint32) models.Location {
-	if id >= MaxLocations {
-		return models.Location{}
+func (s *ArrayStorage) GetLocation(id uint32) models.Location {
+	s.lockL.RLock(id)
+	defer s.lockL.RUnlock(id)
+	if v := s.locations.get(id); v != nil {
+		return *v
 	}
-	db.lockL.RLock(id)
-	defer db.lockL.RUnlock(id)
-	return db.locations[id]
+	return models.Location{}
 }
 
-func (db *DB) GetVisit(id uint32) models.Visit {
-	if id >= MaxVisits {
-		return models.Visit{}
+func (s *ArrayStorage) GetVisit(id uint32) models.Visit {
+	s.lockV.RLock(id)
+	defer s.lockV.RUnlock(id)
+	if v := s.visits.get(id); v != nil {
+		return *v
 	}
-	db.lockV.RLock(id)
-	defer db.lockV.RUnlock(id)
-	return db.visits[id]
+	return models.Visit{}
 }
 
-func (db *DB) AddUser(v models.User) error {
-	if err := v.Validate(); err != nil {
-		return err
-	}
-	db.lockU.Lock(v.ID)
-	if db.users[v.ID].IsValid() {
+func (s *ArrayStorage) AddUser(v models.User) error {
+	s.lockU.Lock(v.ID)
+	defer s.lockU.Unlock(v.ID)
+	p := s.users.ensure(v.ID)
+	if p.IsValid() {
 		return ErrAlreadyExists
 	}
-	db.users[v.ID] = v
-	db.lockU.Unlock(v.ID)
+	*p = v
 	return nil
 }
 
-func (db *DB) AddLocation(v models.Location) error {
-	if err := v.Validate(); err != nil {
-		return err
+func (s *ArrayStorage) AddLocation(v models.Location) error {
+	s.lockL.Lock(v.ID)
+	defer s.lockL.Unlock(v.ID)
+	p := s.locations.ensure(v.ID)
+	if p.IsValid() {
+		return ErrAlreadyExists
 	}
-	db.lockL.Lock(v.ID)
-	if db.locations[v.ID].IsValid() {
+	*p = v
+	return nil
+}
+
+func (s *ArrayStorage) AddVisit(v models.Visit) error {
+	s.lockV.Lock(v.ID)
+	defer s.lockV.Unlock(v.ID)
+	p := s.visits.ensure(v.ID)
+	if p.IsValid() {
 		return ErrAlreadyExists
 	}
-	db.locations[v.ID] = v
-	db.lockL.Unlock(v.ID)
+	*p = v
+	return nil
+}
+
+func (s *ArrayStorage) UpdateUser(v models.User) error {
+	s.lockU.Lock(v.ID)
+	*s.users.ensure(v.ID) = v
+	s.lockU.Unlock(v.ID)
+	return nil
+}
+
+func (s *ArrayStorage) UpdateLocation(v models.Location) error {
+	s.lockL.Lock(v.ID)
+	*s.locations.ensure(v.ID) = v
+	s.lockL.Unlock(v.ID)
+	return nil
+}
+
+func (s *ArrayStorage) UpdateVisit(v models.Visit) error {
+	s.lockV.Lock(v.ID)
+	*s.visits.ensure(v.ID) = v
+	s.lockV.Unlock(v.ID)
+	return nil
+}
+
+func (s *ArrayStorage) DeleteUser(id uint32) error {
+	s.lockU.Lock(id)
+	defer s.lockU.Unlock(id)
+	p := s.users.get(id)
+	if p == nil || !p.IsValid() {
+		return ErrNotFound
+	}
+	*p = models.User{}
 	return nil
 }
 
-func (db *DB) AddVisit(v models.Visit) error {
-	if err := v.Validate(); err != nil {
-		return err
+func (s *ArrayStorage) DeleteLocation(id uint32) error {
+	s.lockL.Lock(id)
+	defer s.lockL.Unlock(id)
+	p := s.locations.get(id)
+	if p == nil || !p.IsValid() {
+		return ErrNotFound
 	}
-	db.lockV.Lock(v.ID)
-	if db.visits[v.ID].IsValid() {
-		return ErrAlreadyExists
+	*p = models.Location{}
+	return nil
+}
+
+func (s *ArrayStorage) DeleteVisit(id uint32) error {
+	s.lockV.Lock(id)
+	defer s.lockV.Unlock(id)
+	p := s.visits.get(id)
+	if p == nil || !p.IsValid() {
+		return ErrNotFound
 	}
-	db.visits[v.ID] = v
-	db.lockV.Unlock(v.ID)
-	return db.AddVisitToIndex(v)
+	*p = models.Visit{}
+	return nil
+}
+
+func (s *ArrayStorage) RangeUsers(f func(models.User)) {
+	s.users.rangeIDs(func(id uint32) {
+		if v := s.GetUser(id); v.IsValid() {
+			f(v)
+		}
+	})
+}
+
+func (s *ArrayStorage) RangeLocations(f func(models.Location)) {
+	s.locations.rangeIDs(func(id uint32) {
+		if v := s.GetLocation(id); v.IsValid() {
+			f(v)
+		}
+	})
+}
+
+func (s *ArrayStorage) RangeVisits(f func(models.Visit)) {
+	s.visits.rangeIDs(func(id uint32) {
+		if v := s.GetVisit(id); v.IsValid() {
+			f(v)
+		}
+	})
 }
@@ -0,0 +1,367 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/mailru/easyjson"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+var (
+	ErrTxDone = errors.New("transaction is already committed or rolled back")
+
+	// ErrTxConflict is returned by Commit if the batch isn't valid anymore
+	// because of the mutations made since it was staged
+	ErrTxConflict = errors.New("batch conflicts with the concurrent mutations")
+)
+
+type txOp struct {
+	op byte
+	v  easyjson.Marshaler
+}
+
+// Tx is a batch of mutations applied atomically. Every mutation is validated
+// against the DB state with the previous mutations of the batch applied.
+//
+// Nothing is locked while the batch is staged. Commit locks the shards of the
+// affected entities, validates the batch again and applies it, so the readers
+// holding the shard read locks (see RLockUser) see every batch either
+// completely applied or not applied at all. The copies of the entity fields
+// in the indexes of other entities (location fields in the user visits, user
+// fields in the location marks) are updated the same way as by the single
+// updates.
+type Tx struct {
+	db  *DB
+	ops []txOp
+
+	users     map[uint32]models.User
+	locations map[uint32]models.Location
+	visits    map[uint32]models.Visit
+
+	// locked is set while Commit holds the affected shards
+	locked bool
+	done   bool
+}
+
+// Begin starts a batch
+func (db *DB) Begin() *Tx {
+	tx := &Tx{db: db}
+	tx.reset()
+	return tx
+}
+
+func (tx *Tx) reset() {
+	tx.ops = nil
+	tx.users = map[uint32]models.User{}
+	tx.locations = map[uint32]models.Location{}
+	tx.visits = map[uint32]models.Visit{}
+}
+
+func (tx *Tx) GetUser(id uint32) models.User {
+	if v, ok := tx.users[id]; ok {
+		return v
+	}
+	return tx.db.GetUser(id)
+}
+
+func (tx *Tx) GetLocation(id uint32) models.Location {
+	if v, ok := tx.locations[id]; ok {
+		return v
+	}
+	return tx.db.GetLocation(id)
+}
+
+func (tx *Tx) GetVisit(id uint32) models.Visit {
+	if v, ok := tx.visits[id]; ok {
+		return v
+	}
+	return tx.db.GetVisit(id)
+}
+
+func (tx *Tx) AddUser(v models.User) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	return tx.stage(txOp{opAddUser, &v})
+}
+
+func (tx *Tx) AddLocation(v models.Location) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	return tx.stage(txOp{opAddLocation, &v})
+}
+
+func (tx *Tx) AddVisit(v models.Visit) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	return tx.stage(txOp{opAddVisit, &v})
+}
+
+func (tx *Tx) UpdateUser(v models.User) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	return tx.stage(txOp{opUpdateUser, &v})
+}
+
+func (tx *Tx) UpdateLocation(v models.Location) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	return tx.stage(txOp{opUpdateLocation, &v})
+}
+
+func (tx *Tx) UpdateVisit(v models.Visit) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	return tx.stage(txOp{opUpdateVisit, &v})
+}
+
+// stage checks the mutation against the DB state with the previous
+// mutations of the batch applied and adds it to the batch
+func (tx *Tx) stage(i txOp) error {
+	switch v := i.v.(type) {
+	case *models.User:
+		exists := tx.GetUser(v.ID).IsValid()
+		if i.op == opAddUser && exists {
+			return ErrAlreadyExists
+		}
+		if i.op == opUpdateUser && !exists {
+			return ErrNotFound
+		}
+		if err := tx.checkEmail(*v); err != nil {
+			return err
+		}
+		tx.users[v.ID] = *v
+	case *models.Location:
+		exists := tx.GetLocation(v.ID).IsValid()
+		if i.op == opAddLocation && exists {
+			return ErrAlreadyExists
+		}
+		if i.op == opUpdateLocation && !exists {
+			return ErrNotFound
+		}
+		tx.locations[v.ID] = *v
+	case *models.Visit:
+		exists := tx.GetVisit(v.ID).IsValid()
+		if i.op == opAddVisit && exists {
+			return ErrAlreadyExists
+		}
+		if i.op == opUpdateVisit && !exists {
+			return ErrNotFound
+		}
+		if err := tx.checkVisitRefs(*v); err != nil {
+			return err
+		}
+		tx.visits[v.ID] = *v
+	default:
+		return fmt.Errorf("unknown batch op %d", i.op)
+	}
+	tx.ops = append(tx.ops, i)
+	return nil
+}
+
+// checkEmail looks for the email among the staged users first
+func (tx *Tx) checkEmail(v models.User) error {
+	if v.Email == "" {
+		return nil
+	}
+	for _, i := range tx.users {
+		if i.Email == v.Email && i.ID != v.ID {
+			return ErrEmailExists
+		}
+	}
+	var id uint32
+	if tx.locked {
+		id = tx.db.emails.get(v.Email)
+	} else {
+		id = tx.db.emails.lookup(v.Email)
+	}
+	if id != 0 && id != v.ID && tx.GetUser(id).Email == v.Email {
+		return ErrEmailExists
+	}
+	return nil
+}
+
+func (tx *Tx) checkVisitRefs(v models.Visit) error {
+	if !tx.GetLocation(v.Location).IsValid() {
+		return fmt.Errorf("location with id %d doesn't exist", v.Location)
+	}
+	if !tx.GetUser(v.User).IsValid() {
+		return fmt.Errorf("user with id %d doesn't exist", v.User)
+	}
+	return nil
+}
+
+// txShards are the entities affected by the batch
+type txShards struct {
+	users, locations, visits []uint32
+	emails                   []string
+}
+
+// shards returns the staged entities, the current owners of the updated
+// visits and the current emails of the updated users
+func (tx *Tx) shards() (ret txShards) {
+	for _, i := range tx.ops {
+		switch v := i.v.(type) {
+		case *models.User:
+			ret.users = append(ret.users, v.ID)
+			ret.emails = append(ret.emails, v.Email, tx.db.GetUser(v.ID).Email)
+		case *models.Location:
+			ret.locations = append(ret.locations, v.ID)
+		case *models.Visit:
+			old := tx.db.GetVisit(v.ID)
+			ret.users = append(ret.users, v.User, old.User)
+			ret.locations = append(ret.locations, v.Location, old.Location)
+			ret.visits = append(ret.visits, v.ID)
+		}
+	}
+	return
+}
+
+// lock locks the shards affected by the batch in the users, locations,
+// visits, emails order, the same as the single mutations do
+func (tx *Tx) lock() (unlock func()) {
+	for {
+		s := tx.shards()
+		unlockU := tx.db.lockU.lockSet(s.users)
+		unlockL := tx.db.lockL.lockSet(s.locations)
+		unlockV := tx.db.lockV.lockSet(s.visits)
+		unlockE := tx.db.emails.lockSet(s.emails)
+		unlock = func() {
+			unlockE()
+			unlockV()
+			unlockL()
+			unlockU()
+		}
+		// the owners and emails could be changed before they were locked
+		if reflect.DeepEqual(s, tx.shards()) {
+			return unlock
+		}
+		unlock()
+	}
+}
+
+// Commit writes the batch to the WAL as a single record and applies it.
+// ErrTxConflict is returned if the batch isn't valid anymore, nothing is
+// applied then.
+func (tx *Tx) Commit() error {
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	tx.db.tx.RLock()
+	defer tx.db.tx.RUnlock()
+	unlock := tx.lock()
+	defer unlock()
+
+	ops := tx.ops
+	tx.reset()
+	tx.locked = true
+	for _, i := range ops {
+		if err := tx.stage(i); err != nil {
+			return ErrTxConflict
+		}
+	}
+
+	if w, _ := tx.db.wal.Load().(*WAL); w != nil {
+		payload, err := tx.encode()
+		if err != nil {
+			return err
+		}
+		if err := w.append(opBatch, payload); err != nil {
+			return err
+		}
+	}
+
+	for _, i := range tx.ops {
+		if err := tx.db.apply(i); err != nil {
+			// validation guarantees it doesn't happen
+			return fmt.Errorf("batch is partially applied: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Rollback discards the batch
+func (tx *Tx) Rollback() {
+	tx.done = true
+}
+
+// Len returns the number of mutations in the batch
+func (tx *Tx) Len() int {
+	return len(tx.ops)
+}
+
+// apply must be called with the affected shards locked, see Tx.lock
+func (db *DB) apply(i txOp) error {
+	switch v := i.v.(type) {
+	case *models.User:
+		if i.op == opAddUser {
+			return db.addUser(*v)
+		}
+		return db.updateUser(*v)
+	case *models.Location:
+		if i.op == opAddLocation {
+			return db.addLocation(*v)
+		}
+		return db.updateLocation(*v)
+	case *models.Visit:
+		if i.op == opAddVisit {
+			return db.addVisit(*v)
+		}
+		return db.updateVisit(*v)
+	}
+	return fmt.Errorf("unknown batch op %d", i.op)
+}
+
+// Batch record payload is a sequence of op byte, uint32 length and JSON
+// encoded entity
+func (tx *Tx) encode() ([]byte, error) {
+	var ret []byte
+	var buf [5]byte
+	for _, i := range tx.ops {
+		payload, err := easyjson.Marshal(i.v)
+		if err != nil {
+			return nil, err
+		}
+		buf[0] = i.op
+		binary.LittleEndian.PutUint32(buf[1:], uint32(len(payload)))
+		ret = append(ret, buf[:]...)
+		ret = append(ret, payload...)
+	}
+	return ret, nil
+}
+
+func (db *DB) applyWALBatch(payload []byte) error {
+	for len(payload) > 0 {
+		if len(payload) < 5 {
+			return ErrWALCorrupt
+		}
+		op := payload[0]
+		n := binary.LittleEndian.Uint32(payload[1:5])
+		payload = payload[5:]
+		if uint32(len(payload)) < n || op == opBatch {
+			return ErrWALCorrupt
+		}
+		if err := db.applyWAL(op, payload[:n]); err == ErrWALCorrupt {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+func testLocation(id uint32) models.Location {
+	return models.Location{ID: id, Place: "place", Country: "country", City: "city", Distance: id}
+}
+
+// testBatchDB has users 1, 2, locations 1, 2 and visit 1 of user 1 to
+// location 1
+func testBatchDB(t *testing.T) *DB {
+	d := New(NewMapStorage())
+	for i := uint32(1); i <= 2; i++ {
+		if err := d.AddUser(testUser(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.AddLocation(testLocation(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.AddVisit(models.Visit{ID: 1, User: 1, Location: 1, VisitedAt: 1, Mark: 3}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestTxValidation(t *testing.T) {
+
+	renamed := testUser(1)
+	renamed.Email = "renamed@example.com"
+	sameEmail := testUser(3)
+	sameEmail.Email = testUser(1).Email
+
+	for _, c := range []struct {
+		name string
+		// stage returns the error of the last mutation, the previous ones
+		// must be staged without errors
+		stage func(tx *Tx) []error
+		ok    bool
+	}{
+		{"add existing user", func(tx *Tx) []error {
+			return []error{tx.AddUser(testUser(1))}
+		}, false},
+		{"add user with used email", func(tx *Tx) []error {
+			return []error{tx.AddUser(sameEmail)}
+		}, false},
+		{"add user with email freed in batch", func(tx *Tx) []error {
+			return []error{tx.UpdateUser(renamed), tx.AddUser(sameEmail)}
+		}, true},
+		{"add two users with same email", func(tx *Tx) []error {
+			u := testUser(4)
+			u.Email = testUser(3).Email
+			return []error{tx.AddUser(testUser(3)), tx.AddUser(u)}
+		}, false},
+		{"update missing user", func(tx *Tx) []error {
+			return []error{tx.UpdateUser(testUser(3))}
+		}, false},
+		{"update invalid user", func(tx *Tx) []error {
+			u := testUser(1)
+			u.Gender = "x"
+			return []error{tx.UpdateUser(u)}
+		}, false},
+		{"update location added in batch", func(tx *Tx) []error {
+			l := testLocation(3)
+			l.City = "town"
+			return []error{tx.AddLocation(testLocation(3)), tx.UpdateLocation(l)}
+		}, true},
+		{"update missing location", func(tx *Tx) []error {
+			return []error{tx.UpdateLocation(testLocation(3))}
+		}, false},
+		{"add visit of user added in batch", func(tx *Tx) []error {
+			return []error{
+				tx.AddUser(testUser(3)),
+				tx.AddVisit(models.Visit{ID: 2, User: 3, Location: 1, VisitedAt: 1, Mark: 1}),
+			}
+		}, true},
+		{"add visit to missing location", func(tx *Tx) []error {
+			return []error{tx.AddVisit(models.Visit{ID: 2, User: 1, Location: 3, VisitedAt: 1, Mark: 1})}
+		}, false},
+		{"move visit to missing user", func(tx *Tx) []error {
+			return []error{tx.UpdateVisit(models.Visit{ID: 1, User: 3, Location: 1, VisitedAt: 1, Mark: 1})}
+		}, false},
+		{"update missing visit", func(tx *Tx) []error {
+			return []error{tx.UpdateVisit(models.Visit{ID: 2, User: 1, Location: 1, VisitedAt: 1, Mark: 1})}
+		}, false},
+	} {
+		d := testBatchDB(t)
+		stats := d.Stats()
+		tx := d.Begin()
+		errs := c.stage(tx)
+		for n, err := range errs[:len(errs)-1] {
+			if err != nil {
+				t.Fatalf("%s: mutation %d: %s", c.name, n, err)
+			}
+		}
+		if err := errs[len(errs)-1]; (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+		if c.ok {
+			if err := tx.Commit(); err != nil {
+				t.Errorf("%s: commit: %s", c.name, err)
+			}
+		} else {
+			tx.Rollback()
+			if d.Stats() != stats {
+				t.Errorf("%s: DB is modified: %+v, expected %+v", c.name, d.Stats(), stats)
+			}
+		}
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+
+	d := testBatchDB(t)
+	stats := d.Stats()
+
+	tx := d.Begin()
+	if err := tx.AddUser(testUser(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.AddVisit(models.Visit{ID: 2, User: 3, Location: 1, VisitedAt: 1, Mark: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.AddVisit(models.Visit{ID: 3, User: 3, Location: 3, VisitedAt: 1, Mark: 1}); err == nil {
+		t.Fatal("visit to missing location is staged")
+	}
+	tx.Rollback()
+
+	if d.Stats() != stats || d.GetUser(3).IsValid() || d.GetVisit(2).IsValid() {
+		t.Fatalf("rolled back batch is applied: %+v", d.Stats())
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Fatalf("commit after rollback: %v", err)
+	}
+}
+
+func TestTxConflict(t *testing.T) {
+
+	path, _ := writeTestWAL(t, 0)
+	defer os.RemoveAll(filepath.Dir(path))
+	d, w, _, _ := replayTestWAL(t, path, 0)
+	d.SetWAL(w)
+	defer d.CloseWAL()
+
+	tx := d.Begin()
+	if err := tx.AddLocation(testLocation(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.AddUser(testUser(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the user is added after the batch is staged
+	if err := d.AddUser(testUser(1)); err != nil {
+		t.Fatal(err)
+	}
+	lsn := w.LSN()
+
+	if err := tx.Commit(); err != ErrTxConflict {
+		t.Fatalf("commit: %v", err)
+	}
+	if d.GetLocation(1).IsValid() {
+		t.Fatal("conflicting batch is partially applied")
+	}
+	if w.LSN() != lsn {
+		t.Fatalf("conflicting batch is logged, lsn %d, expected %d", w.LSN(), lsn)
+	}
+}
+
+func TestWALBatchReplay(t *testing.T) {
+
+	path, _ := writeTestWAL(t, 2)
+	defer os.RemoveAll(filepath.Dir(path))
+	d, w, _, _ := replayTestWAL(t, path, 0)
+	d.SetWAL(w)
+
+	tx := d.Begin()
+	for _, err := range []error{
+		tx.AddLocation(testLocation(1)),
+		tx.AddUser(testUser(3)),
+		tx.AddVisit(models.Visit{ID: 1, User: 3, Location: 1, VisitedAt: 1, Mark: 1}),
+		tx.UpdateVisit(models.Visit{ID: 1, User: 2, Location: 1, VisitedAt: 2, Mark: 5}),
+		tx.UpdateUser(testUser(2)),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CloseWAL(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, w, applied, failed := replayTestWAL(t, path, 0)
+	w.Close()
+	// the batch is a single record
+	if applied != 3 || failed != 0 {
+		t.Fatalf("applied %d, failed %d, expected 3 and 0", applied, failed)
+	}
+	compareDB(t, d, replayed, 3)
+
+	for _, payload := range [][]byte{
+		{opAddUser, 1, 0},
+		{opAddUser, 100, 0, 0, 0, '{'},
+		{opBatch, 0, 0, 0, 0},
+	} {
+		if err := New(NewMapStorage()).applyWALBatch(payload); err != ErrWALCorrupt {
+			t.Errorf("batch %v: got %v", payload, err)
+		}
+	}
+}
+
+func TestTxConcurrentReaders(t *testing.T) {
+
+	d := testBatchDB(t)
+	if err := d.AddVisit(models.Visit{ID: 2, User: 2, Location: 2, VisitedAt: 1, Mark: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	// every batch swaps the owners of both visits
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tx := d.Begin()
+				a, b := tx.GetVisit(1), tx.GetVisit(2)
+				a.User, b.User = b.User, a.User
+				a.Location, b.Location = b.Location, a.Location
+				if err := tx.UpdateVisit(a); err != nil {
+					t.Error(err)
+				}
+				if err := tx.UpdateVisit(b); err != nil {
+					t.Error(err)
+				}
+				if err := tx.Commit(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	for n := 0; n < 10000; n++ {
+		id := uint32(1 + n%2)
+		d.RLockUser(id)
+		uv := d.GetUserVisits(id)
+		uv.M.RLock()
+		visits := len(uv.Visits)
+		uv.M.RUnlock()
+		d.RUnlockUser(id)
+		d.RLockLocation(id)
+		lm := d.GetLocationMarks(id)
+		lm.M.RLock()
+		marks := len(lm.Marks)
+		lm.M.RUnlock()
+		d.RUnlockLocation(id)
+		if visits != 1 || marks != 1 {
+			t.Fatalf("partially applied batch is seen: user %d has %d visits, location %d has %d marks",
+				id, visits, id, marks)
+		}
+	}
+}
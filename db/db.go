@@ -0,0 +1,282 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+const (
+	DefaultShardsCount = 509
+	MaxShardsCount     = 1 << 16
+)
+
+// shardsCount is the number of shards of the locks, indexes and map storage
+// created after SetShardsCount
+var shardsCount uint32 = DefaultShardsCount
+
+// SetShardsCount sets the number of shards of the locks, indexes and map
+// storage. It should be called before the storage and DB are created.
+func SetShardsCount(n int) error {
+	if n <= 0 || n > MaxShardsCount {
+		return fmt.Errorf("shards count should be from 1 to %d, got %d", MaxShardsCount, n)
+	}
+	shardsCount = uint32(n)
+	return nil
+}
+
+var (
+	ErrAlreadyExists = errors.New("already exists")
+	ErrNotFound      = errors.New("not found")
+)
+
+// Storage is a backend which keeps the entities and their indexes. It is
+// responsible only for the storing, validation and index maintenance are
+// done by DB.
+type Storage interface {
+	GetUser(id uint32) models.User
+	GetLocation(id uint32) models.Location
+	GetVisit(id uint32) models.Visit
+
+	// Add* store a new entity, ErrAlreadyExists is returned if the entity
+	// with the same ID is already stored
+	AddUser(models.User) error
+	AddLocation(models.Location) error
+	AddVisit(models.Visit) error
+
+	// Update* replace the stored entity
+	UpdateUser(models.User) error
+	UpdateLocation(models.Location) error
+	UpdateVisit(models.Visit) error
+
+	// Delete* remove the stored entity, ErrNotFound is returned if there is
+	// no entity with such ID
+	DeleteUser(id uint32) error
+	DeleteLocation(id uint32) error
+	DeleteVisit(id uint32) error
+
+	// GetLocationMarks and GetUserVisits return the index entry, it is
+	// created on the first access
+	GetLocationMarks(id uint32) *models.LocationMarks
+	GetUserVisits(id uint32) *models.UserVisits
+
+	// Range* call f for every stored entity or existing index entry, in no
+	// particular order
+	RangeUsers(f func(models.User))
+	RangeLocations(f func(models.Location))
+	RangeVisits(f func(models.Visit))
+	RangeLocationMarks(f func(id uint32, lm *models.LocationMarks))
+	RangeUserVisits(f func(id uint32, uv *models.UserVisits))
+}
+
+var backends = map[string]func() Storage{
+	"array": func() Storage { return NewArrayStorage() },
+	"map":   func() Storage { return NewMapStorage() },
+}
+
+// Backends returns the names of available storage backends
+func Backends() []string {
+	var ret []string
+	for name := range backends {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// HasBackend tells if the storage backend with such name is available
+func HasBackend(backend string) bool {
+	_, ok := backends[backend]
+	return ok
+}
+
+// NewStorage creates the storage backend by its name
+func NewStorage(backend string) (Storage, error) {
+	f, ok := backends[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend: %q", backend)
+	}
+	return f(), nil
+}
+
+type DB struct {
+	s Storage
+
+	// lockU, lockL and lockV serialize mutations of the same entity, the
+	// readers hold them shared while a batch or a delete is applied
+	lockU *ShardedLock
+	lockL *ShardedLock
+	lockV *ShardedLock
+
+	emails *emailIndex
+	search *searchIndex
+
+	inv Invalidator
+
+	// numbers of the stored entities, updated atomically
+	users     int64
+	locations int64
+	visits    int64
+
+	// tx is held shared by mutations while they are logged and applied,
+	// deletes and snapshots hold it exclusively
+	tx  sync.RWMutex
+	wal atomic.Value
+}
+
+func New(s Storage) *DB {
+	return &DB{
+		s:     s,
+		lockU: NewShardedLock(shardsCount),
+		lockL: NewShardedLock(shardsCount),
+		lockV: NewShardedLock(shardsCount),
+
+		emails: newEmailIndex(),
+		search: newSearchIndex(),
+	}
+}
+
+func (db *DB) GetUser(id uint32) models.User {
+	return db.s.GetUser(id)
+}
+
+func (db *DB) GetLocation(id uint32) models.Location {
+	return db.s.GetLocation(id)
+}
+
+func (db *DB) GetVisit(id uint32) models.Visit {
+	return db.s.GetVisit(id)
+}
+
+func (db *DB) GetLocationMarks(id uint32) *models.LocationMarks {
+	return db.s.GetLocationMarks(id)
+}
+
+func (db *DB) GetUserVisits(id uint32) *models.UserVisits {
+	return db.s.GetUserVisits(id)
+}
+
+func (db *DB) AddUser(v models.User) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	db.tx.RLock()
+	defer db.tx.RUnlock()
+	db.lockU.Lock(v.ID)
+	defer db.lockU.Unlock(v.ID)
+	unlock := db.emails.lockPair(v.Email, v.Email)
+	defer unlock()
+	if db.s.GetUser(v.ID).IsValid() {
+		return ErrAlreadyExists
+	}
+	if err := db.emails.check(v.Email, v.ID); err != nil {
+		return err
+	}
+	if err := db.log(opAddUser, &v); err != nil {
+		return err
+	}
+	return db.addUser(v)
+}
+
+// addUser must be called with the email shard locked
+func (db *DB) addUser(v models.User) error {
+	if err := db.s.AddUser(v); err != nil {
+		return err
+	}
+	atomic.AddInt64(&db.users, 1)
+	db.emails.set(v.Email, v.ID)
+	db.invalidateUser(v.ID)
+	return nil
+}
+
+func (db *DB) AddLocation(v models.Location) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	db.tx.RLock()
+	defer db.tx.RUnlock()
+	db.lockL.Lock(v.ID)
+	defer db.lockL.Unlock(v.ID)
+	if db.s.GetLocation(v.ID).IsValid() {
+		return ErrAlreadyExists
+	}
+	if err := db.log(opAddLocation, &v); err != nil {
+		return err
+	}
+	return db.addLocation(v)
+}
+
+func (db *DB) addLocation(v models.Location) error {
+	if err := db.s.AddLocation(v); err != nil {
+		return err
+	}
+	atomic.AddInt64(&db.locations, 1)
+	db.search.add(v)
+	db.invalidateLocation(v.ID)
+	return nil
+}
+
+func (db *DB) AddVisit(v models.Visit) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	db.tx.RLock()
+	defer db.tx.RUnlock()
+	db.lockV.Lock(v.ID)
+	defer db.lockV.Unlock(v.ID)
+	if db.s.GetVisit(v.ID).IsValid() {
+		return ErrAlreadyExists
+	}
+	if err := db.checkVisitRefs(v); err != nil {
+		return err
+	}
+	if err := db.log(opAddVisit, &v); err != nil {
+		return err
+	}
+	return db.addVisit(v)
+}
+
+func (db *DB) addVisit(v models.Visit) error {
+	// the visit must not be stored if it can't be indexed
+	if err := db.checkVisitRefs(v); err != nil {
+		return err
+	}
+	if err := db.s.AddVisit(v); err != nil {
+		return err
+	}
+	atomic.AddInt64(&db.visits, 1)
+	return db.AddVisitToIndex(v)
+}
+
+// RLockUser blocks while a batch or a delete modifying the user or its
+// visits is applied. Readers hold it to see every batch either completely
+// applied or not applied at all.
+func (db *DB) RLockUser(id uint32) {
+	db.lockU.RLock(id)
+}
+
+func (db *DB) RUnlockUser(id uint32) {
+	db.lockU.RUnlock(id)
+}
+
+// RLockLocation is RLockUser for the location and its marks
+func (db *DB) RLockLocation(id uint32) {
+	db.lockL.RLock(id)
+}
+
+func (db *DB) RUnlockLocation(id uint32) {
+	db.lockL.RUnlock(id)
+}
+
+// RLockVisit is RLockUser for the visit
+func (db *DB) RLockVisit(id uint32) {
+	db.lockV.RLock(id)
+}
+
+func (db *DB) RUnlockVisit(id uint32) {
+	db.lockV.RUnlock(id)
+}
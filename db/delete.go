@@ -0,0 +1,186 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrReferenced is returned when deleting a user or location which has
+// visits without cascade
+var ErrReferenced = errors.New("entity is referenced by visits")
+
+// DeleteVisit removes the visit and its entries from the user visits and
+// location marks indexes
+func (db *DB) DeleteVisit(id uint32) error {
+
+	db.tx.RLock()
+	defer db.tx.RUnlock()
+	db.lockV.Lock(id)
+	defer db.lockV.Unlock(id)
+
+	if !db.GetVisit(id).IsValid() {
+		return ErrNotFound
+	}
+
+	if err := db.logDelete(opDeleteVisit, id, false); err != nil {
+		return err
+	}
+
+	return db.deleteVisit(id)
+}
+
+func (db *DB) deleteVisit(id uint32) error {
+	v := db.GetVisit(id)
+	db.GetUserVisits(v.User).Pop(id)
+	db.GetLocationMarks(v.Location).Pop(id)
+	if err := db.s.DeleteVisit(id); err != nil {
+		return err
+	}
+	atomic.AddInt64(&db.visits, -1)
+	db.invalidateUserVisits(v.User)
+	db.invalidateLocationMarks(v.Location)
+	return nil
+}
+
+// DeleteUser removes the user. If the user has visits then ErrReferenced is
+// returned, or the visits are removed too if cascade is set.
+func (db *DB) DeleteUser(id uint32, cascade bool) error {
+
+	// user and location deletions are rare, just stop the world to not
+	// care about visits being added concurrently
+	db.tx.Lock()
+	defer db.tx.Unlock()
+
+	user := db.GetUser(id)
+	if !user.IsValid() {
+		return ErrNotFound
+	}
+
+	uv := db.GetUserVisits(id)
+	uv.M.RLock()
+	visits := make([]uint32, len(uv.Visits))
+	locations := make([]uint32, len(uv.Visits))
+	for n, i := range uv.Visits {
+		visits[n] = i.Visit
+		locations[n] = i.Location
+	}
+	uv.M.RUnlock()
+
+	if len(visits) > 0 && !cascade {
+		return ErrReferenced
+	}
+
+	// the readers of the affected entities wait for the whole cascade
+	defer db.lockU.lockSet([]uint32{id})()
+	defer db.lockL.lockSet(locations)()
+	defer db.lockV.lockSet(visits)()
+
+	if err := db.logDelete(opDeleteUser, id, cascade); err != nil {
+		return err
+	}
+
+	for _, i := range visits {
+		if err := db.deleteVisit(i); err != nil {
+			return err
+		}
+	}
+
+	unlock := db.emails.lockPair(user.Email, user.Email)
+	defer unlock()
+	db.emails.del(user.Email, id)
+
+	if err := db.s.DeleteUser(id); err != nil {
+		return err
+	}
+	atomic.AddInt64(&db.users, -1)
+
+	db.invalidateUser(id)
+	// the empty visits list was answered 200 while the user existed
+	db.invalidateUserVisits(id)
+
+	return nil
+}
+
+// DeleteLocation removes the location, see DeleteUser
+func (db *DB) DeleteLocation(id uint32, cascade bool) error {
+
+	db.tx.Lock()
+	defer db.tx.Unlock()
+
+	location := db.GetLocation(id)
+	if !location.IsValid() {
+		return ErrNotFound
+	}
+
+	lm := db.GetLocationMarks(id)
+	lm.M.RLock()
+	visits := make([]uint32, len(lm.Marks))
+	users := make([]uint32, len(lm.Marks))
+	for n, i := range lm.Marks {
+		visits[n] = i.Visit
+		users[n] = i.User
+	}
+	lm.M.RUnlock()
+
+	if len(visits) > 0 && !cascade {
+		return ErrReferenced
+	}
+
+	defer db.lockU.lockSet(users)()
+	defer db.lockL.lockSet([]uint32{id})()
+	defer db.lockV.lockSet(visits)()
+
+	if err := db.logDelete(opDeleteLocation, id, cascade); err != nil {
+		return err
+	}
+
+	for _, i := range visits {
+		if err := db.deleteVisit(i); err != nil {
+			return err
+		}
+	}
+
+	db.search.del(location)
+
+	if err := db.s.DeleteLocation(id); err != nil {
+		return err
+	}
+	atomic.AddInt64(&db.locations, -1)
+
+	db.invalidateLocation(id)
+	db.invalidateLocationMarks(id)
+
+	return nil
+}
+
+// Delete record payload is uint32 id and cascade flag byte
+func (db *DB) logDelete(op byte, id uint32, cascade bool) error {
+	w, _ := db.wal.Load().(*WAL)
+	if w == nil {
+		return nil
+	}
+	var payload [5]byte
+	binary.LittleEndian.PutUint32(payload[:4], id)
+	if cascade {
+		payload[4] = 1
+	}
+	return w.append(op, payload[:])
+}
+
+func (db *DB) applyWALDelete(op byte, payload []byte) error {
+	if len(payload) != 5 {
+		return ErrWALCorrupt
+	}
+	id := binary.LittleEndian.Uint32(payload[:4])
+	cascade := payload[4] == 1
+	switch op {
+	case opDeleteUser:
+		return db.DeleteUser(id, cascade)
+	case opDeleteLocation:
+		return db.DeleteLocation(id, cascade)
+	case opDeleteVisit:
+		return db.DeleteVisit(id)
+	}
+	return ErrWALCorrupt
+}
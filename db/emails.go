@@ -0,0 +1,110 @@
+package db
+
+import (
+	"errors"
+	"hash/fnv"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+var ErrEmailExists = errors.New("email is already used by another user")
+
+// emailIndex maps User.Email to the user ID. The shard of the email is
+// locked by lock, get, set and del must be called with it held. Empty emails
+// are not indexed.
+type emailIndex struct {
+	lock   *ShardedLock
+	shards []map[string]uint32
+}
+
+func newEmailIndex() *emailIndex {
+	e := &emailIndex{
+		lock:   NewShardedLock(shardsCount),
+		shards: make([]map[string]uint32, shardsCount),
+	}
+	for i := range e.shards {
+		e.shards[i] = map[string]uint32{}
+	}
+	return e
+}
+
+func (e *emailIndex) shard(email string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(email))
+	return h.Sum32() % uint32(len(e.shards))
+}
+
+// lockPair locks the shards of both emails in the shard order, so the email
+// could be changed without deadlocks
+func (e *emailIndex) lockPair(a, b string) (unlock func()) {
+	i, j := e.shard(a), e.shard(b)
+	if i > j {
+		i, j = j, i
+	}
+	e.lock.Lock(i)
+	if i != j {
+		e.lock.Lock(j)
+	}
+	return func() {
+		if i != j {
+			e.lock.Unlock(j)
+		}
+		e.lock.Unlock(i)
+	}
+}
+
+// lockSet locks the shards of all emails, see ShardedLock.lockSet
+func (e *emailIndex) lockSet(emails []string) (unlock func()) {
+	shards := make([]uint32, len(emails))
+	for n, i := range emails {
+		shards[n] = e.shard(i)
+	}
+	return e.lock.lockSet(shards)
+}
+
+// lookup is get with the shard locked for reading
+func (e *emailIndex) lookup(email string) uint32 {
+	i := e.shard(email)
+	e.lock.RLock(i)
+	defer e.lock.RUnlock(i)
+	return e.get(email)
+}
+
+func (e *emailIndex) get(email string) uint32 {
+	return e.shards[e.shard(email)][email]
+}
+
+func (e *emailIndex) set(email string, id uint32) {
+	if email == "" {
+		return
+	}
+	e.shards[e.shard(email)][email] = id
+}
+
+func (e *emailIndex) del(email string, id uint32) {
+	m := e.shards[e.shard(email)]
+	if m[email] == id {
+		delete(m, email)
+	}
+}
+
+// check returns ErrEmailExists if the email belongs to another user
+func (e *emailIndex) check(email string, id uint32) error {
+	if owner := e.get(email); email != "" && owner != 0 && owner != id {
+		return ErrEmailExists
+	}
+	return nil
+}
+
+// GetUserByEmail returns the user with such email, or an invalid zero User
+func (db *DB) GetUserByEmail(email string) models.User {
+	id := db.emails.lookup(email)
+	if id == 0 {
+		return models.User{}
+	}
+	// the email could be changed since it was looked up
+	if v := db.GetUser(id); v.Email == email {
+		return v
+	}
+	return models.User{}
+}
@@ -4,36 +4,66 @@ import (
 	"github.com/ei-grad/hlcup/models"
 )
 
-func (db *DB) GetLocationMarks(id uint32) *models.LocationMarks {
-	db.lockLM.RLock(id)
-	lm := db.locationMarks[id]
-	db.lockLM.RUnlock(id)
+func (s *ArrayStorage) GetLocationMarks(id uint32) *models.LocationMarks {
+	s.lockLM.RLock(id)
+	var lm *models.LocationMarks
+	if p := s.locationMarks.get(id); p != nil {
+		lm = *p
+	}
+	s.lockLM.RUnlock(id)
 	if lm == nil {
-		db.lockLM.Lock(id)
+		s.lockLM.Lock(id)
 		// check for the race condition
-		lm = db.locationMarks[id]
+		p := s.locationMarks.ensure(id)
+		lm = *p
 		if lm == nil {
 			lm = &models.LocationMarks{}
-			db.locationMarks[id] = lm
+			*p = lm
 		}
-		db.lockLM.Unlock(id)
+		s.lockLM.Unlock(id)
 	}
 	return lm
 }
 
-func (db *DB) GetUserVisits(id uint32) *models.UserVisits {
-	db.lockUV.RLock(id)
-	uv := db.userVisits[id]
-	db.lockUV.RUnlock(id)
+func (s *ArrayStorage) GetUserVisits(id uint32) *models.UserVisits {
+	s.lockUV.RLock(id)
+	var uv *models.UserVisits
+	if p := s.userVisits.get(id); p != nil {
+		uv = *p
+	}
+	s.lockUV.RUnlock(id)
 	if uv == nil {
-		db.lockUV.Lock(id)
+		s.lockUV.Lock(id)
 		// check for the race condition
-		uv = db.userVisits[id]
+		p := s.userVisits.ensure(id)
+		uv = *p
 		if uv == nil {
 			uv = &models.UserVisits{}
-			db.userVisits[id] = uv
+			*p = uv
 		}
-		db.lockUV.Unlock(id)
+		s.lockUV.Unlock(id)
 	}
 	return uv
 }
+
+func (s *ArrayStorage) RangeLocationMarks(f func(id uint32, lm *models.LocationMarks)) {
+	s.locationMarks.rangeIDs(func(id uint32) {
+		s.lockLM.RLock(id)
+		lm := *s.locationMarks.get(id)
+		s.lockLM.RUnlock(id)
+		if lm != nil {
+			f(id, lm)
+		}
+	})
+}
+
+func (s *ArrayStorage) RangeUserVisits(f func(id uint32, uv *models.UserVisits)) {
+	s.userVisits.rangeIDs(func(id uint32) {
+		s.lockUV.RLock(id)
+		uv := *s.userVisits.get(id)
+		s.lockUV.RUnlock(id)
+		if uv != nil {
+			f(id, uv)
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package db
+
+// Invalidator is notified after the entities and index entries are modified,
+// it is used to drop the cached responses
+type Invalidator interface {
+	// InvalidateUser is called when the user is added, updated or deleted
+	InvalidateUser(id uint32)
+	// InvalidateLocation is called when the location is added, updated or
+	// deleted
+	InvalidateLocation(id uint32)
+	// InvalidateUserVisits is called when the user visits index entry is
+	// changed, including the place, country, city and distance of visited
+	// locations
+	InvalidateUserVisits(user uint32)
+	// InvalidateLocationMarks is called when the location marks index entry
+	// is changed, including the birth date and gender of the visitors
+	InvalidateLocationMarks(location uint32)
+}
+
+// SetInvalidator must be called before the DB is used
+func (db *DB) SetInvalidator(i Invalidator) {
+	db.inv = i
+}
+
+func (db *DB) invalidateUser(id uint32) {
+	if db.inv != nil {
+		db.inv.InvalidateUser(id)
+	}
+}
+
+func (db *DB) invalidateLocation(id uint32) {
+	if db.inv != nil {
+		db.inv.InvalidateLocation(id)
+	}
+}
+
+func (db *DB) invalidateUserVisits(user uint32) {
+	if db.inv != nil {
+		db.inv.InvalidateUserVisits(user)
+	}
+}
+
+func (db *DB) invalidateLocationMarks(location uint32) {
+	if db.inv != nil {
+		db.inv.InvalidateLocationMarks(location)
+	}
+}
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+// MapStorage keeps entities in sharded maps. Unlike ArrayStorage it has no
+// limits on IDs and its memory usage depends only on the number of entities.
+type MapStorage struct {
+	nShards uint32
+	shards  []mapShard
+}
+
+type mapShard struct {
+	sync.RWMutex
+	users         map[uint32]models.User
+	locations     map[uint32]models.Location
+	visits        map[uint32]models.Visit
+	locationMarks map[uint32]*models.LocationMarks
+	userVisits    map[uint32]*models.UserVisits
+}
+
+func NewMapStorage() *MapStorage {
+	s := &MapStorage{
+		nShards: shardsCount,
+		shards:  make([]mapShard, shardsCount),
+	}
+	for i := range s.shards {
+		s.shards[i].users = map[uint32]models.User{}
+		s.shards[i].locations = map[uint32]models.Location{}
+		s.shards[i].visits = map[uint32]models.Visit{}
+		s.shards[i].locationMarks = map[uint32]*models.LocationMarks{}
+		s.shards[i].userVisits = map[uint32]*models.UserVisits{}
+	}
+	return s
+}
+
+func (s *MapStorage) shard(id uint32) *mapShard {
+	return &s.shards[id%s.nShards]
+}
+
+func (s *MapStorage) GetUser(id uint32) models.User {
+	sh := s.shard(id)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.users[id]
+}
+
+func (s *MapStorage) GetLocation(id uint32) models.Location {
+	sh := s.shard(id)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.locations[id]
+}
+
+func (s *MapStorage) GetVisit(id uint32) models.Visit {
+	sh := s.shard(id)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.visits[id]
+}
+
+func (s *MapStorage) AddUser(v models.User) error {
+	sh := s.shard(v.ID)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.users[v.ID]; ok {
+		return ErrAlreadyExists
+	}
+	sh.users[v.ID] = v
+	return nil
+}
+
+func (s *MapStorage) AddLocation(v models.Location) error {
+	sh := s.shard(v.ID)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.locations[v.ID]; ok {
+		return ErrAlreadyExists
+	}
+	sh.locations[v.ID] = v
+	return nil
+}
+
+func (s *MapStorage) AddVisit(v models.Visit) error {
+	sh := s.shard(v.ID)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.visits[v.ID]; ok {
+		return ErrAlreadyExists
+	}
+	sh.visits[v.ID] = v
+	return nil
+}
+
+func (s *MapStorage) UpdateUser(v models.User) error {
+	sh := s.shard(v.ID)
+	sh.Lock()
+	sh.users[v.ID] = v
+	sh.Unlock()
+	return nil
+}
+
+func (s *MapStorage) UpdateLocation(v models.Location) error {
+	sh := s.shard(v.ID)
+	sh.Lock()
+	sh.locations[v.ID] = v
+	sh.Unlock()
+	return nil
+}
+
+func (s *MapStorage) UpdateVisit(v models.Visit) error {
+	sh := s.shard(v.ID)
+	sh.Lock()
+	sh.visits[v.ID] = v
+	sh.Unlock()
+	return nil
+}
+
+func (s *MapStorage) DeleteUser(id uint32) error {
+	sh := s.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(sh.users, id)
+	return nil
+}
+
+func (s *MapStorage) DeleteLocation(id uint32) error {
+	sh := s.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.locations[id]; !ok {
+		return ErrNotFound
+	}
+	delete(sh.locations, id)
+	return nil
+}
+
+func (s *MapStorage) DeleteVisit(id uint32) error {
+	sh := s.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.visits[id]; !ok {
+		return ErrNotFound
+	}
+	delete(sh.visits, id)
+	return nil
+}
+
+func (s *MapStorage) GetLocationMarks(id uint32) *models.LocationMarks {
+	sh := s.shard(id)
+	sh.RLock()
+	lm := sh.locationMarks[id]
+	sh.RUnlock()
+	if lm == nil {
+		sh.Lock()
+		// check for the race condition
+		lm = sh.locationMarks[id]
+		if lm == nil {
+			lm = &models.LocationMarks{}
+			sh.locationMarks[id] = lm
+		}
+		sh.Unlock()
+	}
+	return lm
+}
+
+func (s *MapStorage) GetUserVisits(id uint32) *models.UserVisits {
+	sh := s.shard(id)
+	sh.RLock()
+	uv := sh.userVisits[id]
+	sh.RUnlock()
+	if uv == nil {
+		sh.Lock()
+		// check for the race condition
+		uv = sh.userVisits[id]
+		if uv == nil {
+			uv = &models.UserVisits{}
+			sh.userVisits[id] = uv
+		}
+		sh.Unlock()
+	}
+	return uv
+}
+
+// Range* functions copy the shard contents before calling f, so f is free
+// to access the storage
+
+func (s *MapStorage) RangeUsers(f func(models.User)) {
+	var buf []models.User
+	for n := range s.shards {
+		sh := &s.shards[n]
+		sh.RLock()
+		buf = buf[:0]
+		for _, v := range sh.users {
+			buf = append(buf, v)
+		}
+		sh.RUnlock()
+		for _, v := range buf {
+			f(v)
+		}
+	}
+}
+
+func (s *MapStorage) RangeLocations(f func(models.Location)) {
+	var buf []models.Location
+	for n := range s.shards {
+		sh := &s.shards[n]
+		sh.RLock()
+		buf = buf[:0]
+		for _, v := range sh.locations {
+			buf = append(buf, v)
+		}
+		sh.RUnlock()
+		for _, v := range buf {
+			f(v)
+		}
+	}
+}
+
+func (s *MapStorage) RangeVisits(f func(models.Visit)) {
+	var buf []models.Visit
+	for n := range s.shards {
+		sh := &s.shards[n]
+		sh.RLock()
+		buf = buf[:0]
+		for _, v := range sh.visits {
+			buf = append(buf, v)
+		}
+		sh.RUnlock()
+		for _, v := range buf {
+			f(v)
+		}
+	}
+}
+
+func (s *MapStorage) RangeLocationMarks(f func(id uint32, lm *models.LocationMarks)) {
+	var ids []uint32
+	var buf []*models.LocationMarks
+	for n := range s.shards {
+		sh := &s.shards[n]
+		sh.RLock()
+		ids, buf = ids[:0], buf[:0]
+		for id, lm := range sh.locationMarks {
+			ids = append(ids, id)
+			buf = append(buf, lm)
+		}
+		sh.RUnlock()
+		for i := range buf {
+			f(ids[i], buf[i])
+		}
+	}
+}
+
+func (s *MapStorage) RangeUserVisits(f func(id uint32, uv *models.UserVisits)) {
+	var ids []uint32
+	var buf []*models.UserVisits
+	for n := range s.shards {
+		sh := &s.shards[n]
+		sh.RLock()
+		ids, buf = ids[:0], buf[:0]
+		for id, uv := range sh.userVisits {
+			ids = append(ids, id)
+			buf = append(buf, uv)
+		}
+		sh.RUnlock()
+		for i := range buf {
+			f(ids[i], buf[i])
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+// Token weights of the Location fields, a query word matching the city or
+// the country is worth more than a word somewhere in the place description
+const (
+	weightPlace   = 1
+	weightCity    = 3
+	weightCountry = 3
+)
+
+// searchIndex is an inverted index of Location.Place, City and Country
+// tokens. For every token it keeps the IDs of the locations with the token
+// weight in them.
+type searchIndex struct {
+	lock   *ShardedLock
+	shards []map[string]map[uint32]uint32
+	count  int64
+}
+
+func newSearchIndex() *searchIndex {
+	s := &searchIndex{
+		lock:   NewShardedLock(shardsCount),
+		shards: make([]map[string]map[uint32]uint32, shardsCount),
+	}
+	for i := range s.shards {
+		s.shards[i] = map[string]map[uint32]uint32{}
+	}
+	return s
+}
+
+func (s *searchIndex) shard(token string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	return h.Sum32() % uint32(len(s.shards))
+}
+
+// Tokenize splits the text into lowercase words. Letters and digits of any
+// script are word characters, "ё" is folded into "е".
+func Tokenize(s string) []string {
+	var ret []string
+	for _, i := range strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		ret = append(ret, strings.Map(func(r rune) rune {
+			r = unicode.ToLower(r)
+			if r == 'ё' {
+				return 'е'
+			}
+			return r
+		}, i))
+	}
+	return ret
+}
+
+func locationTokens(v models.Location) map[string]uint32 {
+	ret := map[string]uint32{}
+	for _, i := range Tokenize(v.Place) {
+		ret[i] += weightPlace
+	}
+	for _, i := range Tokenize(v.City) {
+		ret[i] += weightCity
+	}
+	for _, i := range Tokenize(v.Country) {
+		ret[i] += weightCountry
+	}
+	return ret
+}
+
+func (s *searchIndex) add(v models.Location) {
+	for token, weight := range locationTokens(v) {
+		i := s.shard(token)
+		s.lock.Lock(i)
+		postings := s.shards[i][token]
+		if postings == nil {
+			postings = map[uint32]uint32{}
+			s.shards[i][token] = postings
+		}
+		postings[v.ID] = weight
+		s.lock.Unlock(i)
+	}
+	atomic.AddInt64(&s.count, 1)
+}
+
+func (s *searchIndex) del(v models.Location) {
+	for token := range locationTokens(v) {
+		i := s.shard(token)
+		s.lock.Lock(i)
+		if postings := s.shards[i][token]; postings != nil {
+			delete(postings, v.ID)
+			if len(postings) == 0 {
+				delete(s.shards[i], token)
+			}
+		}
+		s.lock.Unlock(i)
+	}
+	atomic.AddInt64(&s.count, -1)
+}
+
+func (s *searchIndex) update(old, v models.Location) {
+	if old.Place == v.Place && old.City == v.City && old.Country == v.Country {
+		return
+	}
+	s.del(old)
+	s.add(v)
+}
+
+type searchResult struct {
+	id    uint32
+	score float64
+}
+
+// better ranks the higher score first, then the lower ID
+func (r searchResult) better(o searchResult) bool {
+	if r.score != o.score {
+		return r.score > o.score
+	}
+	return r.id < o.id
+}
+
+// topResults keeps the best limit results, the worst of them is on the top of
+// the heap
+type topResults struct {
+	limit   int
+	results []searchResult
+}
+
+func (t *topResults) Len() int           { return len(t.results) }
+func (t *topResults) Less(i, j int) bool { return t.results[j].better(t.results[i]) }
+func (t *topResults) Swap(i, j int)      { t.results[i], t.results[j] = t.results[j], t.results[i] }
+func (t *topResults) Push(x interface{}) { t.results = append(t.results, x.(searchResult)) }
+func (t *topResults) Pop() interface{} {
+	r := t.results[len(t.results)-1]
+	t.results = t.results[:len(t.results)-1]
+	return r
+}
+
+func (t *topResults) add(r searchResult) {
+	switch {
+	case len(t.results) < t.limit:
+		heap.Push(t, r)
+	case r.better(t.results[0]):
+		t.results[0] = r
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns the IDs of the kept results, the best first
+func (t *topResults) sorted() []uint32 {
+	sort.Slice(t.results, func(i, j int) bool {
+		return t.results[i].better(t.results[j])
+	})
+	ret := make([]uint32, len(t.results))
+	for n, i := range t.results {
+		ret[n] = i.id
+	}
+	return ret
+}
+
+// search returns IDs of the locations matching any of the query tokens,
+// ranked by the sum of token weights multiplied by the token IDF. Only the
+// best limit results are kept while ranking.
+func (s *searchIndex) search(q string, limit int) []uint32 {
+
+	if limit <= 0 {
+		return nil
+	}
+
+	n := float64(atomic.LoadInt64(&s.count))
+	top := &topResults{limit: limit}
+	tokens := Tokenize(q)
+
+	// the single token postings are ranked as is
+	if len(tokens) == 1 {
+		i := s.shard(tokens[0])
+		s.lock.RLock(i)
+		postings := s.shards[i][tokens[0]]
+		idf := math.Log(1 + n/float64(len(postings)+1))
+		for id, weight := range postings {
+			top.add(searchResult{id, float64(weight) * idf})
+		}
+		s.lock.RUnlock(i)
+		return top.sorted()
+	}
+
+	scores := map[uint32]float64{}
+
+	for _, token := range tokens {
+		i := s.shard(token)
+		s.lock.RLock(i)
+		postings := s.shards[i][token]
+		idf := math.Log(1 + n/float64(len(postings)+1))
+		for id, weight := range postings {
+			scores[id] += float64(weight) * idf
+		}
+		s.lock.RUnlock(i)
+	}
+
+	for id, score := range scores {
+		top.add(searchResult{id, score})
+	}
+
+	return top.sorted()
+}
+
+// SearchLocations returns up to limit locations matching the query, the most
+// relevant first
+func (db *DB) SearchLocations(q string, limit int) []models.Location {
+	var ret []models.Location
+	for _, id := range db.search.search(q, limit) {
+		if v := db.GetLocation(id); v.IsValid() {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
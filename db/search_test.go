@@ -0,0 +1,67 @@
+package db
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+// fullSearch ranks all the matching locations and cuts the limit after that
+func fullSearch(s *searchIndex, q string, limit int) []uint32 {
+	n := float64(s.count)
+	scores := map[uint32]float64{}
+	for _, token := range Tokenize(q) {
+		postings := s.shards[s.shard(token)][token]
+		idf := math.Log(1 + n/float64(len(postings)+1))
+		for id, weight := range postings {
+			scores[id] += float64(weight) * idf
+		}
+	}
+	var results []searchResult
+	for id, score := range scores {
+		results = append(results, searchResult{id, score})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].better(results[j]) })
+	ret := []uint32{}
+	for n, i := range results {
+		if n == limit {
+			break
+		}
+		ret = append(ret, i.id)
+	}
+	return ret
+}
+
+func TestSearchTopResults(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	words := []string{"Россия", "Москва", "Париж", "Франция", "парк", "музей", "мост", "башня", "собор", "замок"}
+	phrase := func(n int) string {
+		var ret []string
+		for i := 0; i < n; i++ {
+			ret = append(ret, words[r.Intn(len(words))])
+		}
+		return strings.Join(ret, " ")
+	}
+
+	s := newSearchIndex()
+	for id := uint32(1); id <= 2000; id++ {
+		s.add(models.Location{ID: id, Place: phrase(1 + r.Intn(3)), City: phrase(1), Country: phrase(1)})
+	}
+
+	for i := 0; i < 1000; i++ {
+		q, limit := phrase(1+r.Intn(3)), r.Intn(50)
+		got := s.search(q, limit)
+		if got == nil {
+			got = []uint32{}
+		}
+		if expected := fullSearch(s, q, limit); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%q limit %d: %v, expected %v", q, limit, got, expected)
+		}
+	}
+}
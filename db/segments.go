@@ -0,0 +1,247 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+// Segmented arrays cover the whole uint32 ID range. They consist of a
+// directory of lazily allocated fixed-size segments, so the memory usage
+// depends on the highest used IDs and the lookup is still O(1).
+const (
+	segmentBits   = 16
+	segmentSize   = 1 << segmentBits
+	segmentMask   = segmentSize - 1
+	segmentsCount = 1 << (32 - segmentBits)
+)
+
+// segmentsAlloc serializes the segments allocation
+var segmentsAlloc sync.Mutex
+
+type userSegment [segmentSize]models.User
+
+type userArray struct {
+	segments [segmentsCount]unsafe.Pointer
+}
+
+func (a *userArray) segment(id uint32) *userSegment {
+	return (*userSegment)(atomic.LoadPointer(&a.segments[id>>segmentBits]))
+}
+
+// get returns the element or nil if its segment is not allocated yet
+func (a *userArray) get(id uint32) *models.User {
+	if s := a.segment(id); s != nil {
+		return &s[id&segmentMask]
+	}
+	return nil
+}
+
+// ensure returns the element allocating its segment if needed
+func (a *userArray) ensure(id uint32) *models.User {
+	s := a.segment(id)
+	if s == nil {
+		segmentsAlloc.Lock()
+		if s = a.segment(id); s == nil {
+			s = new(userSegment)
+			atomic.StorePointer(&a.segments[id>>segmentBits], unsafe.Pointer(s))
+		}
+		segmentsAlloc.Unlock()
+	}
+	return &s[id&segmentMask]
+}
+
+// rangeIDs calls f for IDs from all allocated segments
+func (a *userArray) rangeIDs(f func(id uint32)) {
+	for n := range a.segments {
+		if atomic.LoadPointer(&a.segments[n]) == nil {
+			continue
+		}
+		base := uint32(n) << segmentBits
+		for i := uint32(0); i < segmentSize; i++ {
+			f(base | i)
+		}
+	}
+}
+
+type locationSegment [segmentSize]models.Location
+
+type locationArray struct {
+	segments [segmentsCount]unsafe.Pointer
+}
+
+func (a *locationArray) segment(id uint32) *locationSegment {
+	return (*locationSegment)(atomic.LoadPointer(&a.segments[id>>segmentBits]))
+}
+
+// get returns the element or nil if its segment is not allocated yet
+func (a *locationArray) get(id uint32) *models.Location {
+	if s := a.segment(id); s != nil {
+		return &s[id&segmentMask]
+	}
+	return nil
+}
+
+// ensure returns the element allocating its segment if needed
+func (a *locationArray) ensure(id uint32) *models.Location {
+	s := a.segment(id)
+	if s == nil {
+		segmentsAlloc.Lock()
+		if s = a.segment(id); s == nil {
+			s = new(locationSegment)
+			atomic.StorePointer(&a.segments[id>>segmentBits], unsafe.Pointer(s))
+		}
+		segmentsAlloc.Unlock()
+	}
+	return &s[id&segmentMask]
+}
+
+// rangeIDs calls f for IDs from all allocated segments
+func (a *locationArray) rangeIDs(f func(id uint32)) {
+	for n := range a.segments {
+		if atomic.LoadPointer(&a.segments[n]) == nil {
+			continue
+		}
+		base := uint32(n) << segmentBits
+		for i := uint32(0); i < segmentSize; i++ {
+			f(base | i)
+		}
+	}
+}
+
+type visitSegment [segmentSize]models.Visit
+
+type visitArray struct {
+	segments [segmentsCount]unsafe.Pointer
+}
+
+func (a *visitArray) segment(id uint32) *visitSegment {
+	return (*visitSegment)(atomic.LoadPointer(&a.segments[id>>segmentBits]))
+}
+
+// get returns the element or nil if its segment is not allocated yet
+func (a *visitArray) get(id uint32) *models.Visit {
+	if s := a.segment(id); s != nil {
+		return &s[id&segmentMask]
+	}
+	return nil
+}
+
+// ensure returns the element allocating its segment if needed
+func (a *visitArray) ensure(id uint32) *models.Visit {
+	s := a.segment(id)
+	if s == nil {
+		segmentsAlloc.Lock()
+		if s = a.segment(id); s == nil {
+			s = new(visitSegment)
+			atomic.StorePointer(&a.segments[id>>segmentBits], unsafe.Pointer(s))
+		}
+		segmentsAlloc.Unlock()
+	}
+	return &s[id&segmentMask]
+}
+
+// rangeIDs calls f for IDs from all allocated segments
+func (a *visitArray) rangeIDs(f func(id uint32)) {
+	for n := range a.segments {
+		if atomic.LoadPointer(&a.segments[n]) == nil {
+			continue
+		}
+		base := uint32(n) << segmentBits
+		for i := uint32(0); i < segmentSize; i++ {
+			f(base | i)
+		}
+	}
+}
+
+type locationMarksSegment [segmentSize]*models.LocationMarks
+
+type locationMarksArray struct {
+	segments [segmentsCount]unsafe.Pointer
+}
+
+func (a *locationMarksArray) segment(id uint32) *locationMarksSegment {
+	return (*locationMarksSegment)(atomic.LoadPointer(&a.segments[id>>segmentBits]))
+}
+
+// get returns the element or nil if its segment is not allocated yet
+func (a *locationMarksArray) get(id uint32) **models.LocationMarks {
+	if s := a.segment(id); s != nil {
+		return &s[id&segmentMask]
+	}
+	return nil
+}
+
+// ensure returns the element allocating its segment if needed
+func (a *locationMarksArray) ensure(id uint32) **models.LocationMarks {
+	s := a.segment(id)
+	if s == nil {
+		segmentsAlloc.Lock()
+		if s = a.segment(id); s == nil {
+			s = new(locationMarksSegment)
+			atomic.StorePointer(&a.segments[id>>segmentBits], unsafe.Pointer(s))
+		}
+		segmentsAlloc.Unlock()
+	}
+	return &s[id&segmentMask]
+}
+
+// rangeIDs calls f for IDs from all allocated segments
+func (a *locationMarksArray) rangeIDs(f func(id uint32)) {
+	for n := range a.segments {
+		if atomic.LoadPointer(&a.segments[n]) == nil {
+			continue
+		}
+		base := uint32(n) << segmentBits
+		for i := uint32(0); i < segmentSize; i++ {
+			f(base | i)
+		}
+	}
+}
+
+type userVisitsSegment [segmentSize]*models.UserVisits
+
+type userVisitsArray struct {
+	segments [segmentsCount]unsafe.Pointer
+}
+
+func (a *userVisitsArray) segment(id uint32) *userVisitsSegment {
+	return (*userVisitsSegment)(atomic.LoadPointer(&a.segments[id>>segmentBits]))
+}
+
+// get returns the element or nil if its segment is not allocated yet
+func (a *userVisitsArray) get(id uint32) **models.UserVisits {
+	if s := a.segment(id); s != nil {
+		return &s[id&segmentMask]
+	}
+	return nil
+}
+
+// ensure returns the element allocating its segment if needed
+func (a *userVisitsArray) ensure(id uint32) **models.UserVisits {
+	s := a.segment(id)
+	if s == nil {
+		segmentsAlloc.Lock()
+		if s = a.segment(id); s == nil {
+			s = new(userVisitsSegment)
+			atomic.StorePointer(&a.segments[id>>segmentBits], unsafe.Pointer(s))
+		}
+		segmentsAlloc.Unlock()
+	}
+	return &s[id&segmentMask]
+}
+
+// rangeIDs calls f for IDs from all allocated segments
+func (a *userVisitsArray) rangeIDs(f func(id uint32)) {
+	for n := range a.segments {
+		if atomic.LoadPointer(&a.segments[n]) == nil {
+			continue
+		}
+		base := uint32(n) << segmentBits
+		for i := uint32(0); i < segmentSize; i++ {
+			f(base | i)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package db
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
 
 type ShardedLock struct {
 	nShards uint32
@@ -29,3 +32,26 @@ func (l *ShardedLock) Lock(id uint32) {
 func (l *ShardedLock) Unlock(id uint32) {
 	l.mu[id%l.nShards].Unlock()
 }
+
+// lockSet locks the shards of all ids in the shard order, so the sets
+// overlapping with other sets could be locked without deadlocks. The shard
+// of several ids is locked once.
+func (l *ShardedLock) lockSet(ids []uint32) (unlock func()) {
+	shards := make([]int, 0, len(ids))
+	seen := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		if i := id % l.nShards; !seen[i] {
+			seen[i] = true
+			shards = append(shards, int(i))
+		}
+	}
+	sort.Ints(shards)
+	for _, i := range shards {
+		l.mu[i].Lock()
+	}
+	return func() {
+		for n := len(shards) - 1; n >= 0; n-- {
+			l.mu[shards[n]].Unlock()
+		}
+	}
+}
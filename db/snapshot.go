@@ -0,0 +1,327 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+// Snapshot file layout:
+//
+//     magic   [4]byte - "HLCS"
+//     version uint32
+//     created int64   - unix nanoseconds
+//     now     int64   - unix nanoseconds, application reference time
+//     lsn     uint64  - WAL records up to lsn are included into the snapshot
+//     users, locations, visits sections
+//     crc     uint32  - CRC-32C of everything above
+//
+// Every section is a sequence of records terminated by a zero ID. Integers
+// are little-endian, strings are prefixed with uvarint length. The location
+// marks and user visits indexes are rebuilt from the visits on load.
+//
+// The snapshot is fuzzy: it is written while the DB is modified, so it could
+// contain some effects of the WAL records after lsn. Replaying them on top of
+// it gives the consistent state, the records conflicting with the snapshot
+// are skipped on load and restored by the replay.
+const (
+	snapshotMagic   = "HLCS"
+	SnapshotVersion = 2
+)
+
+var (
+	ErrSnapshotMagic    = errors.New("snapshot: bad magic")
+	ErrSnapshotVersion  = errors.New("snapshot: unsupported version")
+	ErrSnapshotChecksum = errors.New("snapshot: checksum mismatch")
+	ErrSnapshotTrunc    = errors.New("snapshot: unexpected end of data")
+)
+
+// SnapshotHeader describes the snapshot contents
+type SnapshotHeader struct {
+	Version uint32
+	Created time.Time
+	Now     time.Time
+	LSN     uint64
+}
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (w *snapshotWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc.Write(b)
+	_, w.err = w.w.Write(b)
+}
+
+func (w *snapshotWriter) uint8(v uint8) {
+	w.buf[0] = v
+	w.write(w.buf[:1])
+}
+
+func (w *snapshotWriter) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(w.buf[:], v)
+	w.write(w.buf[:4])
+}
+
+func (w *snapshotWriter) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(w.buf[:], v)
+	w.write(w.buf[:8])
+}
+
+func (w *snapshotWriter) string(v string) {
+	n := binary.PutUvarint(w.buf[:], uint64(len(v)))
+	w.write(w.buf[:n])
+	w.write([]byte(v))
+}
+
+type snapshotReader struct {
+	b   []byte
+	err error
+}
+
+func (r *snapshotReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = ErrSnapshotTrunc
+		return nil
+	}
+	ret := r.b[:n]
+	r.b = r.b[n:]
+	return ret
+}
+
+func (r *snapshotReader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *snapshotReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *snapshotReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *snapshotReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	n, k := binary.Uvarint(r.b)
+	if k <= 0 || uint64(len(r.b)-k) < n {
+		r.err = ErrSnapshotTrunc
+		return ""
+	}
+	r.b = r.b[k:]
+	return string(r.next(int(n)))
+}
+
+// WriteSnapshot writes the DB state to fileName. It could be called while
+// the DB is being modified, the mutations are blocked only to get the LSN.
+func (db *DB) WriteSnapshot(fileName string, now time.Time) (SnapshotHeader, error) {
+
+	h := SnapshotHeader{
+		Version: SnapshotVersion,
+		Created: time.Now(),
+		Now:     now,
+	}
+
+	// wait for in-flight mutations, so all records up to h.LSN are applied
+	db.tx.Lock()
+	if w, _ := db.wal.Load().(*WAL); w != nil {
+		h.LSN = w.LSN()
+	}
+	db.tx.Unlock()
+
+	tmpName := fileName + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return h, err
+	}
+	defer os.Remove(tmpName)
+
+	w := &snapshotWriter{
+		w:   bufio.NewWriterSize(f, 1<<20),
+		crc: crc32.New(walTable),
+	}
+
+	w.write([]byte(snapshotMagic))
+	w.uint32(h.Version)
+	w.uint64(uint64(h.Created.UnixNano()))
+	w.uint64(uint64(h.Now.UnixNano()))
+	w.uint64(h.LSN)
+
+	db.s.RangeUsers(func(v models.User) {
+		w.uint32(v.ID)
+		w.uint64(uint64(v.BirthDate))
+		w.uint8([]byte(v.Gender)[0])
+		w.string(v.Email)
+		w.string(v.FirstName)
+		w.string(v.LastName)
+	})
+	w.uint32(0)
+
+	db.s.RangeLocations(func(v models.Location) {
+		w.uint32(v.ID)
+		w.uint32(v.Distance)
+		w.string(v.Place)
+		w.string(v.Country)
+		w.string(v.City)
+	})
+	w.uint32(0)
+
+	db.s.RangeVisits(func(v models.Visit) {
+		w.uint32(v.ID)
+		w.uint32(v.Location)
+		w.uint32(v.User)
+		w.uint64(uint64(v.VisitedAt))
+		w.uint8(v.Mark)
+	})
+	w.uint32(0)
+
+	if w.err == nil {
+		var sum [4]byte
+		binary.LittleEndian.PutUint32(sum[:], w.crc.Sum32())
+		_, w.err = w.w.Write(sum[:])
+	}
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if w.err == nil {
+		w.err = f.Sync()
+	}
+	if err := f.Close(); w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		return h, w.err
+	}
+
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return h, err
+	}
+
+	// the WAL records before h.LSN could be truncated after it
+	return h, syncDir(fileName)
+}
+
+// LoadSnapshot fills an empty DB with the snapshot contents. The snapshot is
+// verified and decoded before anything is loaded, so the DB is modified only
+// if there is no error. The WAL records after h.LSN must be replayed then.
+func (db *DB) LoadSnapshot(fileName string) (h SnapshotHeader, err error) {
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return h, err
+	}
+
+	if len(b) < len(snapshotMagic)+4 || string(b[:len(snapshotMagic)]) != snapshotMagic {
+		return h, ErrSnapshotMagic
+	}
+	sum := binary.LittleEndian.Uint32(b[len(b)-4:])
+	b = b[:len(b)-4]
+	if crc32.Checksum(b, walTable) != sum {
+		return h, ErrSnapshotChecksum
+	}
+
+	r := &snapshotReader{b: b[len(snapshotMagic):]}
+
+	h.Version = r.uint32()
+	if r.err == nil && h.Version != SnapshotVersion {
+		return h, ErrSnapshotVersion
+	}
+	h.Created = time.Unix(0, int64(r.uint64()))
+	h.Now = time.Unix(0, int64(r.uint64())).UTC()
+	h.LSN = r.uint64()
+
+	var (
+		users     []models.User
+		locations []models.Location
+		visits    []models.Visit
+	)
+
+	for id := r.uint32(); id != 0 && r.err == nil; id = r.uint32() {
+		v := models.User{ID: id}
+		v.BirthDate = int64(r.uint64())
+		v.Gender = string([]byte{r.uint8()})
+		v.Email = r.string()
+		v.FirstName = r.string()
+		v.LastName = r.string()
+		users = append(users, v)
+	}
+
+	for id := r.uint32(); id != 0 && r.err == nil; id = r.uint32() {
+		v := models.Location{ID: id}
+		v.Distance = r.uint32()
+		v.Place = r.string()
+		v.Country = r.string()
+		v.City = r.string()
+		locations = append(locations, v)
+	}
+
+	for id := r.uint32(); id != 0 && r.err == nil; id = r.uint32() {
+		v := models.Visit{ID: id}
+		v.Location = r.uint32()
+		v.User = r.uint32()
+		v.VisitedAt = int(int64(r.uint64()))
+		v.Mark = r.uint8()
+		visits = append(visits, v)
+	}
+
+	if r.err == nil && len(r.b) != 0 {
+		r.err = errors.New("snapshot: trailing data")
+	}
+	if r.err != nil {
+		return h, r.err
+	}
+
+	// the conflicts are caused by the mutations made while the snapshot was
+	// written, the WAL records of them restore the skipped entities
+	var skipped int
+	for _, v := range users {
+		unlock := db.emails.lockPair(v.Email, v.Email)
+		if db.addUser(v) != nil {
+			skipped++
+		}
+		unlock()
+	}
+	for _, v := range locations {
+		if db.addLocation(v) != nil {
+			skipped++
+		}
+	}
+	for _, v := range visits {
+		if db.addVisit(v) != nil {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		log.Printf("snapshot: %d records conflict with the later mutations, skipped", skipped)
+	}
+
+	return h, nil
+}
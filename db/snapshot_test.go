@@ -0,0 +1,285 @@
+package db
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+func testSnapshotDB(t *testing.T) *DB {
+	d := New(NewMapStorage())
+	for i := uint32(1); i <= 10; i++ {
+		if err := d.AddUser(testUser(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.AddLocation(models.Location{ID: i, Place: "place", Country: "country", City: "city", Distance: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := uint32(1); i <= 50; i++ {
+		v := models.Visit{ID: i, User: i%10 + 1, Location: i%7 + 1, VisitedAt: int(i * 1000 % 37), Mark: uint8(i % 6)}
+		if err := d.AddVisit(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the indexes are changed by the updates and deletes too
+	if err := d.UpdateVisit(models.Visit{ID: 1, User: 5, Location: 9, VisitedAt: 100, Mark: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateLocation(models.Location{ID: 2, Place: "other", Country: "country", City: "town", Distance: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteUser(3, true); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func sortedUserVisits(d *DB, id uint32) []models.UserVisit {
+	uv := d.GetUserVisits(id)
+	uv.M.RLock()
+	ret := append([]models.UserVisit(nil), uv.Visits...)
+	uv.M.RUnlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Visit < ret[j].Visit })
+	return ret
+}
+
+func sortedLocationMarks(d *DB, id uint32) []models.LocationMark {
+	lm := d.GetLocationMarks(id)
+	lm.M.RLock()
+	ret := append([]models.LocationMark(nil), lm.Marks...)
+	lm.M.RUnlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Visit < ret[j].Visit })
+	for i := range ret {
+		ret[i].BirthDate = ret[i].BirthDate.UTC()
+	}
+	return ret
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "snapshot")
+
+	d := testSnapshotDB(t)
+	now := time.Date(2017, 8, 25, 21, 10, 52, 0, time.UTC)
+
+	h, err := d.WriteSnapshot(fileName, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := New(NewMapStorage())
+	h2, err := loaded.LoadSnapshot(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.Version != SnapshotVersion || !h2.Now.Equal(now) || h2.LSN != h.LSN || !h2.Created.Equal(h.Created) {
+		t.Fatalf("header %+v, expected %+v", h2, h)
+	}
+
+	for id := uint32(1); id <= 50; id++ {
+		if a, b := d.GetUser(id), loaded.GetUser(id); a != b {
+			t.Errorf("user %d: %+v, expected %+v", id, b, a)
+		}
+		if a, b := d.GetLocation(id), loaded.GetLocation(id); a != b {
+			t.Errorf("location %d: %+v, expected %+v", id, b, a)
+		}
+		if a, b := d.GetVisit(id), loaded.GetVisit(id); a != b {
+			t.Errorf("visit %d: %+v, expected %+v", id, b, a)
+		}
+		if a, b := sortedUserVisits(d, id), sortedUserVisits(loaded, id); !reflect.DeepEqual(a, b) {
+			t.Errorf("user visits %d: %+v, expected %+v", id, b, a)
+		}
+		if a, b := sortedLocationMarks(d, id), sortedLocationMarks(loaded, id); !reflect.DeepEqual(a, b) {
+			t.Errorf("location marks %d: %+v, expected %+v", id, b, a)
+		}
+	}
+
+	if a, b := d.Stats(), loaded.Stats(); a != b {
+		t.Errorf("counts %+v, expected %+v", b, a)
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "snapshot")
+
+	if _, err := testSnapshotDB(t).WriteSnapshot(fileName, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []struct {
+		name    string
+		corrupt func([]byte) []byte
+		err     error
+	}{
+		{"magic", func(b []byte) []byte { b[0] = 'X'; return b }, ErrSnapshotMagic},
+		{"checksum", func(b []byte) []byte { b[len(b)/2] ^= 0xff; return b }, ErrSnapshotChecksum},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-10] }, ErrSnapshotChecksum},
+		{"empty", func(b []byte) []byte { return nil }, ErrSnapshotMagic},
+	} {
+		if err := ioutil.WriteFile(fileName, i.corrupt(append([]byte(nil), b...)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		d := New(NewMapStorage())
+		if _, err := d.LoadSnapshot(fileName); err != i.err {
+			t.Errorf("%s: got %v, expected %v", i.name, err, i.err)
+		}
+		if n := d.Stats(); n.Users != 0 || n.Locations != 0 || n.Visits != 0 {
+			t.Errorf("%s: the DB is modified: %+v", i.name, n)
+		}
+	}
+}
+
+// compareDB checks that the entities and the indexes are the same
+func compareDB(t *testing.T, expected, d *DB, maxID uint32) {
+	for id := uint32(1); id <= maxID; id++ {
+		if a, b := expected.GetUser(id), d.GetUser(id); a != b {
+			t.Errorf("user %d: %+v, expected %+v", id, b, a)
+		}
+		if a, b := expected.GetLocation(id), d.GetLocation(id); a != b {
+			t.Errorf("location %d: %+v, expected %+v", id, b, a)
+		}
+		if a, b := expected.GetVisit(id), d.GetVisit(id); a != b {
+			t.Errorf("visit %d: %+v, expected %+v", id, b, a)
+		}
+		if a, b := sortedUserVisits(expected, id), sortedUserVisits(d, id); !reflect.DeepEqual(a, b) {
+			t.Errorf("user visits %d: %+v, expected %+v", id, b, a)
+		}
+		if a, b := sortedLocationMarks(expected, id), sortedLocationMarks(d, id); !reflect.DeepEqual(a, b) {
+			t.Errorf("location marks %d: %+v, expected %+v", id, b, a)
+		}
+	}
+	if a, b := expected.Stats(), d.Stats(); a != b {
+		t.Errorf("stats %+v, expected %+v", b, a)
+	}
+}
+
+func TestSnapshotConcurrentWrites(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "snapshot")
+	walName := filepath.Join(dir, "wal")
+
+	w, err := OpenWAL(WALOptions{Path: walName, Sync: SyncInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := testSnapshotDB(t)
+	d.SetWAL(w)
+
+	const maxID = 200
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := rand.New(rand.NewSource(1))
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := uint32(1 + r.Intn(maxID))
+			switch r.Intn(8) {
+			case 0:
+				d.AddUser(testUser(id))
+			case 1:
+				// the emails move between the users
+				u := d.GetUser(id)
+				if u.IsValid() {
+					u.Email = testUser(uint32(1 + r.Intn(maxID))).Email
+					u.BirthDate = r.Int63n(1 << 30)
+					d.UpdateUser(u)
+				}
+			case 2:
+				d.AddLocation(models.Location{ID: id, Place: "place", Country: "country", City: "city", Distance: id})
+			case 3:
+				d.UpdateLocation(models.Location{ID: id, Place: "moved", Country: "country", City: "town", Distance: uint32(r.Intn(100))})
+			case 4, 5:
+				v := models.Visit{ID: id, User: uint32(1 + r.Intn(maxID)), Location: uint32(1 + r.Intn(maxID)), VisitedAt: r.Intn(1000), Mark: uint8(r.Intn(6))}
+				if d.GetVisit(id).IsValid() {
+					d.UpdateVisit(v)
+				} else {
+					d.AddVisit(v)
+				}
+			case 6:
+				d.DeleteVisit(id)
+			case 7:
+				if r.Intn(4) == 0 {
+					d.DeleteUser(id, true)
+				} else {
+					d.DeleteLocation(id, true)
+				}
+			}
+		}
+	}()
+
+	// waitLSN waits for the mutations to be logged up to the lsn
+	waitLSN := func(lsn uint64) {
+		for n := 0; w.LSN() < lsn; n++ {
+			if n == 1000 {
+				t.Fatalf("lsn %d, expected %d", w.LSN(), lsn)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	var h SnapshotHeader
+	for i := 0; i < 20; i++ {
+		waitLSN(h.LSN + 10)
+		if h, err = d.WriteSnapshot(fileName, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.TruncateWAL(h.LSN); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the mutations after the last snapshot are replayed from the WAL
+	waitLSN(h.LSN + 100)
+	close(stop)
+	<-done
+	if err := d.CloseWAL(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := New(NewMapStorage())
+	if _, err := loaded.LoadSnapshot(fileName); err != nil {
+		t.Fatal(err)
+	}
+	w, err = OpenWAL(WALOptions{Path: walName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, _, err := loaded.ReplayWAL(w, h.LSN); err != nil {
+		t.Fatal(err)
+	}
+
+	compareDB(t, d, loaded, maxID)
+}
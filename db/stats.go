@@ -0,0 +1,49 @@
+package db
+
+import "sync/atomic"
+
+// Stats is the number of stored entities and index entries
+type Stats struct {
+	Users     int64
+	Locations int64
+	Visits    int64
+
+	// Emails is the number of email index entries
+	Emails int
+	// SearchTerms and SearchPostings are the search index sizes
+	SearchTerms    int
+	SearchPostings int
+}
+
+// Stats returns the current DB sizes. The indexes are counted shard by
+// shard, so the numbers are not consistent with each other while the DB is
+// modified.
+func (db *DB) Stats() (ret Stats) {
+	ret.Users = atomic.LoadInt64(&db.users)
+	ret.Locations = atomic.LoadInt64(&db.locations)
+	ret.Visits = atomic.LoadInt64(&db.visits)
+	ret.Emails = db.emails.len()
+	ret.SearchTerms, ret.SearchPostings = db.search.size()
+	return
+}
+
+func (e *emailIndex) len() (n int) {
+	for i := range e.shards {
+		e.lock.RLock(uint32(i))
+		n += len(e.shards[i])
+		e.lock.RUnlock(uint32(i))
+	}
+	return
+}
+
+func (s *searchIndex) size() (terms, postings int) {
+	for i := range s.shards {
+		s.lock.RLock(uint32(i))
+		terms += len(s.shards[i])
+		for _, p := range s.shards[i] {
+			postings += len(p)
+		}
+		s.lock.RUnlock(uint32(i))
+	}
+	return
+}
@@ -0,0 +1,16 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/ei-grad/hlcup/db"
+	"github.com/ei-grad/hlcup/db/storagetest"
+)
+
+func TestArrayStorage(t *testing.T) {
+	storagetest.Run(t, func() db.Storage { return db.NewArrayStorage() })
+}
+
+func TestMapStorage(t *testing.T) {
+	storagetest.Run(t, func() db.Storage { return db.NewMapStorage() })
+}
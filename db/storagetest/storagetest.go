@@ -0,0 +1,344 @@
+// Package storagetest implements the conformance checks every db.Storage
+// backend must pass.
+//
+// A backend test looks like:
+//
+//     func TestMapStorage(t *testing.T) {
+//         storagetest.Run(t, func() db.Storage { return db.NewMapStorage() })
+//     }
+package storagetest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ei-grad/hlcup/db"
+	"github.com/ei-grad/hlcup/models"
+)
+
+// Run runs every check as a subtest against a fresh storage created by
+// newStorage
+func Run(t *testing.T, newStorage func() db.Storage) {
+	for _, i := range []struct {
+		name  string
+		check func(db.Storage) error
+	}{
+		{"entities", checkEntities},
+		{"missing", checkMissing},
+		{"duplicates", checkDuplicates},
+		{"update", checkUpdate},
+		{"indexes", checkIndexes},
+		{"delete", checkDelete},
+		{"range", checkRange},
+		{"large-ids", checkLargeIDs},
+		{"concurrent-add", checkConcurrentAdd},
+		{"db", checkDB},
+	} {
+		check := i.check
+		t.Run(i.name, func(t *testing.T) {
+			if err := check(newStorage()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+var (
+	user     = models.User{ID: 1, Email: "foo@example.com", FirstName: "Иван", LastName: "Петров", Gender: "m", BirthDate: 315532800}
+	location = models.Location{ID: 2, Distance: 10, Place: "Набережная", Country: "Россия", City: "Москва"}
+	visit    = models.Visit{ID: 3, Location: 2, User: 1, VisitedAt: 1000000000, Mark: 4}
+)
+
+func add(s db.Storage) error {
+	if err := s.AddUser(user); err != nil {
+		return fmt.Errorf("AddUser: %s", err)
+	}
+	if err := s.AddLocation(location); err != nil {
+		return fmt.Errorf("AddLocation: %s", err)
+	}
+	if err := s.AddVisit(visit); err != nil {
+		return fmt.Errorf("AddVisit: %s", err)
+	}
+	return nil
+}
+
+func checkEntities(s db.Storage) error {
+	if err := add(s); err != nil {
+		return err
+	}
+	if v := s.GetUser(user.ID); v != user {
+		return fmt.Errorf("GetUser: got %+v, want %+v", v, user)
+	}
+	if v := s.GetLocation(location.ID); v != location {
+		return fmt.Errorf("GetLocation: got %+v, want %+v", v, location)
+	}
+	if v := s.GetVisit(visit.ID); v != visit {
+		return fmt.Errorf("GetVisit: got %+v, want %+v", v, visit)
+	}
+	return nil
+}
+
+func checkMissing(s db.Storage) error {
+	if err := add(s); err != nil {
+		return err
+	}
+	for _, id := range []uint32{0, 4, 1000} {
+		if s.GetUser(id).IsValid() {
+			return fmt.Errorf("GetUser(%d) returned valid user", id)
+		}
+		if s.GetLocation(id).IsValid() {
+			return fmt.Errorf("GetLocation(%d) returned valid location", id)
+		}
+		if s.GetVisit(id).IsValid() {
+			return fmt.Errorf("GetVisit(%d) returned valid visit", id)
+		}
+	}
+	return nil
+}
+
+func checkDuplicates(s db.Storage) error {
+	if err := add(s); err != nil {
+		return err
+	}
+	if err := s.AddUser(models.User{ID: user.ID, Gender: "f"}); err != db.ErrAlreadyExists {
+		return fmt.Errorf("AddUser: got %v, want %s", err, db.ErrAlreadyExists)
+	}
+	if err := s.AddLocation(models.Location{ID: location.ID}); err != db.ErrAlreadyExists {
+		return fmt.Errorf("AddLocation: got %v, want %s", err, db.ErrAlreadyExists)
+	}
+	if err := s.AddVisit(models.Visit{ID: visit.ID}); err != db.ErrAlreadyExists {
+		return fmt.Errorf("AddVisit: got %v, want %s", err, db.ErrAlreadyExists)
+	}
+	if v := s.GetUser(user.ID); v != user {
+		return fmt.Errorf("user is modified by failed AddUser: %+v", v)
+	}
+	return nil
+}
+
+func checkUpdate(s db.Storage) error {
+	if err := add(s); err != nil {
+		return err
+	}
+	u, l, v := user, location, visit
+	u.Email = "bar@example.com"
+	l.Place = "Площадь"
+	v.Mark = 1
+	if err := s.UpdateUser(u); err != nil {
+		return fmt.Errorf("UpdateUser: %s", err)
+	}
+	if err := s.UpdateLocation(l); err != nil {
+		return fmt.Errorf("UpdateLocation: %s", err)
+	}
+	if err := s.UpdateVisit(v); err != nil {
+		return fmt.Errorf("UpdateVisit: %s", err)
+	}
+	if got := s.GetUser(u.ID); got != u {
+		return fmt.Errorf("GetUser: got %+v, want %+v", got, u)
+	}
+	if got := s.GetLocation(l.ID); got != l {
+		return fmt.Errorf("GetLocation: got %+v, want %+v", got, l)
+	}
+	if got := s.GetVisit(v.ID); got != v {
+		return fmt.Errorf("GetVisit: got %+v, want %+v", got, v)
+	}
+	return nil
+}
+
+func checkDelete(s db.Storage) error {
+	if err := add(s); err != nil {
+		return err
+	}
+	if err := s.DeleteUser(user.ID); err != nil {
+		return fmt.Errorf("DeleteUser: %s", err)
+	}
+	if err := s.DeleteLocation(location.ID); err != nil {
+		return fmt.Errorf("DeleteLocation: %s", err)
+	}
+	if err := s.DeleteVisit(visit.ID); err != nil {
+		return fmt.Errorf("DeleteVisit: %s", err)
+	}
+	if s.GetUser(user.ID).IsValid() || s.GetLocation(location.ID).IsValid() || s.GetVisit(visit.ID).IsValid() {
+		return fmt.Errorf("deleted entity is still returned")
+	}
+	if err := s.DeleteUser(user.ID); err != db.ErrNotFound {
+		return fmt.Errorf("DeleteUser of deleted user: got %v, want %s", err, db.ErrNotFound)
+	}
+	if err := s.AddUser(user); err != nil {
+		return fmt.Errorf("AddUser after delete: %s", err)
+	}
+	return nil
+}
+
+func checkIndexes(s db.Storage) error {
+	lm := s.GetLocationMarks(location.ID)
+	if lm == nil || len(lm.Marks) != 0 {
+		return fmt.Errorf("GetLocationMarks: expected empty entry, got %+v", lm)
+	}
+	lm.Add(models.LocationMark{Visit: visit.ID})
+	if got := s.GetLocationMarks(location.ID); got != lm {
+		return fmt.Errorf("GetLocationMarks: returned different entries for the same id")
+	}
+	uv := s.GetUserVisits(user.ID)
+	if uv == nil || len(uv.Visits) != 0 {
+		return fmt.Errorf("GetUserVisits: expected empty entry, got %+v", uv)
+	}
+	uv.Add(models.UserVisit{Visit: visit.ID})
+	if got := s.GetUserVisits(user.ID); got != uv {
+		return fmt.Errorf("GetUserVisits: returned different entries for the same id")
+	}
+	return nil
+}
+
+func checkRange(s db.Storage) error {
+	const n = 100
+	for i := uint32(1); i <= n; i++ {
+		s.AddUser(models.User{ID: i, Gender: "f"})
+		s.AddLocation(models.Location{ID: i})
+		s.AddVisit(models.Visit{ID: i, User: i, Location: i})
+		s.GetLocationMarks(i)
+		s.GetUserVisits(i)
+	}
+	seen := map[string]map[uint32]bool{}
+	mark := func(kind string, id uint32) {
+		if seen[kind] == nil {
+			seen[kind] = map[uint32]bool{}
+		}
+		seen[kind][id] = true
+	}
+	s.RangeUsers(func(v models.User) { mark("users", v.ID) })
+	s.RangeLocations(func(v models.Location) { mark("locations", v.ID) })
+	s.RangeVisits(func(v models.Visit) { mark("visits", v.ID) })
+	s.RangeLocationMarks(func(id uint32, _ *models.LocationMarks) { mark("location marks", id) })
+	s.RangeUserVisits(func(id uint32, _ *models.UserVisits) { mark("user visits", id) })
+	for _, kind := range []string{"users", "locations", "visits", "location marks", "user visits"} {
+		if len(seen[kind]) != n {
+			return fmt.Errorf("expected %d %s, got %d", n, kind, len(seen[kind]))
+		}
+	}
+	return nil
+}
+
+func checkLargeIDs(s db.Storage) error {
+	for _, id := range []uint32{1 << 20, 1<<31 + 5, 1<<32 - 1} {
+		u := models.User{ID: id, Gender: "m"}
+		if err := s.AddUser(u); err != nil {
+			return fmt.Errorf("AddUser(%d): %s", id, err)
+		}
+		if got := s.GetUser(id); got != u {
+			return fmt.Errorf("GetUser(%d): got %+v, want %+v", id, got, u)
+		}
+		if s.GetUser(id - 1).IsValid() {
+			return fmt.Errorf("GetUser(%d) returned valid user", id-1)
+		}
+		if err := s.AddVisit(models.Visit{ID: id}); err != nil {
+			return fmt.Errorf("AddVisit(%d): %s", id, err)
+		}
+		s.GetUserVisits(id).Add(models.UserVisit{Visit: id})
+		if n := len(s.GetUserVisits(id).Visits); n != 1 {
+			return fmt.Errorf("GetUserVisits(%d): expected 1 visit, got %d", id, n)
+		}
+	}
+	return nil
+}
+
+func checkConcurrentAdd(s db.Storage) error {
+	const n = 16
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		successes int
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if s.AddUser(models.User{ID: 7, FirstName: fmt.Sprint(i), Gender: "m"}) == nil {
+				mu.Lock()
+				successes++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if successes != 1 {
+		return fmt.Errorf("%d concurrent AddUser calls succeeded, want 1", successes)
+	}
+	return nil
+}
+
+// checkDB runs the storage behind db.DB to check the index maintenance
+func checkDB(s db.Storage) error {
+	d := db.New(s)
+	if err := d.AddUser(user); err != nil {
+		return fmt.Errorf("AddUser: %s", err)
+	}
+	if err := d.AddLocation(location); err != nil {
+		return fmt.Errorf("AddLocation: %s", err)
+	}
+	if err := d.AddVisit(visit); err != nil {
+		return fmt.Errorf("AddVisit: %s", err)
+	}
+	l := location
+	l.ID = 5
+	if err := d.AddLocation(l); err != nil {
+		return fmt.Errorf("AddLocation: %s", err)
+	}
+	v := visit
+	v.Location = l.ID
+	if err := d.UpdateVisit(v); err != nil {
+		return fmt.Errorf("UpdateVisit: %s", err)
+	}
+	if n := len(d.GetLocationMarks(location.ID).Marks); n != 0 {
+		return fmt.Errorf("old location still has %d marks", n)
+	}
+	if marks := d.GetLocationMarks(l.ID).Marks; len(marks) != 1 || marks[0].Visit != v.ID {
+		return fmt.Errorf("new location marks: %+v", marks)
+	}
+	if visits := d.GetUserVisits(user.ID).Visits; len(visits) != 1 || visits[0].Location != l.ID {
+		return fmt.Errorf("user visits: %+v", visits)
+	}
+	if got := d.GetUserByEmail(user.Email); got != user {
+		return fmt.Errorf("GetUserByEmail: got %+v, want %+v", got, user)
+	}
+	if err := d.AddUser(models.User{ID: 100, Email: user.Email, Gender: "f", FirstName: "a", LastName: "b"}); err != db.ErrEmailExists {
+		return fmt.Errorf("AddUser with used email: got %v, want %s", err, db.ErrEmailExists)
+	}
+	if got := d.SearchLocations("ЁЛКИ", 10); len(got) != 0 {
+		return fmt.Errorf("SearchLocations: unexpected %+v", got)
+	}
+	l.Place = "Ёлки у Кремля"
+	if err := d.UpdateLocation(l); err != nil {
+		return fmt.Errorf("UpdateLocation: %s", err)
+	}
+	if got := d.SearchLocations("елки", 10); len(got) != 1 || got[0].ID != l.ID {
+		return fmt.Errorf("SearchLocations: got %+v", got)
+	}
+	u := user
+	u.Email = "bar@example.com"
+	if err := d.UpdateUser(u); err != nil {
+		return fmt.Errorf("UpdateUser: %s", err)
+	}
+	if d.GetUserByEmail(user.Email).IsValid() || d.GetUserByEmail(u.Email).ID != u.ID {
+		return fmt.Errorf("email index is not updated")
+	}
+	if err := d.DeleteUser(user.ID, false); err != db.ErrReferenced {
+		return fmt.Errorf("DeleteUser without cascade: got %v, want %s", err, db.ErrReferenced)
+	}
+	if err := d.DeleteLocation(l.ID, true); err != nil {
+		return fmt.Errorf("DeleteLocation: %s", err)
+	}
+	if d.GetVisit(v.ID).IsValid() {
+		return fmt.Errorf("visit is not deleted by cascade")
+	}
+	if n := len(d.GetUserVisits(user.ID).Visits); n != 0 {
+		return fmt.Errorf("user still has %d visits", n)
+	}
+	if err := d.DeleteUser(user.ID, false); err != nil {
+		return fmt.Errorf("DeleteUser: %s", err)
+	}
+	if d.GetUserByEmail(u.Email).IsValid() {
+		return fmt.Errorf("email of deleted user is still indexed")
+	}
+	return nil
+}
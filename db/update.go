@@ -16,7 +16,37 @@ func (db *DB) UpdateUser(v models.User) error {
 		return err
 	}
 
+	db.tx.RLock()
+	defer db.tx.RUnlock()
+	db.lockU.Lock(v.ID)
+	defer db.lockU.Unlock(v.ID)
+
+	if !db.s.GetUser(v.ID).IsValid() {
+		return ErrNotFound
+	}
+
+	unlock := db.emails.lockPair(db.GetUser(v.ID).Email, v.Email)
+	defer unlock()
+
+	if err = db.emails.check(v.Email, v.ID); err != nil {
+		return err
+	}
+
+	if err = db.log(opUpdateUser, &v); err != nil {
+		return err
+	}
+
+	return db.updateUser(v)
+}
+
+// updateUser updates the entity and indexes, the caller is responsible for
+// locking (including the old and new email shards) and logging
+func (db *DB) updateUser(v models.User) error {
+
 	old := db.GetUser(v.ID)
+	if !old.IsValid() {
+		return ErrNotFound
+	}
 
 	if old.BirthDate != v.BirthDate || old.Gender != v.Gender {
 		userLocations := map[uint32]struct{}{}
@@ -31,17 +61,27 @@ func (db *DB) UpdateUser(v models.User) error {
 			lm.M.Lock()
 			for i := range lm.Marks {
 				if lm.Marks[i].User == v.ID {
-					lm.Marks[i].BirthDate = time.Unix(v.BirthDate, 0)
-					lm.Marks[i].Gender = []byte(v.Gender)[0]
+					m := lm.Marks[i]
+					m.BirthDate = time.Unix(v.BirthDate, 0)
+					m.Gender = []byte(v.Gender)[0]
+					lm.Set(i, m)
 				}
 			}
 			lm.M.Unlock()
+			db.invalidateLocationMarks(i)
 		}
 	}
 
-	db.lockU.Lock(v.ID)
-	db.users[v.ID] = v
-	db.lockU.Unlock(v.ID)
+	if err := db.s.UpdateUser(v); err != nil {
+		return err
+	}
+
+	if old.Email != v.Email {
+		db.emails.del(old.Email, v.ID)
+		db.emails.set(v.Email, v.ID)
+	}
+
+	db.invalidateUser(v.ID)
 
 	return nil
 }
@@ -54,9 +94,30 @@ func (db *DB) UpdateLocation(v models.Location) error {
 		return err
 	}
 
+	db.tx.RLock()
+	defer db.tx.RUnlock()
+	db.lockL.Lock(v.ID)
+	defer db.lockL.Unlock(v.ID)
+
+	if !db.s.GetLocation(v.ID).IsValid() {
+		return ErrNotFound
+	}
+
+	if err = db.log(opUpdateLocation, &v); err != nil {
+		return err
+	}
+
+	return db.updateLocation(v)
+}
+
+func (db *DB) updateLocation(v models.Location) error {
+
 	old := db.GetLocation(v.ID)
+	if !old.IsValid() {
+		return ErrNotFound
+	}
 
-	if old.Place != v.Place || old.Country != v.Country || old.Distance != v.Distance {
+	if old.Place != v.Place || old.Country != v.Country || old.City != v.City || old.Distance != v.Distance {
 		locationUsers := map[uint32]struct{}{}
 		lm := db.GetLocationMarks(v.ID)
 		lm.M.RLock()
@@ -71,17 +132,22 @@ func (db *DB) UpdateLocation(v models.Location) error {
 				if i.Location == v.ID {
 					i.Place = v.Place
 					i.Country = v.Country
+					i.City = v.City
 					i.Distance = v.Distance
 					uv.Visits[n] = i
 				}
 			}
 			uv.M.Unlock()
+			db.invalidateUserVisits(i)
 		}
 	}
 
-	db.lockL.Lock(v.ID)
-	db.locations[v.ID] = v
-	db.lockL.Unlock(v.ID)
+	if err := db.s.UpdateLocation(v); err != nil {
+		return err
+	}
+
+	db.search.update(old, v)
+	db.invalidateLocation(v.ID)
 
 	return nil
 }
@@ -94,7 +160,35 @@ func (db *DB) UpdateVisit(v models.Visit) error {
 		return err
 	}
 
+	db.tx.RLock()
+	defer db.tx.RUnlock()
+	db.lockV.Lock(v.ID)
+	defer db.lockV.Unlock(v.ID)
+
+	if !db.s.GetVisit(v.ID).IsValid() {
+		return ErrNotFound
+	}
+	if err = db.checkVisitRefs(v); err != nil {
+		return err
+	}
+
+	if err = db.log(opUpdateVisit, &v); err != nil {
+		return err
+	}
+
+	return db.updateVisit(v)
+}
+
+func (db *DB) updateVisit(v models.Visit) error {
+
 	old := db.GetVisit(v.ID)
+	if !old.IsValid() {
+		return ErrNotFound
+	}
+	// the indexes can't be moved to the missing user or location
+	if err := db.checkVisitRefs(v); err != nil {
+		return err
+	}
 
 	// move visit to new user
 	if old.User != v.User {
@@ -121,14 +215,14 @@ func (db *DB) UpdateVisit(v models.Visit) error {
 	lm.M.Lock()
 	for n, i := range lm.Marks {
 		if i.Visit == v.ID {
-			lm.Marks[n] = models.LocationMark{
+			lm.Set(n, models.LocationMark{
 				Visit:     v.ID,
 				User:      v.User,
 				VisitedAt: v.VisitedAt,
 				BirthDate: time.Unix(user.BirthDate, 0),
 				Mark:      v.Mark,
 				Gender:    []byte(user.Gender)[0],
-			}
+			})
 			break
 		}
 	}
@@ -146,6 +240,7 @@ func (db *DB) UpdateVisit(v models.Visit) error {
 				VisitedAt: v.VisitedAt,
 				Place:     location.Place,
 				Country:   location.Country,
+				City:      location.City,
 				Distance:  location.Distance,
 			}
 			uv.Visits[n] = visit
@@ -155,9 +250,14 @@ func (db *DB) UpdateVisit(v models.Visit) error {
 	sort.Sort(models.UserVisitByVisitedAt(uv.Visits))
 	uv.M.Unlock()
 
-	db.lockV.Lock(v.ID)
-	db.visits[v.ID] = v
-	db.lockV.Unlock(v.ID)
+	if err := db.s.UpdateVisit(v); err != nil {
+		return err
+	}
+
+	db.invalidateUserVisits(old.User)
+	db.invalidateUserVisits(v.User)
+	db.invalidateLocationMarks(old.Location)
+	db.invalidateLocationMarks(v.Location)
 
 	return nil
 }
@@ -7,6 +7,16 @@ import (
 	"github.com/ei-grad/hlcup/models"
 )
 
+func (db *DB) checkVisitRefs(v models.Visit) error {
+	if !db.GetLocation(v.Location).IsValid() {
+		return fmt.Errorf("location with id %d doesn't exist", v.Location)
+	}
+	if !db.GetUser(v.User).IsValid() {
+		return fmt.Errorf("user with id %d doesn't exist", v.User)
+	}
+	return nil
+}
+
 func (db *DB) AddVisitToIndex(v models.Visit) error {
 
 	location := db.GetLocation(v.Location)
@@ -37,10 +47,14 @@ func (db *DB) AddVisitToIndex(v models.Visit) error {
 		VisitedAt: v.VisitedAt,
 		Place:     location.Place,
 		Country:   location.Country,
+		City:      location.City,
 		Distance:  location.Distance,
 	}
 	db.GetUserVisits(v.User).Add(uv)
 
+	db.invalidateUserVisits(v.User)
+	db.invalidateLocationMarks(v.Location)
+
 	return nil
 
 }
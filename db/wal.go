@@ -0,0 +1,567 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mailru/easyjson"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+// WAL record layout:
+//
+//     length uint32 - length of the body
+//     crc    uint32 - CRC-32C of the body
+//     body:
+//         lsn uint64 - log sequence number
+//         op  byte   - one of the op* constants
+//         payload    - JSON-encoded entity, or op specific binary data
+//
+// All integers are little-endian.
+const (
+	walHeaderSize  = 8
+	walBodyPrefix  = 9
+	walMaxBodySize = 1 << 24
+)
+
+const (
+	opAddUser byte = iota + 1
+	opAddLocation
+	opAddVisit
+	opUpdateUser
+	opUpdateLocation
+	opUpdateVisit
+	opBatch
+	opDeleteUser
+	opDeleteLocation
+	opDeleteVisit
+)
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrWALCorrupt = errors.New("wal: corrupt record")
+
+// ErrWALClosed is returned by the mutations after the log is closed
+var ErrWALClosed = errors.New("wal: closed")
+
+// ErrWALTruncated is returned by ReplayWAL if the records it needs are
+// truncated after the snapshot
+var ErrWALTruncated = errors.New("wal: the records before the snapshot are truncated")
+
+// errStopScan stops the scan at the record
+var errStopScan = errors.New("wal: stop scan")
+
+// SyncPolicy defines when the WAL file is fsync'ed
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every record
+	SyncAlways SyncPolicy = iota
+	// SyncBatch fsyncs after every BatchSize records, the partial batch is
+	// fsync'ed in background after Interval
+	SyncBatch
+	// SyncInterval fsyncs in background every Interval
+	SyncInterval
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "batch":
+		return SyncBatch, nil
+	case "interval":
+		return SyncInterval, nil
+	}
+	return 0, fmt.Errorf("unknown wal sync policy: %q", s)
+}
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncBatch:
+		return "batch"
+	case SyncInterval:
+		return "interval"
+	}
+	return "unknown"
+}
+
+// WALOptions configures the write-ahead log
+type WALOptions struct {
+	Path      string
+	Sync      SyncPolicy
+	BatchSize int
+	Interval  time.Duration
+}
+
+// WAL is an append-only write-ahead log of accepted DB mutations
+type WAL struct {
+	opts WALOptions
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	lsn     uint64
+	pending int
+	err     error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenWAL opens or creates the log file. A torn record at the end of the
+// file is cut off.
+func OpenWAL(opts WALOptions) (*WAL, error) {
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 64
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 100 * time.Millisecond
+	}
+
+	f, err := os.OpenFile(opts.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{opts: opts, f: f}
+
+	end, err := w.scan(func(lsn uint64, op byte, payload []byte) error {
+		w.lsn = lsn
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st, err := f.Stat(); err != nil {
+		f.Close()
+		return nil, err
+	} else if st.Size() > end {
+		log.Printf("wal: %s: cutting off torn tail of %d bytes at offset %d",
+			opts.Path, st.Size()-end, end)
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	w.w = bufio.NewWriterSize(f, 64*1024)
+
+	if opts.Sync == SyncInterval || opts.Sync == SyncBatch {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncer()
+	}
+
+	return w, nil
+}
+
+// scan reads the log from the beginning, calls f for every valid record and
+// returns the offset where valid records end. If f returns errStopScan the
+// offset of the record is returned.
+func (w *WAL) scan(f func(lsn uint64, op byte, payload []byte) error) (int64, error) {
+
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReaderSize(w.f, 64*1024)
+
+	var (
+		offset int64
+		header [walHeaderSize]byte
+		body   []byte
+	)
+
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		if length < walBodyPrefix || length > walMaxBodySize {
+			if _, err := r.Peek(1); err == io.EOF {
+				// garbage in the last header, treat as torn
+				return offset, nil
+			}
+			return offset, fmt.Errorf("%s at offset %d: bad length %d", ErrWALCorrupt, offset, length)
+		}
+		if cap(body) < int(length) {
+			body = make([]byte, length)
+		}
+		body = body[:length]
+		if _, err := io.ReadFull(r, body); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		if crc32.Checksum(body, walTable) != sum {
+			if _, err := r.Peek(1); err == io.EOF {
+				return offset, nil
+			}
+			return offset, fmt.Errorf("%s at offset %d: checksum mismatch", ErrWALCorrupt, offset)
+		}
+		lsn := binary.LittleEndian.Uint64(body[0:8])
+		if err := f(lsn, body[8], body[walBodyPrefix:]); err != nil {
+			return offset, err
+		}
+		offset += walHeaderSize + int64(length)
+	}
+}
+
+// LSN returns the sequence number of the last written record
+func (w *WAL) LSN() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lsn
+}
+
+// Append writes the record and syncs it according to the sync policy
+func (w *WAL) Append(op byte, v easyjson.Marshaler) error {
+	payload, err := easyjson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.append(op, payload)
+}
+
+func (w *WAL) append(op byte, payload []byte) error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	body := make([]byte, walBodyPrefix+len(payload))
+	binary.LittleEndian.PutUint64(body[0:8], w.lsn+1)
+	body[8] = op
+	copy(body[walBodyPrefix:], payload)
+
+	var header [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(body)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(body, walTable))
+
+	if _, err := w.w.Write(header[:]); err != nil {
+		w.err = err
+		return err
+	}
+	if _, err := w.w.Write(body); err != nil {
+		w.err = err
+		return err
+	}
+	w.lsn++
+	w.pending++
+
+	switch w.opts.Sync {
+	case SyncAlways:
+		return w.sync()
+	case SyncBatch:
+		if w.pending >= w.opts.BatchSize {
+			return w.sync()
+		}
+	}
+
+	return nil
+}
+
+// sync must be called with w.mu held
+func (w *WAL) sync() error {
+	if w.pending == 0 {
+		return nil
+	}
+	if err := w.w.Flush(); err != nil {
+		w.err = err
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.err = err
+		return err
+	}
+	w.pending = 0
+	return nil
+}
+
+// Sync flushes and fsyncs all pending records
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.sync()
+}
+
+// Truncate removes the records before lsn, they must be in the snapshot
+// already. The record at lsn is kept, so the sequence numbers continue after
+// the log is reopened. The rest of the log is copied to a new file which
+// replaces it, the appends wait meanwhile.
+func (w *WAL) Truncate(lsn uint64) error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+
+	from, err := w.scan(func(l uint64, op byte, payload []byte) error {
+		if l >= lsn {
+			return errStopScan
+		}
+		return nil
+	})
+	if err == errStopScan && from > 0 {
+		return w.replace(from)
+	}
+	if err == errStopScan {
+		// the record at lsn is the first one
+		err = nil
+	}
+	// nothing is truncated, the writes continue at the end
+	return w.seekEnd(err)
+}
+
+// replace replaces the log file with its tail starting at offset, it must be
+// called with w.mu held
+func (w *WAL) replace(offset int64) error {
+
+	tmpName := w.opts.Path + ".tmp"
+	tmp, err := os.Create(tmpName)
+	if err != nil {
+		return w.seekEnd(err)
+	}
+	defer os.Remove(tmpName)
+	if _, err = w.f.Seek(offset, io.SeekStart); err == nil {
+		_, err = io.Copy(tmp, w.f)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, w.opts.Path)
+	}
+	if err != nil {
+		// the log is not replaced, continue writing to it
+		return w.seekEnd(err)
+	}
+
+	// the old file is renamed over, the records can't be written to it
+	w.f.Close()
+	f, err := os.OpenFile(w.opts.Path, os.O_RDWR, 0644)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.f = f
+	w.w.Reset(f)
+
+	return syncDir(w.opts.Path)
+}
+
+// seekEnd moves to the end of the log file to continue writing after err
+func (w *WAL) seekEnd(err error) error {
+	if _, serr := w.f.Seek(0, io.SeekEnd); serr != nil {
+		w.err = serr
+		return serr
+	}
+	return err
+}
+
+// syncDir fsyncs the directory of the file, so the file rename is durable
+func syncDir(fileName string) error {
+	d, err := os.Open(filepath.Dir(fileName))
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *WAL) syncer() {
+	defer close(w.done)
+	t := time.NewTicker(w.opts.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := w.Sync(); err != nil {
+				log.Print("wal: sync failed: ", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Close syncs pending records and closes the log file
+func (w *WAL) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == ErrWALClosed {
+		return nil
+	}
+	err := w.err
+	if err == nil {
+		err = w.sync()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.err = ErrWALClosed
+	return err
+}
+
+// ReplayWAL applies records with LSN greater than fromLSN on top of the
+// current DB state. It must be called before the log is attached with SetWAL.
+// ErrWALTruncated is returned if the log starts after fromLSN+1, the records
+// before it are only in the snapshot.
+// The updates of missing entities are applied as adds, they are the entities
+// skipped while loading the fuzzy snapshot. The visits referencing missing
+// entities are removed, as the later cascade delete did.
+func (db *DB) ReplayWAL(w *WAL, fromLSN uint64) (applied, failed int, err error) {
+	first := true
+	_, err = w.scan(func(lsn uint64, op byte, payload []byte) error {
+		if first && lsn > fromLSN+1 {
+			return ErrWALTruncated
+		}
+		first = false
+		if lsn <= fromLSN {
+			return nil
+		}
+		if err := db.applyWAL(op, payload); err != nil {
+			if err == ErrWALCorrupt {
+				return fmt.Errorf("%s: lsn %d", err, lsn)
+			}
+			failed++
+			return nil
+		}
+		applied++
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	_, err = w.f.Seek(0, io.SeekEnd)
+	return
+}
+
+func (db *DB) applyWAL(op byte, payload []byte) error {
+	switch op {
+	case opAddUser, opUpdateUser:
+		var v models.User
+		if err := v.UnmarshalJSON(payload); err != nil {
+			return ErrWALCorrupt
+		}
+		if op == opAddUser || !db.GetUser(v.ID).IsValid() {
+			return db.AddUser(v)
+		}
+		return db.UpdateUser(v)
+	case opAddLocation, opUpdateLocation:
+		var v models.Location
+		if err := v.UnmarshalJSON(payload); err != nil {
+			return ErrWALCorrupt
+		}
+		if op == opAddLocation || !db.GetLocation(v.ID).IsValid() {
+			return db.AddLocation(v)
+		}
+		return db.UpdateLocation(v)
+	case opAddVisit, opUpdateVisit:
+		var v models.Visit
+		if err := v.UnmarshalJSON(payload); err != nil {
+			return ErrWALCorrupt
+		}
+		if err := db.checkVisitRefs(v); err != nil {
+			// the referenced entity is deleted by a later record, its
+			// cascade removes the visit, but the entity could be missing in
+			// the fuzzy snapshot already
+			db.DeleteVisit(v.ID)
+			return err
+		}
+		if op == opAddVisit || !db.GetVisit(v.ID).IsValid() {
+			return db.AddVisit(v)
+		}
+		return db.UpdateVisit(v)
+	case opBatch:
+		return db.applyWALBatch(payload)
+	case opDeleteUser, opDeleteLocation, opDeleteVisit:
+		return db.applyWALDelete(op, payload)
+	}
+	return ErrWALCorrupt
+}
+
+// SetWAL attaches the log, every following mutation is written to it before
+// it becomes visible
+func (db *DB) SetWAL(w *WAL) {
+	db.wal.Store(w)
+}
+
+// TruncateWAL removes the records of the attached log before the snapshot
+// LSN, see WAL.Truncate
+func (db *DB) TruncateWAL(lsn uint64) error {
+	w, _ := db.wal.Load().(*WAL)
+	if w == nil {
+		return nil
+	}
+	return w.Truncate(lsn)
+}
+
+// CloseWAL waits for the in-flight mutations and closes the attached log, the
+// following mutations fail with ErrWALClosed
+func (db *DB) CloseWAL() error {
+	db.tx.Lock()
+	defer db.tx.Unlock()
+	w, _ := db.wal.Load().(*WAL)
+	if w == nil {
+		return nil
+	}
+	return w.Close()
+}
+
+func (db *DB) log(op byte, v easyjson.Marshaler) error {
+	w, _ := db.wal.Load().(*WAL)
+	if w == nil {
+		return nil
+	}
+	return w.Append(op, v)
+}
@@ -0,0 +1,331 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ei-grad/hlcup/models"
+)
+
+func testUser(id uint32) models.User {
+	return models.User{
+		ID:        id,
+		Email:     fmt.Sprintf("user%d@example.com", id),
+		FirstName: "First",
+		LastName:  "Last",
+		Gender:    "m",
+		BirthDate: int64(id) * 86400,
+	}
+}
+
+// writeTestWAL writes n user records and returns the log file name and the
+// offsets of the records ends
+func writeTestWAL(t *testing.T, n int) (string, []int64) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "wal")
+	w, err := OpenWAL(WALOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(NewMapStorage())
+	d.SetWAL(w)
+	var ends []int64
+	for i := 1; i <= n; i++ {
+		if err := d.AddUser(testUser(uint32(i))); err != nil {
+			t.Fatal(err)
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, st.Size())
+	}
+	if err := d.CloseWAL(); err != nil {
+		t.Fatal(err)
+	}
+	return path, ends
+}
+
+func replayTestWAL(t *testing.T, path string, fromLSN uint64) (*DB, *WAL, int, int) {
+	w, err := OpenWAL(WALOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(NewMapStorage())
+	applied, failed, err := d.ReplayWAL(w, fromLSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, w, applied, failed
+}
+
+func TestWALReplay(t *testing.T) {
+	path, _ := writeTestWAL(t, 5)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	d, w, applied, failed := replayTestWAL(t, path, 0)
+	w.Close()
+	if applied != 5 || failed != 0 {
+		t.Fatalf("applied %d, failed %d, expected 5 and 0", applied, failed)
+	}
+	for i := uint32(1); i <= 5; i++ {
+		if u := d.GetUser(i); u != testUser(i) {
+			t.Fatalf("user %d: %+v", i, u)
+		}
+	}
+
+	d, w, applied, failed = replayTestWAL(t, path, 3)
+	w.Close()
+	if applied != 2 || failed != 0 {
+		t.Fatalf("from lsn 3: applied %d, failed %d, expected 2 and 0", applied, failed)
+	}
+	for i := uint32(1); i <= 5; i++ {
+		if d.GetUser(i).IsValid() != (i > 3) {
+			t.Fatalf("from lsn 3: user %d is replayed: %v", i, d.GetUser(i).IsValid())
+		}
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	path, ends := writeTestWAL(t, 5)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// the last record is partially written
+	if err := os.Truncate(path, ends[4]-3); err != nil {
+		t.Fatal(err)
+	}
+
+	d, w, applied, failed := replayTestWAL(t, path, 0)
+	if applied != 4 || failed != 0 {
+		t.Fatalf("applied %d, failed %d, expected 4 and 0", applied, failed)
+	}
+	if d.GetUser(5).IsValid() {
+		t.Fatal("user 5 of the torn record is replayed")
+	}
+	if st, err := os.Stat(path); err != nil || st.Size() != ends[3] {
+		t.Fatalf("torn tail is not cut off: %v %v", st.Size(), err)
+	}
+
+	// the following records continue the sequence after the cut
+	d.SetWAL(w)
+	if err := d.AddUser(testUser(6)); err != nil {
+		t.Fatal(err)
+	}
+	if w.LSN() != 5 {
+		t.Fatalf("lsn after the cut is %d, expected 5", w.LSN())
+	}
+	if err := d.CloseWAL(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, w, applied, _ = replayTestWAL(t, path, 0)
+	w.Close()
+	if applied != 5 || !d.GetUser(6).IsValid() {
+		t.Fatalf("applied %d after append, expected 5", applied)
+	}
+}
+
+func TestWALChecksumMismatch(t *testing.T) {
+	path, ends := writeTestWAL(t, 5)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt payload of the last record is treated as torn
+	last := append([]byte(nil), b...)
+	last[len(last)-2] ^= 0xff
+	if err := ioutil.WriteFile(path, last, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, w, applied, _ := replayTestWAL(t, path, 0)
+	w.Close()
+	if applied != 4 || d.GetUser(5).IsValid() {
+		t.Fatalf("applied %d, expected 4", applied)
+	}
+	if st, err := os.Stat(path); err != nil || st.Size() != ends[3] {
+		t.Fatalf("corrupt tail is not cut off: %v %v", st.Size(), err)
+	}
+
+	// corrupt record in the middle is an error, nothing is cut off
+	middle := append([]byte(nil), b...)
+	middle[ends[1]-2] ^= 0xff
+	if err := ioutil.WriteFile(path, middle, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWAL(WALOptions{Path: path}); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if st, err := os.Stat(path); err != nil || st.Size() != int64(len(b)) {
+		t.Fatalf("log with corrupt record in the middle is modified: %v %v", st.Size(), err)
+	}
+}
+
+func TestWALRejectedUpdateVisit(t *testing.T) {
+	path, _ := writeTestWAL(t, 1)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	d, w, _, _ := replayTestWAL(t, path, 0)
+	d.SetWAL(w)
+	defer d.CloseWAL()
+
+	if err := d.AddLocation(models.Location{ID: 1, Place: "p", Country: "c", City: "m", Distance: 1}); err != nil {
+		t.Fatal(err)
+	}
+	v := models.Visit{ID: 1, User: 1, Location: 1, VisitedAt: 1, Mark: 3}
+	if err := d.AddVisit(v); err != nil {
+		t.Fatal(err)
+	}
+	lsn := w.LSN()
+
+	for _, i := range []models.Visit{
+		{ID: 1, User: 2, Location: 1, VisitedAt: 1, Mark: 3},
+		{ID: 1, User: 1, Location: 2, VisitedAt: 1, Mark: 3},
+		{ID: 2, User: 1, Location: 1, VisitedAt: 1, Mark: 3},
+	} {
+		if err := d.UpdateVisit(i); err == nil {
+			t.Fatalf("update to %+v is accepted", i)
+		}
+	}
+	if w.LSN() != lsn {
+		t.Fatalf("rejected updates are logged, lsn %d, expected %d", w.LSN(), lsn)
+	}
+	if d.GetVisit(1) != v {
+		t.Fatalf("visit is modified: %+v", d.GetVisit(1))
+	}
+}
+
+func TestWALRejectedUpdateMissing(t *testing.T) {
+	path, _ := writeTestWAL(t, 1)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	d, w, _, _ := replayTestWAL(t, path, 0)
+	d.SetWAL(w)
+	defer d.CloseWAL()
+
+	lsn := w.LSN()
+	stats := d.Stats()
+
+	if err := d.UpdateUser(testUser(2)); err != ErrNotFound {
+		t.Fatalf("update of missing user: %v", err)
+	}
+	if err := d.UpdateLocation(models.Location{ID: 1, Place: "p", Country: "c", City: "m", Distance: 1}); err != ErrNotFound {
+		t.Fatalf("update of missing location: %v", err)
+	}
+	if w.LSN() != lsn {
+		t.Fatalf("rejected updates are logged, lsn %d, expected %d", w.LSN(), lsn)
+	}
+	if d.GetUser(2).IsValid() || d.GetLocation(1).IsValid() {
+		t.Fatal("missing entities are created by update")
+	}
+	if d.Stats() != stats {
+		t.Fatalf("stats %+v, expected %+v", d.Stats(), stats)
+	}
+}
+
+func TestWALTruncate(t *testing.T) {
+	path, ends := writeTestWAL(t, 5)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	d, w, _, _ := replayTestWAL(t, path, 0)
+	d.SetWAL(w)
+
+	// nothing is before the first record
+	if err := d.TruncateWAL(1); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(path); err != nil || st.Size() != ends[4] {
+		t.Fatalf("log is truncated up to the first record: %v %v", st.Size(), err)
+	}
+
+	// the snapshot is at lsn 3
+	if err := d.TruncateWAL(3); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(path); err != nil || st.Size() != ends[4]-ends[1] {
+		t.Fatalf("log size %v %v, expected %d", st.Size(), err, ends[4]-ends[1])
+	}
+	// the writes continue to the truncated log
+	if err := d.AddUser(testUser(6)); err != nil {
+		t.Fatal(err)
+	}
+	if w.LSN() != 6 {
+		t.Fatalf("lsn after truncate is %d, expected 6", w.LSN())
+	}
+
+	// the last record is kept to continue the sequence numbers
+	if err := d.TruncateWAL(6); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddUser(testUser(7)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CloseWAL(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, w, applied, failed := replayTestWAL(t, path, 6)
+	if applied != 1 || failed != 0 || !replayed.GetUser(7).IsValid() {
+		t.Fatalf("applied %d, failed %d, expected 1 and 0", applied, failed)
+	}
+	if w.LSN() != 7 {
+		t.Fatalf("lsn after reopen is %d, expected 7", w.LSN())
+	}
+	w.Close()
+
+	// the records before the snapshot are required without it
+	for _, lsn := range []uint64{0, 4} {
+		w, err := OpenWAL(WALOptions{Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := New(NewMapStorage()).ReplayWAL(w, lsn); err != ErrWALTruncated {
+			t.Errorf("replay from lsn %d: %v", lsn, err)
+		}
+		w.Close()
+	}
+}
+
+func TestWALSyncBatchTimer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wal")
+
+	w, err := OpenWAL(WALOptions{Path: path, Sync: SyncBatch, BatchSize: 100, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	u := testUser(1)
+	if err := w.Append(opAddUser, &u); err != nil {
+		t.Fatal(err)
+	}
+
+	// the partial batch is written by the timer
+	for n := 0; ; n++ {
+		st, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Size() > 0 {
+			break
+		}
+		if n == 100 {
+			t.Fatal("partial batch is not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
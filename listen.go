@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/valyala/tcplisten"
+)
+
+// capabilities are the features enabled at startup, they are logged as the
+// summary after the listeners are created
+type capabilities []capability
+
+type capability struct {
+	name, state string
+}
+
+func (c *capabilities) add(name, format string, args ...interface{}) {
+	*c = append(*c, capability{name, fmt.Sprintf(format, args...)})
+}
+
+func (c capabilities) log() {
+	for _, i := range c {
+		log.Printf("startup: %-16s %s", i.name, i.state)
+	}
+}
+
+// mlockall locks the process memory if mode is try or require. If the
+// future allocations could not be locked the current memory is locked only,
+// with require mode it is an error if nothing could be locked.
+func mlockall(mode string, caps *capabilities) error {
+	if mode == "off" {
+		caps.add("mlockall", "disabled")
+		return nil
+	}
+	err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE)
+	if err == nil {
+		caps.add("mlockall", "current and future memory")
+		return nil
+	}
+	if err2 := syscall.Mlockall(syscall.MCL_CURRENT); err2 == nil {
+		caps.add("mlockall", "current memory only (MCL_FUTURE: %s)", err)
+		return nil
+	}
+	if mode == "require" {
+		return fmt.Errorf("mlockall: %s", err)
+	}
+	caps.add("mlockall", "unavailable (%s)", err)
+	return nil
+}
+
+// listen creates the listeners of the main port. The TCP options which
+// couldn't be set are turned off, dual-stack tcp falls back to tcp4 if IPv6
+// is not available, and gets the separate tcp4 listeners if the IPv6 sockets
+// are IPv6 only.
+func listen(c *config, caps *capabilities) ([]net.Listener, error) {
+
+	if c.Network == "unix" {
+		return listenUnix(c.Bind, caps)
+	}
+
+	n := c.Listeners
+	if n == 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	lc := tcplisten.Config{
+		ReusePort:   n > 1,
+		DeferAccept: c.DeferAccept,
+		FastOpen:    c.FastOpen,
+		Backlog:     c.Backlog,
+	}
+
+	network := c.Network
+	if network == "tcp" {
+		network = "tcp6"
+	}
+
+	ln, err := newTCPListener(&lc, network, c.Bind)
+	if err != nil && c.Network == "tcp" {
+		log.Printf("startup: can't listen on IPv6, falling back to tcp4: %s", err)
+		network = "tcp4"
+		ln, err = newTCPListener(&lc, network, c.Bind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lns := []net.Listener{ln}
+	if lc.ReusePort {
+		for i := 1; i < n; i++ {
+			l, err := lc.NewListener(network, ln.Addr().String())
+			if err != nil {
+				for _, l := range lns {
+					l.Close()
+				}
+				return nil, err
+			}
+			lns = append(lns, l)
+		}
+	}
+
+	listeners, family := len(lns), ""
+	if c.Network == "tcp" && v6only(network, ln.Addr()) {
+		family = " per address family"
+		addr4 := net.JoinHostPort("0.0.0.0", strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))
+		for i := 0; i < listeners; i++ {
+			l, err := lc.NewListener("tcp4", addr4)
+			if err != nil {
+				for _, l := range lns {
+					l.Close()
+				}
+				return nil, fmt.Errorf("tcp4 listener of dual-stack tcp: %s", err)
+			}
+			lns = append(lns, l)
+		}
+		caps.add("listen", "%s %s and tcp4 %s (net.ipv6.bindv6only=1)", network, ln.Addr(), addr4)
+	} else {
+		caps.add("listen", "%s %s%s", network, ln.Addr(), stackState(network, ln.Addr()))
+	}
+	if lc.ReusePort {
+		caps.add("listeners", "%d%s with SO_REUSEPORT", listeners, family)
+	} else if n > 1 {
+		caps.add("listeners", "1%s (SO_REUSEPORT unavailable, %d requested)", family, n)
+	} else {
+		caps.add("listeners", "1%s", family)
+	}
+	caps.add("backlog", "%s", backlogState(c.Backlog))
+	caps.add("TCP_DEFER_ACCEPT", "%s", optionState(c.DeferAccept, lc.DeferAccept))
+	caps.add("TCP_FASTOPEN", "%s", optionState(c.FastOpen, lc.FastOpen))
+
+	return lns, nil
+}
+
+// newTCPListener creates the listener, turning off TCP_FASTOPEN,
+// TCP_DEFER_ACCEPT and SO_REUSEPORT one by one while they are not supported
+// by the kernel. Other errors, like the address already in use, are returned
+// as is.
+func newTCPListener(lc *tcplisten.Config, network, addr string) (net.Listener, error) {
+	try := *lc
+	for {
+		ln, err := try.NewListener(network, addr)
+		if err == nil {
+			*lc = try
+			return ln, nil
+		}
+		opt := unsupportedOption(&try, err)
+		if opt == nil || !*opt {
+			return nil, err
+		}
+		log.Printf("startup: %s, listening without it", err)
+		*opt = false
+	}
+}
+
+// optionErrors are the prefixes of the tcplisten errors of the options
+// which could be turned off
+var optionErrors = []struct {
+	prefix string
+	option func(*tcplisten.Config) *bool
+}{
+	{"cannot enable TCP_FASTOPEN", func(c *tcplisten.Config) *bool { return &c.FastOpen }},
+	{"cannot enable TCP_DEFER_ACCEPT", func(c *tcplisten.Config) *bool { return &c.DeferAccept }},
+	{"cannot enable SO_REUSEPORT", func(c *tcplisten.Config) *bool { return &c.ReusePort }},
+}
+
+// unsupportedErrnos are returned by setsockopt for the options the kernel
+// doesn't know
+var unsupportedErrnos = []syscall.Errno{syscall.ENOPROTOOPT, syscall.EINVAL, syscall.EOPNOTSUPP}
+
+// unsupportedOption returns the option of lc which couldn't be set because
+// it is not supported, or nil. tcplisten formats the errno into the error
+// message, so the message is matched.
+func unsupportedOption(lc *tcplisten.Config, err error) *bool {
+	msg := err.Error()
+	for _, i := range optionErrors {
+		if !strings.HasPrefix(msg, i.prefix) {
+			continue
+		}
+		for _, errno := range unsupportedErrnos {
+			if strings.HasSuffix(msg, errno.Error()) {
+				return i.option(lc)
+			}
+		}
+	}
+	return nil
+}
+
+func listenUnix(path string, caps *capabilities) ([]net.Listener, error) {
+	// remove the socket left by the previous run
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	caps.add("listen", "unix %s", path)
+	caps.add("listeners", "1")
+	return []net.Listener{ln}, nil
+}
+
+func sysctl(name string) string {
+	b, err := ioutil.ReadFile("/proc/sys/" + strings.Replace(name, ".", "/", -1))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// v6only tells if the socket listening on the unspecified IPv6 address
+// doesn't accept the IPv4 connections
+func v6only(network string, addr net.Addr) bool {
+	if network != "tcp6" {
+		return false
+	}
+	if a, ok := addr.(*net.TCPAddr); !ok || !a.IP.IsUnspecified() {
+		return false
+	}
+	return sysctl("net.ipv6.bindv6only") == "1"
+}
+
+func stackState(network string, addr net.Addr) string {
+	if network != "tcp6" {
+		return ""
+	}
+	if a, ok := addr.(*net.TCPAddr); !ok || !a.IP.IsUnspecified() {
+		return ""
+	}
+	switch sysctl("net.ipv6.bindv6only") {
+	case "0":
+		return " (dual-stack)"
+	case "1":
+		return " (IPv6 only, net.ipv6.bindv6only=1)"
+	}
+	return ""
+}
+
+func backlogState(backlog int) string {
+	somaxconn, err := strconv.Atoi(sysctl("net.core.somaxconn"))
+	switch {
+	case err != nil && backlog <= 0:
+		return "system default"
+	case err != nil:
+		return strconv.Itoa(backlog)
+	case backlog <= 0:
+		return fmt.Sprintf("%d (net.core.somaxconn)", somaxconn)
+	case backlog > somaxconn:
+		return fmt.Sprintf("%d (capped by net.core.somaxconn=%d)", somaxconn, somaxconn)
+	}
+	return strconv.Itoa(backlog)
+}
+
+func optionState(requested, enabled bool) string {
+	switch {
+	case enabled:
+		return "on"
+	case requested:
+		return "off (unavailable)"
+	}
+	return "off"
+}
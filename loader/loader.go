@@ -1,7 +1,7 @@
 package main
 
 import (
-	"archive/zip"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -11,33 +11,56 @@ import (
 
 	"github.com/valyala/fasthttp"
 
-	"github.com/ei-grad/hlcup/models"
+	"github.com/ei-grad/hlcup/dataset"
 )
 
+// record is a loaded entity, it is sent in the task alone or in the batch
+type record struct {
+	file   string
+	offset int64
+	entity string
+	id     uint32
+	body   []byte
+}
+
 type task struct {
-	url  string
-	body []byte
+	records []record
 }
 
 type loader struct {
 	baseURL, fileName string
+	entity            string
 	wg                sync.WaitGroup
 	nWorkers          int
+	batchSize         int
+	rejects           *dataset.Rejects
 	countUsers        int32
 	countLocations    int32
 	countVisits       int32
 }
 
-func LoadData(baseURL, fileName string, nWorkers int) {
+// LoadData sends the data file records to the server. In strict mode it
+// stops on the first bad or not accepted record and returns it as
+// *dataset.Error, in lenient mode such records are skipped and written to
+// the rejects file.
+func LoadData(baseURL, fileName, entity string, nWorkers, batchSize int, mode dataset.Mode, rejectsFile string) error {
+	rejects, err := dataset.NewRejects(mode, rejectsFile)
+	if err != nil {
+		return err
+	}
+	defer rejects.Close()
 	l := &loader{
-		baseURL:  baseURL,
-		fileName: fileName,
-		nWorkers: nWorkers,
+		baseURL:   baseURL,
+		fileName:  fileName,
+		entity:    entity,
+		nWorkers:  nWorkers,
+		batchSize: batchSize,
+		rejects:   rejects,
 	}
-	l.LoadData()
+	return l.LoadData(mode)
 }
 
-func (l *loader) LoadData() {
+func (l *loader) LoadData(mode dataset.Mode) error {
 
 	tasks := make(chan task)
 	defer close(tasks)
@@ -46,142 +69,194 @@ func (l *loader) LoadData() {
 		go l.worker(tasks)
 	}
 
-	// Open a zip archive for reading.
-	r, err := zip.OpenReader(l.fileName)
+	d, err := dataset.Open(l.fileName, l.entity)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer r.Close()
+	defer d.Close()
 
-	log.Printf("loader: starting")
+	log.Printf("loader: starting in %s mode", mode)
 
 	t0 := time.Now()
+	t1 := t0
 
-	for _, f := range r.File {
-		l.wg.Add(1)
-		go l.loadFile(f, 1, tasks)
-	}
+	for stage := 1; stage <= 2; stage++ {
 
-	l.wg.Wait()
+		for _, f := range d.Files {
+			l.wg.Add(1)
+			go l.loadFile(f, stage, tasks)
+		}
 
-	t1 := time.Now()
-	log.Printf("loader: stage 1 finished in %s", t1.Sub(t0))
+		l.wg.Wait()
 
-	for _, f := range r.File {
-		l.wg.Add(1)
-		go l.loadFile(f, 2, tasks)
-	}
+		if err := l.rejects.Err(); err != nil {
+			log.Printf("loader: stopped on stage %d after %s, sent %d users, %d locations, %d visits",
+				stage, time.Since(t0), l.countUsers, l.countLocations, l.countVisits)
+			return err
+		}
 
-	l.wg.Wait()
+		t2 := time.Now()
+		log.Printf("loader: stage %d finished in %s", stage, t2.Sub(t1))
+		t1 = t2
+	}
 
-	t2 := time.Now()
-	log.Printf("loader: stage 2 finished in %s", t2.Sub(t1))
-	log.Printf("loader: load finished in %s", t2.Sub(t0))
-	log.Printf("loader: loaded %d users, %d locations, %d visits",
+	log.Printf("loader: load finished in %s", t1.Sub(t0))
+	log.Printf("loader: sent %d users, %d locations, %d visits",
 		l.countUsers, l.countLocations, l.countVisits)
 
+	if mode == dataset.Lenient {
+		log.Printf("loader: %s", l.rejects.Summary())
+	}
+
+	return nil
 }
 
-func (l *loader) loadFile(f *zip.File, stage int, tasks chan task) {
+func (l *loader) loadFile(f *dataset.File, stage int, tasks chan task) {
 
 	defer l.wg.Done()
 
-	rc, err := f.Open()
+	batches := map[string][]record{}
+
+	err := f.Read(stage, func(r dataset.Record) error {
+		// other files are stopped at the first error in strict mode
+		if err := l.rejects.Err(); err != nil {
+			return err
+		}
+		body, err := r.Value.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("can't encode %+v back: %s", r.Value, err)
+		}
+		switch r.Entity {
+		case dataset.Users:
+			atomic.AddInt32(&l.countUsers, 1)
+		case dataset.Locations:
+			atomic.AddInt32(&l.countLocations, 1)
+		case dataset.Visits:
+			atomic.AddInt32(&l.countVisits, 1)
+		}
+		rec := record{f.Name, r.Offset, r.Entity, r.Value.GetID(), body}
+		if l.batchSize > 1 {
+			batch := append(batches[r.Entity], rec)
+			if len(batch) == l.batchSize {
+				l.wg.Add(1)
+				tasks <- task{batch}
+				batch = nil
+			}
+			batches[r.Entity] = batch
+			return nil
+		}
+		l.wg.Add(1)
+		tasks <- task{[]record{rec}}
+		return nil
+	}, l.rejects.Handle)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
-	defer rc.Close()
 
-	decoder := json.NewDecoder(rc)
+	for _, batch := range batches {
+		if len(batch) > 0 {
+			l.wg.Add(1)
+			tasks <- task{batch}
+		}
+	}
 
-	// read left_bracket token
-	token, err := decoder.Token()
-	if err != nil {
-		log.Fatalf("loader: %s: invalid JSON", f.Name)
+}
+
+func (l *loader) reject(r record, reason string) {
+	l.rejects.Handle(&dataset.Error{
+		File:   r.file,
+		Offset: r.offset,
+		Entity: r.entity,
+		ID:     r.id,
+		Reason: reason,
+	})
+}
+
+func (l *loader) worker(tasks chan task) {
+	for i := range tasks {
+		if l.batchSize > 1 {
+			l.sendBatch(i.records)
+		} else {
+			l.sendOne(i.records[0])
+		}
+		l.wg.Done()
 	}
-	if t, ok := token.(json.Delim); !ok || t.String() != "{" {
-		log.Fatalf("loader: %s: expected {, got %v", f.Name, token)
+}
+
+func (l *loader) sendOne(r record) {
+	url := fmt.Sprintf("%s/%s/new", l.baseURL, r.entity)
+	status, body, err := l.sendPost(url, r.body)
+	switch {
+	case err != nil:
+		l.reject(r, err.Error())
+	case status != 200:
+		l.reject(r, fmt.Sprintf("POST %s: %d %s", url, status, body))
 	}
+}
 
-	for decoder.More() {
+type batchResponse struct {
+	Applied bool `json:"applied"`
+	Results []struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	} `json:"results"`
+}
 
-		// read key
-		token, err = decoder.Token()
-		if err != nil {
-			log.Fatalf("loader: %s: invalid JSON", f.Name)
-		}
-		key, ok := token.(string)
-		if !ok {
-			log.Fatalf("loader: %s: expected string, got %v", f.Name, token)
-		}
+// sendBatch sends the records in POST /batch. The batch is applied only if
+// all of its operations are valid, so the failed ones are rejected and the
+// rest are sent again.
+func (l *loader) sendBatch(batch []record) {
 
-		// read left_brace token
-		token, err = decoder.Token()
-		if err != nil {
-			log.Fatalf("loader: %s: invalid JSON", f.Name)
-		}
-		if t, ok := token.(json.Delim); !ok || t.String() != "[" {
-			log.Fatalf("loader: %s: expected [, got %v", f.Name, token)
-		}
+	url := fmt.Sprintf("%s/batch", l.baseURL)
+
+	for len(batch) > 0 {
 
-		type Entity interface {
-			MarshalJSON() ([]byte, error)
-			UnmarshalJSON([]byte) error
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for n, i := range batch {
+			if n > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(&buf, `{"op":"new","entity":%q,"data":%s}`, i.entity, i.body)
 		}
+		buf.WriteByte(']')
 
-		var v Entity
-		var constructor func() Entity
+		status, body, err := l.sendPost(url, buf.Bytes())
+		if err == nil && status == 200 {
+			return
+		}
 
-		switch {
-		case key == "users" && stage == 1:
-			constructor = func() Entity {
-				atomic.AddInt32(&l.countUsers, 1)
-				return &models.User{}
-			}
-		case key == "locations" && stage == 1:
-			constructor = func() Entity {
-				atomic.AddInt32(&l.countLocations, 1)
-				return &models.Location{}
-			}
-		case key == "visits" && stage == 2:
-			constructor = func() Entity {
-				atomic.AddInt32(&l.countVisits, 1)
-				return &models.Visit{}
+		var resp batchResponse
+		if err == nil && (json.Unmarshal(body, &resp) != nil || len(resp.Results) != len(batch)) {
+			err = fmt.Errorf("POST %s: %d %s", url, status, body)
+		}
+		if err != nil {
+			for _, i := range batch {
+				l.reject(i, err.Error())
 			}
-		default:
 			return
 		}
 
-		log.Printf("loader: %s: loading %s", f.Name, key)
-
-		for decoder.More() {
-			v = constructor()
-			err := decoder.Decode(&v)
-			if err != nil {
-				log.Fatalf("loader: bad JSON: %s", err)
-			}
-			body, err := v.MarshalJSON()
-			if err != nil {
-				log.Fatalf("loader: can't encode %+v back: %s", v, err)
+		var valid []record
+		for n, i := range resp.Results {
+			if i.Error == "" {
+				valid = append(valid, batch[n])
+			} else {
+				l.reject(batch[n], fmt.Sprintf("POST %s: %d %s", url, i.Status, i.Error))
 			}
-			l.wg.Add(1)
-			tasks <- task{
-				url:  fmt.Sprintf("%s/%s/new", l.baseURL, key),
-				body: body,
+		}
+		if len(valid) == len(batch) {
+			// not applied for another reason, don't retry
+			for _, i := range batch {
+				l.reject(i, fmt.Sprintf("POST %s: %d %s", url, status, body))
 			}
+			return
 		}
+		batch = valid
 	}
-
 }
 
-func (l *loader) worker(tasks chan task) {
-	for i := range tasks {
-		l.sendPost(i.url, i.body)
-		l.wg.Done()
-	}
-}
-
-func (l *loader) sendPost(url string, body []byte) {
+func (l *loader) sendPost(url string, body []byte) (int, []byte, error) {
 
 	req := fasthttp.AcquireRequest()
 	defer fasthttp.ReleaseRequest(req)
@@ -194,14 +269,9 @@ func (l *loader) sendPost(url string, body []byte) {
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
 
-	err := fasthttp.Do(req, resp)
-
-	if err != nil {
-		log.Fatalf("loader: can't send request: %s", err)
-	}
-
-	if resp.StatusCode() != 200 {
-		log.Fatalf("loader: got non-200 response:\n%s", resp)
+	if err := fasthttp.Do(req, resp); err != nil {
+		return 0, nil, fmt.Errorf("can't send request: %s", err)
 	}
 
+	return resp.StatusCode(), append([]byte(nil), resp.Body()...), nil
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/ei-grad/hlcup/app"
+	"github.com/ei-grad/hlcup/dataset"
+	"github.com/ei-grad/hlcup/db"
+)
+
+// testData has the duplicate user 1, the user 3 with invalid gender and the
+// visit 2 to the missing location, the server rejects them
+var testData = map[string]string{
+	"users.ndjson": `{"id":1,"email":"a@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}
+{"id":2,"email":"b@b.c","first_name":"a","last_name":"b","gender":"f","birth_date":0}
+{"id":1,"email":"c@b.c","first_name":"a","last_name":"b","gender":"m","birth_date":0}
+{"id":3,"email":"d@b.c","first_name":"a","last_name":"b","gender":"x","birth_date":0}
+`,
+	"locations.csv": "id,place,country,city,distance\n1,a,b,c,10\n",
+	"visits.csv":    "id,user,location,visited_at,mark\n1,1,1,100,5\n2,2,9,100,5\n",
+}
+
+func testServer(t *testing.T) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	a := app.NewApplication(db.NewMapStorage())
+	go fasthttp.Serve(ln, a.RequestHandler)
+	return "http://" + ln.Addr().String(), func() { ln.Close() }
+}
+
+// checkLoaded checks the status of GET of the paths
+func checkLoaded(t *testing.T, name, url string, paths map[string]int) {
+	for path, expected := range paths {
+		status, _, err := fasthttp.Get(nil, url+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != expected {
+			t.Errorf("%s: GET %s: %d, expected %d", name, path, status, expected)
+		}
+	}
+}
+
+func TestLoadData(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "loader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range testData {
+		if err := ioutil.WriteFile(filepath.Join(data, name), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		url, stop := testServer(t)
+		defer stop()
+		err := LoadData(url, data, "", 1, 1, dataset.Strict, "")
+		e, ok := err.(*dataset.Error)
+		if !ok {
+			t.Fatalf("got %#v", err)
+		}
+		if e.File != "users.ndjson" || e.Offset != 3 || e.Entity != dataset.Users || e.ID != 1 {
+			t.Errorf("got %s", e)
+		}
+		// the visits stage is not started
+		checkLoaded(t, "strict", url, map[string]int{"/users/2": 200, "/visits/1": 404})
+	})
+
+	for _, batch := range []int{1, 2, 10} {
+		url, stop := testServer(t)
+		rejectsFile := filepath.Join(dir, "rejects.jsonl")
+		if err := LoadData(url, data, "", 4, batch, dataset.Lenient, rejectsFile); err != nil {
+			t.Fatalf("batch %d: %s", batch, err)
+		}
+		checkLoaded(t, fmt.Sprintf("batch %d", batch), url, map[string]int{
+			"/users/1": 200, "/users/2": 200, "/users/3": 404,
+			"/locations/1": 200, "/visits/1": 200, "/visits/2": 404,
+		})
+		stop()
+
+		b, err := ioutil.ReadFile(rejectsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := dataset.NewRejects(dataset.Lenient, "")
+		for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+			var e dataset.Error
+			if err := json.Unmarshal(line, &e); err != nil {
+				t.Fatalf("batch %d: %s: %s", batch, line, err)
+			}
+			r.Handle(&e)
+		}
+		s := r.Summary()
+		if s.Total != 3 || s.Files["users.ndjson"] != 2 || s.Files["visits.csv"] != 1 {
+			t.Errorf("batch %d: %s", batch, s)
+		}
+	}
+}
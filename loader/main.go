@@ -1,12 +1,27 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"log"
+
+	"github.com/ei-grad/hlcup/dataset"
+)
 
 var baseURL = flag.String("url", "http://localhost", "base URL (for loader)")
 var nWorkers = flag.Int("w", 8, "number of parallel requests while loading data")
-var dataFileName = flag.String("data", "/tmp/data/data.zip", "data file name")
+var dataFileName = flag.String("data", "/tmp/data/data.zip", "data zip archive, directory or file (json, ndjson or csv, optionally gzipped)")
+var dataEntity = flag.String("entity", "", "entity of ndjson and csv data files (detected by file names if empty)")
+var loadMode = flag.String("mode", "strict", "bad records handling: strict (stop loading) or lenient (skip them)")
+var rejectsFile = flag.String("rejects", "", "file to write the records skipped in lenient mode to (JSON lines)")
+var batchSize = flag.Int("batch", 1, "send entities in POST /batch requests of this size")
 
 func main() {
 	flag.Parse()
-	LoadData(*baseURL, *dataFileName, *nWorkers)
+	mode, err := dataset.ParseMode(*loadMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := LoadData(*baseURL, *dataFileName, *dataEntity, *nWorkers, *batchSize, mode, *rejectsFile); err != nil {
+		log.Fatalf("loader: %s", err)
+	}
 }
@@ -5,12 +5,11 @@ import (
 	"log"
 	"os"
 	"runtime"
-	"syscall"
 
 	"github.com/valyala/fasthttp"
-	"github.com/valyala/tcplisten"
 
 	"github.com/ei-grad/hlcup/app"
+	"github.com/ei-grad/hlcup/dataset"
 	"github.com/ei-grad/hlcup/db"
 )
 
@@ -19,62 +18,142 @@ var BuildDate string
 
 func main() {
 
-	log.Printf("HighLoad Cup solution by Andrew Grigorev <andrew@ei-grad.ru>")
-	log.Printf("Version %s/DB=%s built %s, %s", Version, db.Version, BuildDate, runtime.Version())
-	log.Printf("GOMAXPROCS: %d", runtime.GOMAXPROCS(0))
-
-	var (
-		accessLog     = flag.Bool("v", false, "show access log")
-		address       = flag.String("b", ":80", "bind address")
-		dataFileName  = flag.String("data", "/tmp/data/data.zip", "data file name")
-		useHeat       = flag.Bool("heat", false, "heat GET requests on POST")
-		runRpsWatcher = flag.Bool("rps", true, "log RPS every second")
-	)
+	cfg := defaultConfig()
+	cfg.flags(flag.CommandLine)
+	configFile := flag.String("config", os.Getenv(configEnvName("config")), "config file, keys are the flag names: .json, or .yaml and .toml limited to scalar values and sections")
+	printConfig := flag.Bool("print-config", false, "print the effective config as JSON and exit")
+	printConfigMask := flag.Bool("print-config-mask", false, "mask admin-token in -print-config output")
 
 	flag.Parse()
 
+	if err := cfg.load(flag.CommandLine, *configFile); err != nil {
+		log.Fatal("config: ", err)
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal("config: ", err)
+	}
+	if *printConfig {
+		if err := cfg.print(os.Stdout, flag.CommandLine, *printConfigMask); err != nil {
+			log.Fatal("config: ", err)
+		}
+		return
+	}
+
+	log.Printf("HighLoad Cup solution by Andrew Grigorev <andrew@ei-grad.ru>")
+	log.Printf("Version %s/DB=%s built %s, %s", Version, cfg.Backend, BuildDate, runtime.Version())
+	log.Printf("GOMAXPROCS: %d", runtime.GOMAXPROCS(0))
+
 	cpuinfo()
 	swapon()
 	rlimit()
-	memstats()
 	whoami()
 
-	if os.Getenv("RUN_TOP") == "1" {
-		go top()
+	stopTop := make(chan struct{})
+	topDone := make(chan struct{})
+	if cfg.Top {
+		go top(stopTop, topDone)
+	} else {
+		close(topDone)
 	}
 
-	app := app.NewApplication()
-	app.UseHeat(*useHeat)
-	if *runRpsWatcher {
-		go app.RpsWatcher()
+	if err := db.SetShardsCount(cfg.Shards); err != nil {
+		log.Fatal(err)
+	}
+	storage, err := db.NewStorage(cfg.Backend)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	h := app.RequestHandler
-
-	if *accessLog {
-		h = accessLogHandler(h)
+	// opened before the application shadows the package name
+	var accessLogger *app.AccessLog
+	if cfg.AccessLog || cfg.AccessLogFile != "" {
+		l, err := app.OpenAccessLog(app.AccessLogOptions{
+			Path:          cfg.AccessLogFile,
+			Format:        cfg.accessFormat,
+			SampleRate:    cfg.AccessLogSample,
+			SlowThreshold: cfg.AccessLogSlow,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		accessLogger = l
+		go reopenOnSIGHUP(l)
 	}
 
-	if err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE); err != nil {
-		log.Print("mlockall: ", err)
-	} else {
-		log.Print("mlockall: success")
+	app := app.NewApplication(storage)
+	if accessLogger != nil {
+		app.UseAccessLog(accessLogger)
+	}
+	app.UseHeat(cfg.Heat)
+	app.SetMaxBatchSize(cfg.BatchMax)
+	app.SetMaxPageLimit(cfg.PageMax)
+	app.SetMaxSearchLimit(cfg.SearchMax)
+	app.SetDataEntity(cfg.DataEntity)
+	app.SetLoadMode(cfg.loadMode, cfg.Rejects)
+	app.SetNow(cfg.nowMode, cfg.now)
+	app.SetUnavailableWhileLoading(cfg.RetryAfter)
+	if cfg.Cache > 0 {
+		app.UseCache(cfg.Cache << 20)
+	}
+	if cfg.WAL != "" {
+		app.UseWAL(db.WALOptions{
+			Path:      cfg.WAL,
+			Sync:      cfg.walSync,
+			BatchSize: cfg.WALBatch,
+			Interval:  cfg.WALInterval,
+		})
+	}
+	if cfg.Snapshot != "" {
+		app.UseSnapshot(cfg.Snapshot, cfg.SnapshotInterval)
+	}
+	app.SetAdminToken(cfg.AdminToken)
+	if cfg.Reload {
+		app.EnableReload(func() (db.Storage, error) {
+			return db.NewStorage(cfg.Backend)
+		})
+	}
+	if cfg.RPS {
+		go app.RpsWatcher()
 	}
 
-	// goroutine to load data and profile cpu and mem
-	go app.LoadData(*dataFileName)
+	h := app.RequestHandler
 
-	var err error
+	var caps capabilities
+	if err := mlockall(cfg.Mlockall, &caps); err != nil {
+		log.Fatal(err)
+	}
 
-	var cfg = &tcplisten.Config{
-		DeferAccept: true,
-		FastOpen:    true,
+	// goroutine to load data and profile cpu and mem
+	go func() {
+		err := app.LoadData(cfg.Data)
+		if _, ok := err.(*dataset.Error); ok && cfg.WAL != "" {
+			// keep serving the data loaded before the bad record, the WAL
+			// isn't replayed and attached, so the mutations get 503
+			log.Printf("loader: %s, serving the loaded data read-only", err)
+		} else if ok {
+			// keep serving the data loaded before the bad record
+			log.Printf("loader: %s", err)
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if cfg.Admin != "" {
+		go func() {
+			log.Printf("admin: listening on %s", cfg.Admin)
+			if err := fasthttp.ListenAndServe(cfg.Admin, app.AdminHandler); err != nil {
+				log.Fatal("admin: ", err)
+			}
+		}()
 	}
-	ln, err := cfg.NewListener("tcp4", *address)
+
+	lns, err := listen(cfg, &caps)
 	if err != nil {
-		log.Fatal("can't setup listener:", err)
-	}
-	if err := fasthttp.Serve(ln, h); err != nil {
-		log.Fatal("fasthttp.Serve:", err)
+		log.Fatal("can't setup listener: ", err)
 	}
+	caps.add("reference time", "%s", cfg.nowState())
+	caps.log()
+	code := serve(lns, h, app, cfg.DrainTimeout, cfg.PersistOnExit, stopTop)
+	<-topDone
+	os.Exit(code)
 }
@@ -0,0 +1,274 @@
+package models
+
+import (
+	"sort"
+	"time"
+)
+
+// MarksQuery is the /locations/<id>/avg filter:
+//    fromDate, toDate - visited_at в интервале (fromDate, toDate)
+//    fromAge, toAge - возраст путешественника, считается от Now
+//    gender - 'm', 'f' или 0 для всех
+type MarksQuery struct {
+	FromDate      int
+	FromDateIsSet bool
+	ToDate        int
+	ToDateIsSet   bool
+	FromAge       int
+	FromAgeIsSet  bool
+	ToAge         int
+	ToAgeIsSet    bool
+	Gender        byte
+	Now           time.Time
+}
+
+// AgeThreshold returns the birth time of those who are exactly age years old
+// at the Now second
+func (q MarksQuery) AgeThreshold(age int) time.Time {
+	t := q.Now.UTC()
+	return time.Date(t.Year()-age, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// Age returns the number of full years at the Now second, that is the
+// largest k for which birthDate is before AgeThreshold(k), or -1 if the
+// birth date is after Now
+func (q MarksQuery) Age(birthDate time.Time) int {
+	age := q.Now.UTC().Year() - birthDate.UTC().Year()
+	if age < 0 {
+		age = 0
+	}
+	for age >= 0 && !birthDate.Before(q.AgeThreshold(age)) {
+		age--
+	}
+	for birthDate.Before(q.AgeThreshold(age + 1)) {
+		age++
+	}
+	return age
+}
+
+const (
+	// AggregateMinMarks is the number of marks starting from which the
+	// location gets the MarksAggregate, scanning less marks is fast enough
+	AggregateMinMarks = 256
+
+	// age buckets are -1 (born after Now), 0, 1, ... maxAge, and the last
+	// one for everyone older
+	ageBuckets = 256
+	maxAge     = ageBuckets - 3
+)
+
+// MarksAggregate answers sum and count of the marks matching MarksQuery in
+// O(log(ageBuckets) * log(n)). For every gender it keeps a Fenwick tree over
+// the age buckets, every tree node is a list of marks ordered by visited_at
+// with prefix sums.
+//
+// The age of the user is the number of full years at the reference time, so
+// fromAge and toAge filters become age bucket ranges. fromAge=k filter is
+// birthDate.Before(AgeThreshold(k)), toAge=k is the opposite, and the
+// answers are exactly the same as the filtering of the marks one by one
+// gives. Queries with another reference second or ages beyond maxAge can't be
+// answered.
+//
+// The buckets are fixed at the reference second: the users move to the next
+// bucket on their birthdays, so the aggregate is useless for the moving
+// reference time. It is built only when the reference time is constant (the
+// data or fixed one), with the wall clock every avg query scans the marks.
+type MarksAggregate struct {
+	// now is the reference time in unix seconds
+	now int64
+
+	// thresholds[k] is the birth date of those who are k years old
+	thresholds [maxAge + 2]time.Time
+
+	genders [2][ageBuckets + 1]aggregateNode
+}
+
+type aggregateKey struct {
+	visitedAt int
+	visit     uint32
+}
+
+func (k aggregateKey) less(other aggregateKey) bool {
+	if k.visitedAt != other.visitedAt {
+		return k.visitedAt < other.visitedAt
+	}
+	return k.visit < other.visit
+}
+
+type aggregateNode struct {
+	keys []aggregateKey
+	// sums[i] is the sum of marks of keys[:i]
+	sums []int
+}
+
+func (n *aggregateNode) search(k aggregateKey) int {
+	return sort.Search(len(n.keys), func(i int) bool { return !n.keys[i].less(k) })
+}
+
+func (n *aggregateNode) add(k aggregateKey, mark int) {
+	if n.sums == nil {
+		n.sums = []int{0}
+	}
+	i := n.search(k)
+	n.keys = append(n.keys, aggregateKey{})
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = k
+	n.sums = append(n.sums, 0)
+	copy(n.sums[i+2:], n.sums[i+1:])
+	n.sums[i+1] = n.sums[i]
+	for j := i + 1; j < len(n.sums); j++ {
+		n.sums[j] += mark
+	}
+}
+
+func (n *aggregateNode) remove(k aggregateKey, mark int) {
+	i := n.search(k)
+	if i == len(n.keys) || n.keys[i] != k {
+		return
+	}
+	n.keys = n.keys[:i+copy(n.keys[i:], n.keys[i+1:])]
+	n.sums = n.sums[:i+1+copy(n.sums[i+1:], n.sums[i+2:])]
+	for j := i + 1; j < len(n.sums); j++ {
+		n.sums[j] -= mark
+	}
+}
+
+// query returns sum and count of marks with visited_at in the date range
+func (n *aggregateNode) query(q MarksQuery) (sum, count int) {
+	lo, hi := 0, len(n.keys)
+	if q.FromDateIsSet {
+		lo = sort.Search(len(n.keys), func(i int) bool { return n.keys[i].visitedAt > q.FromDate })
+	}
+	if q.ToDateIsSet {
+		hi = sort.Search(len(n.keys), func(i int) bool { return n.keys[i].visitedAt >= q.ToDate })
+	}
+	if lo >= hi {
+		return 0, 0
+	}
+	return n.sums[hi] - n.sums[lo], hi - lo
+}
+
+// NewMarksAggregate builds the aggregate for the reference time of now
+func NewMarksAggregate(now time.Time, marks []LocationMark) *MarksAggregate {
+	a := &MarksAggregate{now: now.Unix()}
+	q := MarksQuery{Now: now}
+	for k := range a.thresholds {
+		a.thresholds[k] = q.AgeThreshold(k)
+	}
+
+	// the nodes are filled in bulk, sorted and summed up once
+	type entry struct {
+		key  aggregateKey
+		mark int
+	}
+	var entries [2][ageBuckets + 1][]entry
+	for _, m := range marks {
+		e := entry{aggregateKey{m.VisitedAt, m.Visit}, int(m.Mark)}
+		g := genderIndex(m.Gender)
+		for i := a.bucket(m.BirthDate) + 1; i <= ageBuckets; i += i & -i {
+			entries[g][i] = append(entries[g][i], e)
+		}
+	}
+	for g := range entries {
+		for i, e := range entries[g] {
+			if len(e) == 0 {
+				continue
+			}
+			sort.Slice(e, func(i, j int) bool { return e[i].key.less(e[j].key) })
+			n := &a.genders[g][i]
+			n.keys = make([]aggregateKey, len(e))
+			n.sums = make([]int, len(e)+1)
+			for j := range e {
+				n.keys[j] = e[j].key
+				n.sums[j+1] = n.sums[j] + e[j].mark
+			}
+		}
+	}
+
+	return a
+}
+
+// bucket returns the age bucket of the birth date, the user age is the
+// largest k for which birthDate is before thresholds[k]
+func (a *MarksAggregate) bucket(birthDate time.Time) int {
+	// birthDate is before thresholds[k-1], so the age is k-1 and the bucket
+	// is k
+	return sort.Search(len(a.thresholds), func(k int) bool { return !birthDate.Before(a.thresholds[k]) })
+}
+
+func genderIndex(g byte) int {
+	if g == 'f' {
+		return 1
+	}
+	return 0
+}
+
+func (a *MarksAggregate) update(m LocationMark, f func(*aggregateNode)) {
+	nodes := &a.genders[genderIndex(m.Gender)]
+	for i := a.bucket(m.BirthDate) + 1; i <= ageBuckets; i += i & -i {
+		f(&nodes[i])
+	}
+}
+
+// Add accounts the mark
+func (a *MarksAggregate) Add(m LocationMark) {
+	k := aggregateKey{m.VisitedAt, m.Visit}
+	a.update(m, func(n *aggregateNode) { n.add(k, int(m.Mark)) })
+}
+
+// Remove forgets the mark, it must be exactly the same as it was added
+func (a *MarksAggregate) Remove(m LocationMark) {
+	k := aggregateKey{m.VisitedAt, m.Visit}
+	a.update(m, func(n *aggregateNode) { n.remove(k, int(m.Mark)) })
+}
+
+// prefix returns sum and count of marks of the gender in buckets [0, b)
+func (a *MarksAggregate) prefix(gender int, b int, q MarksQuery) (sum, count int) {
+	nodes := &a.genders[gender]
+	for i := b; i > 0; i -= i & -i {
+		s, c := nodes[i].query(q)
+		sum += s
+		count += c
+	}
+	return
+}
+
+// Sum returns sum and count of the marks matching the query, ok is false if
+// the query can't be answered by the aggregate
+func (a *MarksAggregate) Sum(q MarksQuery) (sum, count int, ok bool) {
+
+	if q.Now.Unix() != a.now {
+		return 0, 0, false
+	}
+
+	// age >= fromAge means bucket >= fromAge+1, age < toAge means
+	// bucket < toAge+1
+	lo, hi := 0, ageBuckets
+	if q.FromAgeIsSet {
+		if q.FromAge > maxAge {
+			return 0, 0, false
+		}
+		lo = q.FromAge + 1
+	}
+	if q.ToAgeIsSet {
+		if q.ToAge > maxAge {
+			return 0, 0, false
+		}
+		hi = q.ToAge + 1
+	}
+	if lo >= hi {
+		return 0, 0, true
+	}
+
+	for g, gender := range []byte{'m', 'f'} {
+		if q.Gender != 0 && q.Gender != gender {
+			continue
+		}
+		sHi, cHi := a.prefix(g, hi, q)
+		sLo, cLo := a.prefix(g, lo, q)
+		sum += sHi - sLo
+		count += cHi - cLo
+	}
+
+	return sum, count, true
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// linearSum is the filtering of the marks one by one, the aggregate answers
+// must be exactly the same
+func linearSum(marks []LocationMark, q MarksQuery) (sum, count int) {
+	for _, m := range marks {
+		switch {
+		case q.FromDateIsSet && m.VisitedAt <= q.FromDate:
+		case q.ToDateIsSet && m.VisitedAt >= q.ToDate:
+		case q.FromAgeIsSet && !m.BirthDate.Before(q.AgeThreshold(q.FromAge)):
+		case q.ToAgeIsSet && m.BirthDate.Before(q.AgeThreshold(q.ToAge)):
+		case q.Gender != 0 && m.Gender != q.Gender:
+		default:
+			sum += int(m.Mark)
+			count++
+		}
+	}
+	return
+}
+
+func randomMark(r *rand.Rand, q MarksQuery, visit uint32) LocationMark {
+	// the birth dates are often exactly at the age thresholds
+	birthDate := q.AgeThreshold(r.Intn(maxAge + 10)).Add(time.Duration(r.Intn(3)-1) * time.Second)
+	if r.Intn(4) == 0 {
+		birthDate = birthDate.Add(time.Duration(r.Int63n(int64(365 * 24 * time.Hour))))
+	}
+	return LocationMark{
+		Visit:     visit,
+		User:      uint32(r.Intn(1000)),
+		VisitedAt: r.Intn(1000),
+		BirthDate: birthDate,
+		Mark:      uint8(r.Intn(6)),
+		Gender:    "mf"[r.Intn(2)],
+	}
+}
+
+func randomQuery(r *rand.Rand, now time.Time) MarksQuery {
+	q := MarksQuery{Now: now}
+	if r.Intn(2) == 0 {
+		q.FromDate, q.FromDateIsSet = r.Intn(1100)-50, true
+	}
+	if r.Intn(2) == 0 {
+		q.ToDate, q.ToDateIsSet = r.Intn(1100)-50, true
+	}
+	if r.Intn(2) == 0 {
+		q.FromAge, q.FromAgeIsSet = r.Intn(maxAge+1), true
+	}
+	if r.Intn(2) == 0 {
+		q.ToAge, q.ToAgeIsSet = r.Intn(maxAge+1), true
+	}
+	q.Gender = []byte{0, 'm', 'f'}[r.Intn(3)]
+	return q
+}
+
+func TestMarksAggregateSum(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	now := time.Date(2017, 8, 25, 21, 10, 52, 0, time.UTC)
+	q := MarksQuery{Now: now}
+
+	var lm LocationMarks
+	var visit uint32
+	for i := 0; i < AggregateMinMarks; i++ {
+		visit++
+		lm.Add(randomMark(r, q, visit))
+	}
+	lm.Aggregate(now)
+	if lm.agg == nil {
+		t.Fatal("the aggregate is not built")
+	}
+
+	for i := 0; i < 20000; i++ {
+
+		switch n := len(lm.Marks); r.Intn(4) {
+		case 0:
+			visit++
+			lm.Add(randomMark(r, q, visit))
+		case 1:
+			if n > 0 {
+				lm.Pop(lm.Marks[r.Intn(n)].Visit)
+			}
+		case 2:
+			if n > 0 {
+				k := r.Intn(n)
+				m := randomMark(r, q, lm.Marks[k].Visit)
+				lm.Set(k, m)
+			}
+		}
+
+		query := randomQuery(r, now)
+		sum, count, ok := lm.Sum(query)
+		if !ok {
+			t.Fatalf("query %d %+v is not answered by the aggregate", i, query)
+		}
+		if s, c := linearSum(lm.Marks, query); s != sum || c != count {
+			t.Fatalf("query %d %+v: sum %d count %d, the linear scan gives %d and %d", i, query, sum, count, s, c)
+		}
+	}
+
+	// another reference time and the ages beyond maxAge are not answered
+	if _, _, ok := lm.Sum(MarksQuery{Now: now.Add(time.Second)}); ok {
+		t.Error("query with another reference time is answered")
+	}
+	if _, _, ok := lm.Sum(MarksQuery{Now: now, FromAge: maxAge + 1, FromAgeIsSet: true}); ok {
+		t.Error("query beyond maxAge is answered")
+	}
+}
@@ -27,11 +27,18 @@ type LocationMark struct {
 type LocationMarks struct {
 	M     sync.RWMutex
 	Marks []LocationMark
+
+	// agg is built for the locations with many marks, Marks must be modified
+	// only with Add, Pop and Set to keep it in sync
+	agg *MarksAggregate
 }
 
 func (lm *LocationMarks) Add(m LocationMark) {
 	lm.M.Lock()
 	lm.Marks = append(lm.Marks, m)
+	if lm.agg != nil {
+		lm.agg.Add(m)
+	}
 	lm.M.Unlock()
 }
 
@@ -41,22 +48,59 @@ func (lm *LocationMarks) Pop(visitID uint32) (LocationMark, bool) {
 	for n, i := range lm.Marks {
 		if i.Visit == visitID {
 			lm.Marks = lm.Marks[:n+copy(lm.Marks[n:], lm.Marks[n+1:])]
+			if lm.agg != nil {
+				lm.agg.Remove(i)
+			}
 			return i, true
 		}
 	}
 	return LocationMark{}, false
 }
 
+// Set replaces the n-th mark, lm.M must be locked
+func (lm *LocationMarks) Set(n int, m LocationMark) {
+	if lm.agg != nil {
+		lm.agg.Remove(lm.Marks[n])
+		lm.agg.Add(m)
+	}
+	lm.Marks[n] = m
+}
+
+// Sum returns sum and count of the marks matching the query if the aggregate
+// is built and could answer it, lm.M must be locked for reading
+func (lm *LocationMarks) Sum(q MarksQuery) (sum, count int, ok bool) {
+	if lm.agg == nil {
+		return 0, 0, false
+	}
+	return lm.agg.Sum(q)
+}
+
+// Aggregate builds the aggregate for the reference time of now if there are
+// enough marks
+func (lm *LocationMarks) Aggregate(now time.Time) {
+	lm.M.Lock()
+	defer lm.M.Unlock()
+	if len(lm.Marks) < AggregateMinMarks {
+		return
+	}
+	if _, _, ok := lm.Sum(MarksQuery{Now: now}); ok {
+		return
+	}
+	lm.agg = NewMarksAggregate(now, lm.Marks)
+}
+
 // UserVisit is used to filter and output the user visit info
 //    fromDate - посещения с visited_at > fromDate
 //    toDate - посещения с visited_at < toDate
 //    country - название страны, в которой находятся интересующие достопримечательности
+//    city - название города
 //    toDistance - возвращать только те места, у которых расстояние от города меньше этого параметра
 //easyjson:json
 type UserVisit struct {
 	VisitedAt int    `json:"visited_at"`
 	Place     string `json:"place"`
 	Country   string `json:"-"`
+	City      string `json:"-"`
 	Visit     uint32 `json:"-"`
 	Location  uint32 `json:"-"`
 	Distance  uint32 `json:"-"`
@@ -81,9 +125,13 @@ func (uv UserVisitByVisitedAt) Swap(i, j int) {
 	uv[i], uv[j] = uv[j], uv[i]
 }
 
-// Less is part of sort.Interface. It is implemented by calling the "by" closure in the sorter.
+// Less is part of sort.Interface. Visits with the same visited_at are
+// ordered by ID, so the order is stable and could be used for paging.
 func (uv UserVisitByVisitedAt) Less(i, j int) bool {
-	return uv[i].VisitedAt < uv[j].VisitedAt
+	if uv[i].VisitedAt != uv[j].VisitedAt {
+		return uv[i].VisitedAt < uv[j].VisitedAt
+	}
+	return uv[i].Visit < uv[j].Visit
 }
 
 func (uv *UserVisits) Add(v UserVisit) {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/ei-grad/hlcup/app"
+)
+
+// Exit codes of the graceful shutdown
+const (
+	exitOK = 0
+	// exitPersistFailed is returned if the snapshot or the WAL couldn't be
+	// written on exit, some writes could be lost. 1 is log.Fatal and 2 is
+	// the flag parsing error.
+	exitPersistFailed = 4
+	// exitDrainTimeout is returned if the in-flight requests didn't finish
+	// in time
+	exitDrainTimeout = 3
+)
+
+// serve serves the listeners until SIGTERM or SIGINT, then stops accepting
+// connections, drains the in-flight requests and closes the application.
+// It returns the process exit code.
+func serve(lns []net.Listener, h fasthttp.RequestHandler, application *app.Application, drainTimeout time.Duration, persist bool, stopTop chan struct{}) int {
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	s := &fasthttp.Server{Handler: h}
+	served := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			served <- s.Serve(ln)
+		}(ln)
+	}
+
+	select {
+	case err := <-served:
+		log.Fatal("fasthttp.Serve:", err)
+	case sig := <-stop:
+		log.Printf("shutdown: got %s, draining requests for up to %s", sig, drainTimeout)
+	}
+
+	close(stopTop)
+
+	t0 := time.Now()
+
+	for _, ln := range lns {
+		ln.Close()
+	}
+
+	code := exitOK
+
+	if !application.Drain(drainTimeout) {
+		code = exitDrainTimeout
+	}
+
+	if err := application.Close(persist); err != nil {
+		code = exitPersistFailed
+	}
+
+	log.Printf("shutdown: finished in %s, exit code %d", time.Since(t0), code)
+
+	return code
+}
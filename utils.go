@@ -7,24 +7,11 @@ import (
 	"os/exec"
 	"os/signal"
 	"os/user"
-	"runtime"
 	"syscall"
 	"time"
-)
 
-func memstats() {
-	var memstats runtime.MemStats
-	if os.Getenv("DEBUG_MEMSTATS") != "1" {
-		return
-	}
-	go func() {
-		for {
-			runtime.ReadMemStats(&memstats)
-			log.Printf("memstats: %+v", memstats)
-			time.Sleep(10 * time.Second)
-		}
-	}()
-}
+	"github.com/ei-grad/hlcup/app"
+)
 
 const RLIMIT_MEMLOCK = 8 // nolint
 
@@ -47,28 +34,31 @@ func whoami() {
 	log.Printf("Who am I: %+v", u)
 }
 
-func top() {
-
-	time.Sleep(30 * time.Second)
+// top runs top in batch mode until stop is closed
+func top(stop <-chan struct{}, done chan<- struct{}) {
 
-	var gracefulStop = make(chan os.Signal)
+	defer close(done)
 
-	signal.Notify(gracefulStop, syscall.SIGTERM)
-	signal.Notify(gracefulStop, syscall.SIGINT)
+	select {
+	case <-time.After(30 * time.Second):
+	case <-stop:
+		return
+	}
 
 	cmd := exec.Command("top", "-b", "-d30")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		log.Print("top: ", err)
+		return
+	}
 
-	<-gracefulStop
+	<-stop
 
 	cmd.Process.Kill()
 
 	cmd.Wait()
 
-	os.Exit(0)
-
 }
 
 func cpuinfo() {
@@ -88,3 +78,16 @@ func swapon() {
 	cmd.Start()
 	cmd.Wait()
 }
+
+// reopenOnSIGHUP reopens the access log after logrotate moves it
+func reopenOnSIGHUP(l *app.AccessLog) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := l.Reopen(); err != nil {
+			log.Print("access log: can't reopen: ", err)
+		} else {
+			log.Print("access log: reopened")
+		}
+	}
+}